@@ -2,27 +2,32 @@ package api
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/wwqdrh/file-share/utils"
 )
 
-func parsePath(filename string) (map[string]interface{}, error) {
+func (s *Server) parsePath(filename string) (map[string]interface{}, error) {
 	if filename == "" {
 		return map[string]interface{}{
 			"finalPath": "",
 			"filePaths": []string{},
 			"startPath": "",
+			"room":      "",
 		}, nil
 	}
 
@@ -39,34 +44,33 @@ func parsePath(filename string) (map[string]interface{}, error) {
 	}
 
 	startPath := filteredPaths[0]
-	startFile := GetFile(startPath)
+	startFile := s.GetFile(startPath)
 	if startFile.Name == "" {
 		return nil, fmt.Errorf("分享列表未找到该文件")
 	}
 
+	// Nested paths resolve below the shared directory and may not leave it
+	finalPath := startFile.Path
+	for _, p := range filteredPaths[1:] {
+		if p == "." || p == ".." || strings.ContainsAny(p, `\`) {
+			return nil, fmt.Errorf("invalid path")
+		}
+		finalPath = filepath.Join(finalPath, p)
+	}
+
 	return map[string]interface{}{
-		"finalPath": startFile.Path,
+		"finalPath": finalPath,
 		"filePaths": filteredPaths,
 		"startPath": startPath,
+		"room":      utils.RoomName(startFile.Room),
 	}, nil
 }
 
-func StopServer() {
-	if server != nil {
-		server.Close()
-	}
-	status = StatusStop
-	TriggerEvent(map[string]interface{}{
-		"type": "server.statusChange",
-		"data": map[string]string{"status": StatusStop},
-	})
-}
-
 // Handler functions
-func HandleFiles(w http.ResponseWriter, r *http.Request) {
+func (s *Server) HandleFiles(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Query().Get("path")
 
-	parseResult, err := parsePath(path)
+	parseResult, err := s.parsePath(path)
 	if err != nil {
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"code":    500,
@@ -75,38 +79,100 @@ func HandleFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	finalPath := parseResult["finalPath"].(string)
-	if finalPath == "" {
+	query, err := utils.ParseListQuery(r.URL.Query())
+	if err != nil {
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"code": 200,
-			"data": map[string]interface{}{
-				"path":  []string{},
-				"files": ListFiles(),
-			},
+			"code":    400,
+			"message": err.Error(),
 		})
 		return
 	}
 
+	// The shared list is that of the requested room, paths below an
+	// entry are only listed to members of the entry's room
+	var files []utils.FileInfo
+	relPath := ""
+	room := parseResult["room"].(string)
+	finalPath := parseResult["finalPath"].(string)
+	if finalPath == "" {
+		var ok bool
+		if room, ok = s.joinedRoom(w, r); !ok {
+			return
+		}
+		files = s.ListRoomFiles(room)
+	} else {
+		if !s.canAccess(r, room) {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"code":    403,
+				"message": "未加入该房间",
+			})
+			return
+		}
+		relPath = strings.Join(parseResult["filePaths"].([]string), "/")
+		files = ListFilesInPath(finalPath, relPath)
+	}
+	page, total, nextCursor := query.Apply(files)
+
+	// dirSize=1 adds the recursive size of directories, computed in the
+	// background and announced with a dir.size event when not cached yet
+	if r.URL.Query().Get("dirSize") == "1" {
+		for i, file := range page {
+			page[i] = s.withDirSize(file, room, strings.TrimPrefix(relPath+"/"+file.Name, "/"))
+		}
+	}
+
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"code": 200,
 		"data": map[string]interface{}{
-			"path":  parseResult["filePaths"],
-			"files": ListFilesInPath(finalPath),
+			"path":       parseResult["filePaths"],
+			"files":      page,
+			"total":      total,
+			"nextCursor": nextCursor,
 		},
 	})
 }
 
-func ListFilesInPath(path string) []interface{} {
+// withDirSize sets the recursive size of a directory shared as relPath in
+// room, marking it pending while it is being computed
+func (s *Server) withDirSize(file utils.FileInfo, room, relPath string) utils.FileInfo {
+	if file.Type != "directory" {
+		return file
+	}
+	size, ok := s.dirSizes.Lookup(file.Path, func(size int64) {
+		s.publishRoom(room, "dir.size", map[string]interface{}{
+			"path":     relPath,
+			"size":     size,
+			"sizeText": utils.ConvertBytes(size),
+		})
+	})
+	if ok {
+		file.Size = size
+		file.SizeText = utils.ConvertBytes(size)
+	} else {
+		file.SizePending = true
+	}
+	return file
+}
+
+// ListFilesInPath lists the directory at path, which is shared as relPath.
+// Images get a thumbnail URL below relPath.
+func ListFilesInPath(path, relPath string) []utils.FileInfo {
 	files, err := utils.ListFilesInDir(path)
 	if err != nil {
 		return nil
 	}
 
-	result := make([]interface{}, len(files))
 	for i, file := range files {
-		result[i] = file
+		if file.Type == "file" && utils.CanThumbnail(file.Name) {
+			files[i].Thumbnail = thumbnailURL(relPath + "/" + file.Name)
+		}
 	}
-	return result
+	return files
+}
+
+// thumbnailURL returns the thumbnail URL of the shared file at relPath
+func thumbnailURL(relPath string) string {
+	return "/api/thumbnail?filename=" + url.QueryEscape(relPath)
 }
 
 func ParseFileName(path string) string {
@@ -117,70 +183,154 @@ func ZipDirectory(sourcePath, destPath string) error {
 	return nil
 }
 
-func HandleDownload(w http.ResponseWriter, r *http.Request) {
+// requestFile is the local file a request's filename parameter refers to
+type requestFile struct {
+	Path string
+	Info os.FileInfo
+	// EntryName is set when the file is a top-level shared entry
+	EntryName string
+	// Name is the file name presented to clients
+	Name string
+	// Room is the room of the shared entry the file lies in
+	Room string
+}
+
+// resolveRequestFile checks the token query parameter and resolves the
+// filename parameter, which must lie in a room the client joined. On failure
+// it writes the error status and returns false.
+func (s *Server) resolveRequestFile(w http.ResponseWriter, r *http.Request) (requestFile, bool) {
 	token := r.URL.Query().Get("token")
-	if GetAuthEnable() && (token == "" || !session[token]) {
+	if s.GetAuthEnable() && !s.validSession(token) {
 		w.WriteHeader(http.StatusForbidden)
-		return
+		return requestFile{}, false
 	}
 
 	filename := r.URL.Query().Get("filename")
-	parseResult, err := parsePath(filename)
+	parseResult, err := s.parsePath(filename)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
-		return
+		return requestFile{}, false
 	}
 
 	sourceFilePath := parseResult["finalPath"].(string)
 	if sourceFilePath == "" {
 		w.WriteHeader(http.StatusBadRequest)
-		return
+		return requestFile{}, false
 	}
+	if !s.canAccess(r, parseResult["room"].(string)) {
+		w.WriteHeader(http.StatusForbidden)
+		return requestFile{}, false
+	}
+	filePaths := parseResult["filePaths"].([]string)
 
 	// Check if file exists
-	if _, err := os.Stat(sourceFilePath); os.IsNotExist(err) {
-		fmt.Println("file not exist")
-		// Remove file from database if it doesn't exist
-		filePaths := parseResult["filePaths"].([]string)
-		if len(filePaths) > 0 {
-			utils.RemoveFileFromDb(utils.FileInfo{Name: filePaths[0]})
+	fileInfo, err := os.Stat(sourceFilePath)
+	if os.IsNotExist(err) {
+		s.logger.Printf("file not exist: %s\n", sourceFilePath)
+		// Remove file from database if the shared entry itself doesn't exist
+		if len(filePaths) == 1 {
+			s.RemoveFile(utils.FileInfo{Name: filePaths[0]})
 		}
 		w.WriteHeader(http.StatusNotFound)
-		return
+		return requestFile{}, false
 	}
-
-	fileInfo, err := os.Stat(sourceFilePath)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return requestFile{}, false
+	}
+
+	file := requestFile{
+		Path: sourceFilePath,
+		Info: fileInfo,
+		Name: utils.ExtractFileName(sourceFilePath),
+		Room: parseResult["room"].(string),
+	}
+	if len(filePaths) == 1 {
+		// Uploads are stored under their hash, name them after the entry
+		file.EntryName = filePaths[0]
+		file.Name = filePaths[0]
 	}
+	return file, true
+}
 
-	if fileInfo.IsDir() {
-		// Handle directory download
-		fileName := utils.ExtractFileName(sourceFilePath)
-		destZipFile := filepath.Join(filepath.Dir(sourceFilePath), fileName+".zip")
+func (s *Server) HandleDownload(w http.ResponseWriter, r *http.Request) {
+	file, ok := s.resolveRequestFile(w, r)
+	if !ok {
+		return
+	}
 
-		if err := utils.ZipDirectory(sourceFilePath, destZipFile); err != nil {
+	servePath, downloadName := file.Path, file.Name
+	if file.Info.IsDir() {
+		// Handle directory download, the archive is cached until the
+		// directory changes so interrupted downloads can resume
+		archivePath, err := utils.CachedZipDirectory(file.Path, s.paths.ArchiveDir())
+		if err != nil {
+			s.logger.Printf("zip directory error: %v\n", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		defer os.Remove(destZipFile) // Clean up zip file after sending
 
-		downloadName := utils.ExtractFileName(destZipFile)
+		servePath, downloadName = archivePath, file.Name+".zip"
 		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", url.QueryEscape(downloadName)))
 		w.Header().Set("Content-Type", "application/zip")
-		http.ServeFile(w, r, destZipFile)
+		s.setDigestHeaders(w, archivePath, "")
 	} else {
 		// Handle file download
-		downloadName := utils.ExtractFileName(sourceFilePath)
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", url.QueryEscape(downloadName)))
-		w.Header().Set("download-filename", url.QueryEscape(downloadName))
-		http.ServeFile(w, r, sourceFilePath)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", url.QueryEscape(file.Name)))
+		w.Header().Set("download-filename", url.QueryEscape(file.Name))
+		s.setDigestHeaders(w, file.Path, file.EntryName)
 	}
+
+	s.serveTransfer(w, r, servePath, func(interrupt func()) *transfer {
+		return s.startTransfer(r, TransferDownload, downloadName, file.Room, 0, interrupt)
+	})
 }
 
-func HandleLogin(w http.ResponseWriter, r *http.Request) {
-	if !GetAuthEnable() {
+// setDigestHeaders sets ETag, Digest and Repr-Digest for the file at path,
+// which also lets http.ServeFile answer If-Range and If-None-Match
+func (s *Server) setDigestHeaders(w http.ResponseWriter, path, entryName string) {
+	hash, err := s.fileHash(path, entryName)
+	if err != nil {
+		s.logger.Printf("hash file error: %v\n", err)
+		return
+	}
+	etag, digest, reprDigest := utils.DigestHeaders(hash)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Digest", digest)
+	w.Header().Set("Repr-Digest", reprDigest)
+}
+
+// fileHash returns the SHA-256 of path. Top-level shared files keep their
+// digest in their FileInfo, everything else uses the in-memory cache.
+func (s *Server) fileHash(path, entryName string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	if entryName != "" {
+		entry, err := s.db.GetFile(entryName)
+		if err == nil && entry.Hash != "" && entry.Size == info.Size() && entry.ModTime == info.ModTime().UnixMilli() {
+			return entry.Hash, nil
+		}
+	}
+
+	hash, err := s.hashes.FileHash(path)
+	if err != nil {
+		return "", err
+	}
+	if entryName != "" {
+		s.db.UpdateFile(entryName, func(f *utils.FileInfo) {
+			f.Hash = hash
+			f.Size = info.Size()
+			f.ModTime = info.ModTime().UnixMilli()
+		})
+	}
+	return hash, nil
+}
+
+func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	if !s.GetAuthEnable() {
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"code":    200,
 			"message": "success",
@@ -196,7 +346,7 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if loginData.Password != GetPassword() {
+	if loginData.Password != s.settings.Get().Password {
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"code":    403,
 			"message": "密码错误",
@@ -208,9 +358,9 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 	hash.Write([]byte(loginData.Password))
 	token := hex.EncodeToString(hash.Sum(nil))
 
-	sessionMutex.Lock()
-	session[token] = true
-	sessionMutex.Unlock()
+	s.sessionMutex.Lock()
+	s.sessions[token] = true
+	s.sessionMutex.Unlock()
 
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"code": 200,
@@ -221,8 +371,15 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func HandleAddFile(w http.ResponseWriter, r *http.Request) {
-	file, header, err := r.FormFile("file")
+func (s *Server) HandleAddFile(w http.ResponseWriter, r *http.Request) {
+	room, ok := s.joinedRoom(w, r)
+	if !ok {
+		return
+	}
+
+	// Stream the file part instead of buffering the whole form, so that its
+	// progress can be followed while it arrives
+	part, err := uploadPart(r)
 	if err != nil {
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"code":    500,
@@ -230,11 +387,11 @@ func HandleAddFile(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-	defer file.Close()
+	defer part.Close()
+	filename := part.FileName()
 
-	// Create upload directory if it doesn't exist
-	uploadDir := filepath.Join(os.Getenv("HOME"), ".hui", "cache", "fs-share", "files")
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+	// Create temp directory if it doesn't exist
+	if err := os.MkdirAll(s.paths.TempDir(), 0755); err != nil {
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"code":    500,
 			"message": "创建上传目录失败",
@@ -242,9 +399,8 @@ func HandleAddFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create the destination file
-	dstPath := filepath.Join(uploadDir, header.Filename)
-	dst, err := os.Create(dstPath)
+	// Create the temp file the upload streams into
+	dst, err := os.CreateTemp(s.paths.TempDir(), "upload-*")
 	if err != nil {
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"code":    500,
@@ -252,10 +408,28 @@ func HandleAddFile(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	defer os.Remove(dst.Name()) // No-op once the blob store took the file
 	defer dst.Close()
 
-	// Copy the uploaded file to the destination
-	if _, err := io.Copy(dst, file); err != nil {
+	// Copy the uploaded file to the destination, hashing it on the way
+	controller := http.NewResponseController(w)
+	t := s.startTransfer(r, TransferUpload, filename, room, r.ContentLength, func() {
+		controller.SetReadDeadline(time.Now())
+	})
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(dst, hash), &transferReader{Reader: part, s: s, t: t})
+	if err == nil {
+		err = dst.Close()
+	}
+	s.finishTransfer(t, err)
+	if errors.Is(err, errTransferCancelled) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    500,
+			"message": "上传已取消",
+		})
+		return
+	}
+	if err != nil {
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"code":    500,
 			"message": "保存文件失败",
@@ -264,22 +438,65 @@ func HandleAddFile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	sourceip := getClientIP(r)
-	utils.AddFileToDb(
-		utils.FileInfo{
-			Name:     header.Filename,
-			Path:     dstPath,
-			Username: sourceip,
-		},
-	)
+	entry, deduplicated, err := s.db.AddUpload(dst.Name(), s.paths.BlobDir(), utils.FileInfo{
+		Name:     filename,
+		Username: sourceip,
+		Hash:     hex.EncodeToString(hash.Sum(nil)),
+		Size:     size,
+		Room:     room,
+	})
+	if err != nil {
+		s.logger.Printf("store upload error: %v\n", err)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    500,
+			"message": "保存文件失败",
+		})
+		return
+	}
+
+	s.index.AddFile(entry.Name, entry.Name, entry.Path)
+	s.publishRoom(room, "file.added", map[string]string{"name": entry.Name, "username": sourceip, "hash": entry.Hash})
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"code":    200,
+		"code": 200,
+		"data": map[string]interface{}{
+			"name":         entry.Name,
+			"hash":         entry.Hash,
+			"size":         entry.Size,
+			"deduplicated": deduplicated,
+		},
 		"message": "添加成功",
 	})
 }
 
-func HandleAddText(w http.ResponseWriter, r *http.Request) {
+// uploadPart returns the part of the multipart request r holding the
+// uploaded file, skipping other fields
+func uploadPart(r *http.Request) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" && part.FileName() != "" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+func (s *Server) HandleAddText(w http.ResponseWriter, r *http.Request) {
+	room, ok := s.joinedRoom(w, r)
+	if !ok {
+		return
+	}
+
 	var data struct {
-		Message string `json:"message"`
+		Message  string `json:"message"`
+		Format   string `json:"format"`
+		Language string `json:"language"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 		json.NewEncoder(w).Encode(map[string]interface{}{
@@ -288,98 +505,120 @@ func HandleAddText(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	if len(data.Message) > utils.MaxTextSize {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    413,
+			"message": "消息过长",
+		})
+		return
+	}
+	if _, _, err := utils.ParseTextFormat(data.Format, data.Language); err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    400,
+			"message": "消息格式无效",
+		})
+		return
+	}
 
-	sourceIP := getClientIP(r)
-	AddText(data.Message, sourceIP)
+	message, err := s.AddText(utils.TextMessage{
+		Content:  data.Message,
+		Format:   data.Format,
+		Language: data.Language,
+		Author:   getClientIP(r),
+		Client:   getClientIP(r),
+		Room:     room,
+	})
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    500,
+			"message": "保存消息失败",
+		})
+		return
+	}
 
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"code":    200,
+		"data":    message,
 		"message": "添加成功",
 	})
 }
 
-func GetServerStatus() string {
-	return status
-}
-
-func GetFile(name string) utils.FileInfo {
-	file, _ := utils.GetFileFromDb(name)
+func (s *Server) GetFile(name string) utils.FileInfo {
+	file, _ := s.db.GetFile(name)
 	return file
 }
 
-func RemoveFile(file interface{}) {
+func (s *Server) RemoveFile(file interface{}) {
 	if f, ok := file.(utils.FileInfo); ok {
-		utils.RemoveFileFromDb(f)
+		s.db.RemoveFile(f)
+		s.index.RemovePrefix(f.Name)
 	}
 }
 
-func ListFiles() []interface{} {
-	files, err := utils.ListFilesFromDb()
+// ListFiles returns the shared entries with their current metadata
+// followed by the text history
+func (s *Server) ListFiles() []utils.FileInfo {
+	files, err := s.db.ListFiles()
 	if err != nil {
 		return nil
 	}
+	if texts, err := s.texts.List(); err == nil {
+		for _, text := range texts {
+			files = append(files, text.FileInfo())
+		}
+	}
 
-	result := make([]interface{}, len(files))
 	for i, file := range files {
-		result[i] = file
+		if file.Type == "file" || file.Type == "directory" {
+			if info, err := os.Stat(file.Path); err == nil {
+				utils.FillMetadata(&files[i], info)
+			}
+		}
+		if file.Type == "file" && utils.CanThumbnail(file.Name) {
+			files[i].Thumbnail = thumbnailURL(file.Name)
+		}
 	}
-	return result
+	return files
 }
 
-func AddText(text, username string) {
-	utils.AddTextToDb(text, username)
+// AddText adds message to the text history, see utils.TextStore.Add
+func (s *Server) AddText(message utils.TextMessage) (utils.TextMessage, error) {
+	message, err := s.texts.Add(message)
+	if err != nil {
+		s.logger.Printf("add text error: %v\n", err)
+		return message, err
+	}
+	s.index.AddText(textIndexID(message.ID), message.Title, message.Content)
+	s.publishRoom(message.Room, "text.added", map[string]string{"id": message.ID, "username": message.Author})
+	return message, nil
 }
 
+// getClientIP returns the address of the peer of r, which identifies the
+// client. IPv4-mapped IPv6 addresses are reported as IPv4, so that a
+// client has the same identity on IPv4 and dual-stack listeners.
 func getClientIP(r *http.Request) string {
-	ip := r.RemoteAddr
-	re := regexp.MustCompile(`\d+\.\d+\.\d+\.\d+`)
-	matches := re.FindString(ip)
-
-	realIP := r.Header.Get("X-Real-IP")
-	if realIP != "" {
-		return realIP
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
 	}
-	return matches
-}
-
-const (
-	StatusStart = "start"
-	StatusStop  = "stop"
-)
-
-var (
-	session      = make(map[string]bool)
-	server       *http.Server
-	status       = StatusStop
-	sessionMutex sync.RWMutex
-)
-
-// Empty function stubs for external dependencies
-func GetAuthEnable() bool {
-	return false
-}
-
-func GetPassword() string {
-	return ""
-}
-
-func GetUrl() string {
-	return "http://localhost:8080"
-}
-
-func GetUploadPath() string {
-	return "./uploads"
-}
-
-func RegistryEventListener(event string, callback func()) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.Unmap().String()
+	}
+	return host
 }
 
-func TriggerEvent(event interface{}) {
+// isHostClient reports whether r comes from the machine running the
+// server, which may manage the transfers and settings of everyone. Loopback
+// requests relayed by an untrusted proxy do not count, see Server.realIP.
+func isHostClient(r *http.Request) bool {
+	return utils.IsLoopback(getClientIP(r)) && r.Context().Value(untrustedProxyKey{}) == nil
 }
 
-func AuthFilter(next http.Handler) http.Handler {
+// AuthFilter rejects API requests without a valid session token when
+// authentication is enabled in the settings
+func (s *Server) AuthFilter(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !GetAuthEnable() {
+		if !s.GetAuthEnable() {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -390,6 +629,11 @@ func AuthFilter(next http.Handler) http.Handler {
 			r.URL.Path == "/favicon.ico" ||
 			r.URL.Path == "/api/login" ||
 			strings.HasPrefix(r.URL.Path, "/api/download") ||
+			strings.HasPrefix(r.URL.Path, "/api/preview") ||
+			strings.HasPrefix(r.URL.Path, "/api/thumbnail") ||
+			isRawTextPath(r.URL.Path) ||
+			isOfferDownloadPath(r.URL.Path) ||
+			r.URL.Path == "/api/ws" ||
 			strings.HasPrefix(r.URL.Path, "/static") {
 			next.ServeHTTP(w, r)
 			return
@@ -397,11 +641,7 @@ func AuthFilter(next http.Handler) http.Handler {
 
 		// Validate session
 		token := r.Header.Get("Authorization")
-		sessionMutex.RLock()
-		_, exists := session[token]
-		sessionMutex.RUnlock()
-
-		if exists {
+		if s.validSession(token) {
 			next.ServeHTTP(w, r)
 		} else {
 			w.WriteHeader(http.StatusUnauthorized)
@@ -412,3 +652,18 @@ func AuthFilter(next http.Handler) http.Handler {
 		}
 	})
 }
+
+// GetAuthEnable returns whether login is required
+func (s *Server) GetAuthEnable() bool {
+	return s.settings.Get().AuthEnable
+}
+
+// validSession reports whether token was issued by HandleLogin
+func (s *Server) validSession(token string) bool {
+	if token == "" {
+		return false
+	}
+	s.sessionMutex.RLock()
+	defer s.sessionMutex.RUnlock()
+	return s.sessions[token]
+}
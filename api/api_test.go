@@ -0,0 +1,57 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wwqdrh/file-share/utils"
+)
+
+func TestParsePath(t *testing.T) {
+	s := newTestServer(t)
+	shared := filepath.Join(t.TempDir(), "docs")
+	if err := os.MkdirAll(filepath.Join(shared, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.AddFile(utils.FileInfo{Path: shared}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filename string
+		want     string
+		wantErr  bool
+	}{
+		{filename: "", want: ""},
+		{filename: "docs", want: shared},
+		{filename: "docs/sub/a.txt", want: filepath.Join(shared, "sub", "a.txt")},
+		{filename: "/docs//sub/", want: filepath.Join(shared, "sub")},
+		{filename: "missing/a.txt", wantErr: true},
+		{filename: "///", wantErr: true},
+		{filename: "docs/..", wantErr: true},
+		{filename: "docs/../../etc/passwd", wantErr: true},
+		{filename: "docs/sub/../../x", wantErr: true},
+		{filename: "docs/./sub", wantErr: true},
+		{filename: `docs/..\..\etc`, wantErr: true},
+		{filename: `docs/sub\a`, wantErr: true},
+		{filename: "..", wantErr: true},
+		{filename: "../docs", wantErr: true},
+	}
+	for _, tt := range tests {
+		result, err := s.parsePath(tt.filename)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parsePath(%q) = %v, want an error", tt.filename, result["finalPath"])
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePath(%q) error: %v", tt.filename, err)
+			continue
+		}
+		if got := result["finalPath"].(string); got != tt.want {
+			t.Errorf("parsePath(%q) = %q, want %q", tt.filename, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/wwqdrh/file-share/utils"
+)
+
+// transferChunk is the most a transfer moves between two rate limit waits
+const transferChunk = 32 * 1024
+
+// bandwidth holds the rate limiters of a server and keeps them in line
+// with the bandwidth settings
+type bandwidth struct {
+	lock     sync.Mutex
+	settings utils.Bandwidth
+	upload   *utils.RateLimiter
+	download *utils.RateLimiter
+	// clients holds the limiters of the clients with running transfers
+	clients map[string]*clientLimiters
+}
+
+// clientLimiters are the limiters of one client IP, shared by its
+// transfers
+type clientLimiters struct {
+	upload   *utils.RateLimiter
+	download *utils.RateLimiter
+	// transfers counts the running transfers using the limiters
+	transfers int
+}
+
+// newBandwidth creates limiters applying settings
+func newBandwidth(settings utils.Bandwidth) *bandwidth {
+	return &bandwidth{
+		settings: settings,
+		upload:   utils.NewRateLimiter(settings.Global.Upload),
+		download: utils.NewRateLimiter(settings.Global.Download),
+		clients:  make(map[string]*clientLimiters),
+	}
+}
+
+// apply changes the rates of all limiters, including those of running
+// transfers
+func (b *bandwidth) apply(settings utils.Bandwidth) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.settings = settings
+	b.upload.SetRate(settings.Global.Upload)
+	b.download.SetRate(settings.Global.Download)
+	for client, limiters := range b.clients {
+		limit := settings.ClientLimit(client)
+		limiters.upload.SetRate(limit.Upload)
+		limiters.download.SetRate(limit.Download)
+	}
+}
+
+// acquire returns the limiters a transfer of kind by client has to pass
+// and a function releasing them once the transfer is over
+func (b *bandwidth) acquire(client, kind string) ([]*utils.RateLimiter, func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	limiters := b.clients[client]
+	if limiters == nil {
+		limit := b.settings.ClientLimit(client)
+		limiters = &clientLimiters{
+			upload:   utils.NewRateLimiter(limit.Upload),
+			download: utils.NewRateLimiter(limit.Download),
+		}
+		b.clients[client] = limiters
+	}
+	limiters.transfers++
+
+	release := func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if limiters.transfers--; limiters.transfers == 0 {
+			delete(b.clients, client)
+		}
+	}
+	if kind == TransferUpload {
+		return []*utils.RateLimiter{b.upload, limiters.upload}, release
+	}
+	return []*utils.RateLimiter{b.download, limiters.download}, release
+}
+
+// HandleGetBandwidth returns the bandwidth settings
+func (s *Server) HandleGetBandwidth(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code": 200,
+		"data": s.settings.Get().Bandwidth,
+	})
+}
+
+// HandleUpdateBandwidth replaces the bandwidth settings with the JSON body,
+// rates being bytes per second and 0 unlimited. The new limits apply to
+// running transfers as well. Only the machine running the server may
+// change them.
+func (s *Server) HandleUpdateBandwidth(w http.ResponseWriter, r *http.Request) {
+	if !isHostClient(r) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    403,
+			"message": "只能在本机修改设置",
+		})
+		return
+	}
+
+	var limits utils.Bandwidth
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil || limits.Validate() != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    400,
+			"message": "带宽设置无效",
+		})
+		return
+	}
+
+	settings := s.settings.Get()
+	settings.Bandwidth = limits
+	if err := s.settings.Update(settings); err != nil {
+		s.logger.Printf("update settings error: %v\n", err)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    500,
+			"message": "保存设置失败",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    200,
+		"data":    limits,
+		"message": "保存成功",
+	})
+}
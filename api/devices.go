@@ -0,0 +1,594 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wwqdrh/file-share/utils"
+)
+
+const (
+	// deviceRetention is how long disconnected devices stay listed
+	deviceRetention = 24 * time.Hour
+	// offerTTL is how long an offer waits for the recipient to answer
+	offerTTL = 10 * time.Minute
+	// acceptedOfferTTL is how long an accepted file stays downloadable
+	acceptedOfferTTL = time.Hour
+)
+
+// Device is a browser or client connected to the SSE stream. Its ID is
+// the subscriber ID of the connection.
+type Device struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	UserAgent string `json:"userAgent"`
+	IP        string `json:"ip"`
+	// LastSeen is unix milliseconds, now for connected devices
+	LastSeen int64 `json:"lastSeen"`
+	Online   bool  `json:"online"`
+	// Status is the presence set by the device: online, away or busy
+	Status string `json:"status"`
+	// LastActive is unix milliseconds of the last heartbeat or message of
+	// a connected device, Idle is set once it is older than presenceIdleAfter
+	LastActive int64 `json:"lastActive"`
+	Idle       bool  `json:"idle"`
+}
+
+// validPresence reports whether status is a presence a device may set
+func validPresence(status string) bool {
+	return status == "online" || status == "away" || status == "busy"
+}
+
+// Statuses of an offer
+const (
+	OfferPending  = "pending"
+	OfferAccepted = "accepted"
+	OfferDeclined = "declined"
+	OfferExpired  = "expired"
+)
+
+// offer is a text or file sent to one device, only handed out once the
+// recipient accepted it
+type offer struct {
+	ID string `json:"id"`
+	// From is the device ID of the sender, empty when sent without one
+	From     string `json:"from,omitempty"`
+	FromName string `json:"fromName"`
+	FromIP   string `json:"fromIp"`
+	To       string `json:"to"`
+	// Kind is "text" or "file"
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Status string `json:"status"`
+	// CreatedAt and ExpiresAt are unix milliseconds
+	CreatedAt int64 `json:"createdAt"`
+	ExpiresAt int64 `json:"expiresAt"`
+
+	text string
+	path string
+	// toIP is the address the recipient answers from
+	toIP string
+}
+
+// deviceName derives a readable device name from a user agent, e.g.
+// "Chrome on Windows", falling back to ip
+func deviceName(userAgent, ip string) string {
+	platform := ""
+	for _, p := range [][2]string{
+		{"iPhone", "iPhone"}, {"iPad", "iPad"}, {"Android", "Android"},
+		{"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, p[0]) {
+			platform = p[1]
+			break
+		}
+	}
+
+	browser := ""
+	for _, b := range [][2]string{
+		{"Edg/", "Edge"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+	} {
+		if strings.Contains(userAgent, b[0]) {
+			browser = b[1]
+			break
+		}
+	}
+	if browser == "" && platform == "" {
+		// Command line clients such as curl/8.5.0
+		browser, _, _ = strings.Cut(userAgent, "/")
+	}
+
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case browser != "":
+		return browser
+	case platform != "":
+		return platform
+	}
+	return ip
+}
+
+// addDevice registers the device of a new SSE subscriber
+func (h *Hub) addDevice(sub *Subscriber, r *http.Request) {
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" {
+		name = deviceName(r.UserAgent(), sub.Client)
+	}
+	now := time.Now().UnixMilli()
+	sub.Device = Device{
+		ID:         sub.ID,
+		Name:       truncateName(name),
+		UserAgent:  r.UserAgent(),
+		IP:         sub.Client,
+		Online:     true,
+		LastSeen:   now,
+		Status:     "online",
+		LastActive: now,
+	}
+
+	h.subLock.Lock()
+	defer h.subLock.Unlock()
+	delete(h.offline, sub.ID)
+}
+
+// truncateName limits device names to 64 characters
+func truncateName(name string) string {
+	if runes := []rune(name); len(runes) > 64 {
+		return string(runes[:64])
+	}
+	return name
+}
+
+// Devices returns the connected devices followed by the devices seen
+// within the last day, most recently seen first
+func (h *Hub) Devices() []Device {
+	h.subLock.Lock()
+	defer h.subLock.Unlock()
+
+	now := time.Now()
+	devices := make([]Device, 0, len(h.subscribers)+len(h.offline))
+	for _, sub := range h.subscribers {
+		device := sub.Device
+		device.LastSeen = now.UnixMilli()
+		devices = append(devices, device)
+	}
+	for id, device := range h.offline {
+		if now.Sub(time.UnixMilli(device.LastSeen)) > deviceRetention {
+			delete(h.offline, id)
+			continue
+		}
+		devices = append(devices, device)
+	}
+
+	sort.SliceStable(devices, func(i, j int) bool {
+		if devices[i].Online != devices[j].Online {
+			return devices[i].Online
+		}
+		return devices[i].LastSeen > devices[j].LastSeen
+	})
+	return devices
+}
+
+// Device returns the connected device with id
+func (h *Hub) Device(id string) (Device, bool) {
+	h.subLock.RLock()
+	defer h.subLock.RUnlock()
+	for _, sub := range h.subscribers {
+		if sub.ID == id {
+			return sub.Device, true
+		}
+	}
+	return Device{}, false
+}
+
+// SendTo sends an event to the subscriber with id only
+func (h *Hub) SendTo(id string, data interface{}) error {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("error marshaling event data: %v", err)
+	}
+
+	h.subLock.RLock()
+	defer h.subLock.RUnlock()
+	for _, sub := range h.subscribers {
+		if sub.ID != id {
+			continue
+		}
+		select {
+		case sub.events <- jsonData:
+			return nil
+		default:
+			return fmt.Errorf("subscriber %s too slow", id)
+		}
+	}
+	return fmt.Errorf("subscriber %s not connected", id)
+}
+
+// sendToDevice sends an event to one device and the OnEvent hook
+func (s *Server) sendToDevice(id, eventType string, data interface{}) error {
+	event := Event{Type: eventType, Data: data}
+	if s.options.OnEvent != nil {
+		s.options.OnEvent(event)
+	}
+	return s.hub.SendTo(id, event)
+}
+
+// HandleListDevices lists the connected and recently seen devices
+func (s *Server) HandleListDevices(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code": 200,
+		"data": map[string]interface{}{
+			"devices": s.hub.Devices(),
+		},
+	})
+}
+
+// HandleSendToDevice offers a text or file to one connected device, which
+// receives an offer.received event and has to accept the offer before the
+// content is handed out. The body is either JSON {"text", "from"} or a
+// multipart form with a file and an optional from field, from being the
+// device ID of the sender to notify about the answer.
+func (s *Server) HandleSendToDevice(w http.ResponseWriter, r *http.Request) {
+	target, ok := s.hub.Device(r.PathValue("id"))
+	if !ok {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    404,
+			"message": "设备不在线",
+		})
+		return
+	}
+
+	o := &offer{
+		ID:     newOfferID(),
+		FromIP: getClientIP(r),
+		To:     target.ID,
+		toIP:   target.IP,
+		Status: OfferPending,
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		if err := s.receiveOfferFile(w, r, o); errors.Is(err, errTransferCancelled) {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"code":    500,
+				"message": "上传已取消",
+			})
+			return
+		} else if err != nil {
+			s.logger.Printf("receive offer error: %v\n", err)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"code":    500,
+				"message": "文件上传失败",
+			})
+			return
+		}
+	} else {
+		var data struct {
+			Text string `json:"text"`
+			From string `json:"from"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || strings.TrimSpace(data.Text) == "" {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"code":    500,
+				"message": "消息不能为空",
+			})
+			return
+		}
+		o.Kind = "text"
+		o.Name = utils.TextTitle(data.Text)
+		o.Size = int64(len(data.Text))
+		o.text = data.Text
+		o.From = data.From
+	}
+
+	o.FromName = o.FromIP
+	if sender, ok := s.hub.Device(o.From); ok && sender.IP == o.FromIP {
+		o.FromName = sender.Name
+	} else {
+		o.From = ""
+	}
+	now := time.Now()
+	o.CreatedAt = now.UnixMilli()
+	o.ExpiresAt = now.Add(offerTTL).UnixMilli()
+
+	view := *o
+	s.offersLock.Lock()
+	s.offers[o.ID] = o
+	s.offersLock.Unlock()
+	time.AfterFunc(offerTTL, func() { s.expireOffer(o.ID) })
+
+	if err := s.sendToDevice(target.ID, "offer.received", view); err != nil {
+		s.dropOffer(o.ID)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    404,
+			"message": "设备不在线",
+		})
+		return
+	}
+
+	s.logger.Printf("offer %s: %s %s to %s\n", o.ID, o.Kind, o.Name, target.Name)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    200,
+		"data":    view,
+		"message": "已发送，等待对方接收",
+	})
+}
+
+// receiveOfferFile stores the uploaded file of an offer in the temp
+// directory, where it stays until the offer is answered or expires. The
+// form is streamed like in HandleAddFile, its from field sets o.From.
+func (s *Server) receiveOfferFile(w http.ResponseWriter, r *http.Request, o *offer) error {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			switch {
+			case part.FormName() == "from":
+				from, _ := io.ReadAll(io.LimitReader(part, 256))
+				o.From = string(from)
+			case part.FormName() == "file" && part.FileName() != "" && o.path == "":
+				err = s.receiveOfferPart(w, r, o, part)
+			}
+			part.Close()
+		}
+		if err != nil {
+			o.discardFile()
+			return err
+		}
+	}
+	if o.path == "" {
+		return http.ErrMissingFile
+	}
+	return nil
+}
+
+// receiveOfferPart streams the file part of an offer form into a temp file
+func (s *Server) receiveOfferPart(w http.ResponseWriter, r *http.Request, o *offer, part *multipart.Part) error {
+	if err := os.MkdirAll(s.paths.TempDir(), 0755); err != nil {
+		return err
+	}
+	dst, err := os.CreateTemp(s.paths.TempDir(), "offer-*")
+	if err != nil {
+		return err
+	}
+	o.Kind = "file"
+	o.Name = utils.ExtractFileName(part.FileName())
+
+	controller := http.NewResponseController(w)
+	t := s.startOfferTransfer(r, TransferUpload, o, r.ContentLength, func() {
+		controller.SetReadDeadline(time.Now())
+	})
+	size, err := io.Copy(dst, &transferReader{Reader: part, s: s, t: t})
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	s.finishTransfer(t, err)
+	if err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+	o.Size = size
+	o.path = dst.Name()
+	return nil
+}
+
+// discardFile removes the received file of an offer that is not kept
+func (o *offer) discardFile() {
+	if o.path != "" {
+		os.Remove(o.path)
+		o.path = ""
+	}
+}
+
+// requestOffer returns the offer of the request path when the client is its
+// recipient. Otherwise it writes the error response and returns nil.
+func (s *Server) requestOffer(w http.ResponseWriter, r *http.Request) *offer {
+	s.offersLock.Lock()
+	o := s.offers[r.PathValue("id")]
+	s.offersLock.Unlock()
+	if o == nil || o.toIP != getClientIP(r) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    404,
+			"message": "发送请求不存在或已过期",
+		})
+		return nil
+	}
+	return o
+}
+
+// HandleAcceptOffer accepts an offer. Texts are returned right away, files
+// can be downloaded from the returned URL for an hour.
+func (s *Server) HandleAcceptOffer(w http.ResponseWriter, r *http.Request) {
+	o := s.requestOffer(w, r)
+	if o == nil {
+		return
+	}
+
+	view, ok := s.answerOffer(w, o, OfferAccepted)
+	if !ok {
+		return
+	}
+
+	if view.Kind == "file" {
+		time.AfterFunc(acceptedOfferTTL, func() { s.dropOffer(view.ID) })
+	} else {
+		s.dropOffer(view.ID)
+	}
+	s.notifySender(view, "offer.accepted")
+
+	data := map[string]interface{}{"offer": view}
+	if view.Kind == "text" {
+		data["text"] = view.text
+	} else {
+		data["downloadUrl"] = "/api/offers/" + view.ID + "/download"
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    200,
+		"data":    data,
+		"message": "已接收",
+	})
+}
+
+// HandleDeclineOffer declines an offer and discards its content
+func (s *Server) HandleDeclineOffer(w http.ResponseWriter, r *http.Request) {
+	o := s.requestOffer(w, r)
+	if o == nil {
+		return
+	}
+
+	view, ok := s.answerOffer(w, o, OfferDeclined)
+	if !ok {
+		return
+	}
+
+	s.dropOffer(view.ID)
+	s.notifySender(view, "offer.declined")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    200,
+		"message": "已拒绝",
+	})
+}
+
+// answerOffer moves a pending offer to status and returns a copy of it. An
+// offer answered before gets an error response and false.
+func (s *Server) answerOffer(w http.ResponseWriter, o *offer, status string) (offer, bool) {
+	s.offersLock.Lock()
+	pending := o.Status == OfferPending
+	if pending {
+		o.Status = status
+		if status == OfferAccepted {
+			o.ExpiresAt = time.Now().Add(acceptedOfferTTL).UnixMilli()
+		}
+	}
+	view := *o
+	s.offersLock.Unlock()
+
+	if !pending {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    409,
+			"message": "发送请求已处理",
+		})
+	}
+	return view, pending
+}
+
+// HandleDownloadOffer serves the file of an accepted offer to its
+// recipient. Like /api/download it takes the session token as a query
+// parameter so that browsers can navigate to it.
+func (s *Server) HandleDownloadOffer(w http.ResponseWriter, r *http.Request) {
+	if s.GetAuthEnable() && !s.validSession(requestToken(r)) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	s.offersLock.Lock()
+	var view offer
+	if o := s.offers[r.PathValue("id")]; o != nil {
+		view = *o
+	}
+	s.offersLock.Unlock()
+	if view.Kind != "file" || view.Status != OfferAccepted || view.toIP != getClientIP(r) {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", url.QueryEscape(view.Name)))
+	w.Header().Set("download-filename", url.QueryEscape(view.Name))
+	s.serveTransfer(w, r, view.path, func(interrupt func()) *transfer {
+		return s.startOfferTransfer(r, TransferDownload, &view, 0, interrupt)
+	})
+}
+
+// notifySender tells the device that sent o about its answer
+func (s *Server) notifySender(o offer, eventType string) {
+	if o.From == "" {
+		return
+	}
+	if err := s.sendToDevice(o.From, eventType, o); err != nil {
+		s.logger.Printf("notify sender of offer %s: %v\n", o.ID, err)
+	}
+}
+
+// expireOffer drops an offer nobody answered in time
+func (s *Server) expireOffer(id string) {
+	s.offersLock.Lock()
+	o := s.offers[id]
+	pending := o != nil && o.Status == OfferPending
+	var view offer
+	if pending {
+		o.Status = OfferExpired
+		view = *o
+	}
+	s.offersLock.Unlock()
+	if !pending {
+		return
+	}
+
+	s.dropOffer(id)
+	s.sendToDevice(view.To, "offer.expired", view)
+	s.notifySender(view, "offer.expired")
+}
+
+// dropOffer forgets an offer and removes its file
+func (s *Server) dropOffer(id string) {
+	s.offersLock.Lock()
+	o := s.offers[id]
+	delete(s.offers, id)
+	s.offersLock.Unlock()
+	if o != nil && o.path != "" {
+		os.Remove(o.path)
+	}
+}
+
+// dropOffers removes the files of all offers, e.g. when stopping
+func (s *Server) dropOffers() {
+	s.offersLock.Lock()
+	ids := make([]string, 0, len(s.offers))
+	for id := range s.offers {
+		ids = append(ids, id)
+	}
+	s.offersLock.Unlock()
+	for _, id := range ids {
+		s.dropOffer(id)
+	}
+}
+
+// isOfferDownloadPath reports whether path is /api/offers/{id}/download,
+// which checks its token itself
+func isOfferDownloadPath(path string) bool {
+	return strings.HasPrefix(path, "/api/offers/") && strings.HasSuffix(path, "/download")
+}
+
+// requestToken returns the session token of r from the Authorization
+// header or the token query parameter
+func requestToken(r *http.Request) string {
+	if token := r.Header.Get("Authorization"); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+// newOfferID returns a random offer id that cannot be guessed
+func newOfferID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
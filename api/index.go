@@ -0,0 +1,132 @@
+package api
+
+import (
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// maxIndexedFiles bounds how many files below shared directories are
+	// read into the full-text index
+	maxIndexedFiles = 20000
+	// indexSyncInterval is how old the index may get before a search
+	// triggers a rescan of the shared entries
+	indexSyncInterval = time.Minute
+)
+
+// textIndexID is the index id of a text message, files use the path that
+// /api/download accepts
+func textIndexID(id string) string {
+	return "text:" + id
+}
+
+// indexedTexts returns the contents of the text messages indexed under ids
+func (s *Server) indexedTexts(ids []string) map[string]string {
+	texts, err := s.texts.List()
+	if err != nil {
+		s.logger.Printf("list texts error: %v\n", err)
+		return nil
+	}
+	wanted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	contents := make(map[string]string, len(ids))
+	for _, text := range texts {
+		if id := textIndexID(text.ID); wanted[id] {
+			contents[id] = text.Content
+		}
+	}
+	return contents
+}
+
+// requestIndexSync rescans the shared entries in the background unless the
+// index is fresh. A forced request during a running scan is queued so that
+// the change it announces is not missed.
+func (s *Server) requestIndexSync(force bool) {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+	if s.indexSyncing {
+		s.indexQueued = s.indexQueued || force
+		return
+	}
+	if !force && time.Since(s.indexSynced) < indexSyncInterval {
+		return
+	}
+	s.indexSyncing = true
+	go s.syncIndex()
+}
+
+// syncIndex brings the full-text index in line with the shared entries.
+// Unchanged files are only stat'ed, entries that are gone are dropped.
+func (s *Server) syncIndex() {
+	defer func() {
+		s.indexLock.Lock()
+		s.indexSynced = time.Now()
+		if s.indexQueued {
+			s.indexQueued = false
+			go s.syncIndex()
+		} else {
+			s.indexSyncing = false
+		}
+		s.indexLock.Unlock()
+	}()
+
+	// Documents indexed while scanning are not in this list and stay
+	before := s.index.IDs()
+	files, err := s.db.ListFiles()
+	if err != nil {
+		s.logger.Printf("index sync error: %v\n", err)
+		return
+	}
+
+	seen := make(map[string]bool)
+	if texts, err := s.texts.List(); err == nil {
+		for _, text := range texts {
+			id := textIndexID(text.ID)
+			s.index.AddText(id, text.Title, text.Content)
+			seen[id] = true
+		}
+	}
+
+	count := 0
+	for _, file := range files {
+		switch file.Type {
+		case "file":
+			s.index.AddFile(file.Name, file.Name, file.Path)
+			seen[file.Name] = true
+		case "directory":
+			root, prefix := file.Path, file.Name
+			filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					if path != root && d != nil && d.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if !d.Type().IsRegular() {
+					return nil
+				}
+				if count >= maxIndexedFiles {
+					return fs.SkipAll
+				}
+				count++
+				rel, err := filepath.Rel(root, path)
+				if err != nil {
+					return nil
+				}
+				id := prefix + "/" + filepath.ToSlash(rel)
+				s.index.AddFile(id, d.Name(), path)
+				seen[id] = true
+				return nil
+			})
+		}
+	}
+
+	for _, id := range before {
+		if !seen[id] {
+			s.index.Remove(id)
+		}
+	}
+}
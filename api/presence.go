@@ -0,0 +1,194 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// presenceIdleAfter is how long a connected device may go without a
+	// heartbeat before it is shown as idle
+	presenceIdleAfter = 2 * time.Minute
+	// presenceCheckInterval is how often idle devices are looked for
+	presenceCheckInterval = 15 * time.Second
+)
+
+// presenceUpdate changes the display name or status of a device, empty
+// fields are left as they are
+type presenceUpdate struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// touch records a heartbeat of the connected device with id and applies
+// update. It also reports whether others should be told, i.e. the device
+// was idle or got a new name or status, and whether the device is
+// connected at all.
+func (h *Hub) touch(id string, update presenceUpdate) (Device, bool, bool) {
+	h.subLock.Lock()
+	defer h.subLock.Unlock()
+	for _, sub := range h.subscribers {
+		if sub.ID != id {
+			continue
+		}
+		device := &sub.Device
+		changed := device.Idle
+		device.Idle = false
+		device.LastActive = time.Now().UnixMilli()
+		device.LastSeen = device.LastActive
+		if name := truncateName(strings.TrimSpace(update.Name)); name != "" && name != device.Name {
+			device.Name = name
+			changed = true
+		}
+		if update.Status != "" && update.Status != device.Status {
+			device.Status = update.Status
+			changed = true
+		}
+		return *device, changed, true
+	}
+	return Device{}, false, false
+}
+
+// markIdle flags the connected devices without a heartbeat for
+// presenceIdleAfter as idle and returns those that just became idle
+func (h *Hub) markIdle(now time.Time) []Device {
+	h.subLock.Lock()
+	defer h.subLock.Unlock()
+	var idle []Device
+	for _, sub := range h.subscribers {
+		if sub.Device.Idle || now.Sub(time.UnixMilli(sub.Device.LastActive)) < presenceIdleAfter {
+			continue
+		}
+		sub.Device.Idle = true
+		sub.Device.LastSeen = now.UnixMilli()
+		idle = append(idle, sub.Device)
+	}
+	return idle
+}
+
+// Presence returns the connected devices, active ones first and most
+// recently active first among them
+func (h *Hub) Presence() []Device {
+	h.subLock.RLock()
+	now := time.Now().UnixMilli()
+	devices := make([]Device, 0, len(h.subscribers))
+	for _, sub := range h.subscribers {
+		device := sub.Device
+		device.LastSeen = now
+		devices = append(devices, device)
+	}
+	h.subLock.RUnlock()
+
+	sort.SliceStable(devices, func(i, j int) bool {
+		if devices[i].Idle != devices[j].Idle {
+			return !devices[i].Idle
+		}
+		return devices[i].LastActive > devices[j].LastActive
+	})
+	return devices
+}
+
+// setPresence records a heartbeat of the device with id, applies update
+// and announces a visible change with a presence.changed event
+func (s *Server) setPresence(id string, update presenceUpdate) (Device, bool) {
+	device, changed, ok := s.hub.touch(id, update)
+	if changed {
+		s.hub.notifyPresence("presence.changed", device)
+	}
+	return device, ok
+}
+
+// publishPresence sends a presence event about device to the other
+// subscribers and the OnEvent hook
+func (s *Server) publishPresence(eventType string, device Device) {
+	event := Event{Type: eventType, Data: device}
+	if s.options.OnEvent != nil {
+		s.options.OnEvent(event)
+	}
+	if err := s.hub.sendEvent(event, device.ID); err != nil {
+		s.logger.Printf("send event error: %v\n", err)
+	}
+}
+
+// watchPresence marks devices idle once their heartbeats stop, until the
+// hub closes
+func (s *Server) watchPresence() {
+	closed := s.hub.done()
+	ticker := time.NewTicker(presenceCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, device := range s.hub.markIdle(now) {
+				s.hub.notifyPresence("presence.changed", device)
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// HandlePresence lists the connected devices with their display name,
+// status and whether they are idle
+func (s *Server) HandlePresence(w http.ResponseWriter, r *http.Request) {
+	devices := s.hub.Presence()
+	idle := 0
+	for _, device := range devices {
+		if device.Idle {
+			idle++
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code": 200,
+		"data": map[string]interface{}{
+			"devices": devices,
+			"online":  len(devices) - idle,
+			"idle":    idle,
+		},
+	})
+}
+
+// HandleHeartbeat keeps a device of the client active. The optional JSON
+// body {"name", "status"} changes its display name or status as well.
+// Clients on SSE call it periodically while the user is active, WebSocket
+// clients count as active with every message they send.
+func (s *Server) HandleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	var update presenceUpdate
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"code":    400,
+				"message": "参数错误",
+			})
+			return
+		}
+	}
+	if update.Status != "" && !validPresence(update.Status) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    400,
+			"message": "状态无效",
+		})
+		return
+	}
+
+	// Only the device itself may speak for it
+	id, client := r.PathValue("id"), getClientIP(r)
+	device, ok := s.hub.Device(id)
+	if ok && device.IP == client {
+		device, ok = s.setPresence(id, update)
+	}
+	if !ok || device.IP != client {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    404,
+			"message": "设备不在线",
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code": 200,
+		"data": device,
+	})
+}
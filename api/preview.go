@@ -0,0 +1,111 @@
+package api
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sandboxCSP is sent with risky content so that scripts never run and the
+// document cannot load anything, not even from the server itself
+const sandboxCSP = "sandbox; default-src 'none'; img-src data:; style-src 'unsafe-inline'; media-src 'none'"
+
+// riskyPreviewTypes can run script when rendered by the browser
+var riskyPreviewTypes = map[string]bool{
+	"text/html":              true,
+	"application/xhtml+xml":  true,
+	"image/svg+xml":          true,
+	"text/xml":               true,
+	"application/xml":        true,
+	"text/javascript":        true,
+	"application/javascript": true,
+}
+
+// inlinePreviewTypes are safe to render inline besides image/*, audio/*
+// and video/*
+var inlinePreviewTypes = map[string]bool{
+	"application/pdf":  true,
+	"application/json": true,
+	"text/plain":       true,
+	"text/markdown":    true,
+	"text/csv":         true,
+	"text/css":         true,
+}
+
+// HandlePreview serves a file inline so browsers can display images,
+// media, PDFs and text instead of downloading them. Range requests are
+// supported for media streaming. HTML, SVG and other scriptable types are
+// refused unless the client asks for them sandboxed (sandbox=1), in which
+// case they are served under a strict Content-Security-Policy.
+func (s *Server) HandlePreview(w http.ResponseWriter, r *http.Request) {
+	file, ok := s.resolveRequestFile(w, r)
+	if !ok {
+		return
+	}
+	if file.Info.IsDir() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	contentType, err := previewContentType(file.Path, file.Name)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch {
+	case riskyPreviewTypes[mediaType]:
+		if r.URL.Query().Get("sandbox") != "1" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Security-Policy", sandboxCSP)
+	case inlinePreviewTypes[mediaType],
+		strings.HasPrefix(mediaType, "image/"),
+		strings.HasPrefix(mediaType, "audio/"),
+		strings.HasPrefix(mediaType, "video/"):
+	default:
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename*=UTF-8''%s", url.PathEscape(file.Name)))
+	s.serveTransfer(w, r, file.Path, func(interrupt func()) *transfer {
+		return s.startTransfer(r, TransferDownload, file.Name, file.Room, 0, interrupt)
+	})
+}
+
+// previewContentType determines the Content-Type of a file from its name
+// and its first bytes. Content that sniffs as something scriptable wins over
+// an innocent looking extension, so an HTML page named .png stays risky.
+func previewContentType(path, name string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, _ := f.Read(head)
+	sniffed := http.DetectContentType(head[:n])
+	sniffedType, _, _ := mime.ParseMediaType(sniffed)
+
+	byExt := mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	if byExt == "" || riskyPreviewTypes[sniffedType] {
+		return sniffed, nil
+	}
+
+	// Plain text files get an explicit charset
+	extType, params, _ := mime.ParseMediaType(byExt)
+	if strings.HasPrefix(extType, "text/") && params["charset"] == "" {
+		return extType + "; charset=utf-8", nil
+	}
+	return byExt, nil
+}
@@ -0,0 +1,265 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/wwqdrh/file-share/utils"
+)
+
+// roomInfo is a room as listed to a client
+type roomInfo struct {
+	utils.Room
+	// Joined reports whether the requesting client is a member
+	Joined bool `json:"joined"`
+}
+
+// requestRoom returns the room a request is made in, given by the room
+// query parameter or the X-Room header and defaulting to the default room
+func requestRoom(r *http.Request) string {
+	room := r.URL.Query().Get("room")
+	if room == "" {
+		room = r.Header.Get("X-Room")
+	}
+	return utils.RoomName(room)
+}
+
+// canAccess reports whether the client of r joined room. Clients are
+// identified by the address of their connection, see getClientIP.
+func (s *Server) canAccess(r *http.Request, room string) bool {
+	return s.rooms.IsMember(room, getClientIP(r))
+}
+
+// joinedRoom returns the room of r when its client joined it. Otherwise it
+// writes the error response and returns false.
+func (s *Server) joinedRoom(w http.ResponseWriter, r *http.Request) (string, bool) {
+	room := requestRoom(r)
+	if s.canAccess(r, room) {
+		return room, true
+	}
+	if _, err := s.rooms.Get(room); err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    404,
+			"message": "房间不存在",
+		})
+		return "", false
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    403,
+		"message": "未加入该房间",
+	})
+	return "", false
+}
+
+// ListRoomFiles returns the shared entries and texts of room
+func (s *Server) ListRoomFiles(room string) []utils.FileInfo {
+	var files []utils.FileInfo
+	for _, file := range s.ListFiles() {
+		if utils.RoomName(file.Room) == room {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// HandleListRooms lists all rooms and whether the client joined them
+func (s *Server) HandleListRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := s.rooms.List()
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    500,
+			"message": "读取房间失败",
+		})
+		return
+	}
+
+	client := getClientIP(r)
+	infos := make([]roomInfo, 0, len(rooms))
+	for _, room := range rooms {
+		infos = append(infos, roomInfo{Room: room, Joined: room.HasMember(client)})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code": 200,
+		"data": map[string]interface{}{
+			"rooms": infos,
+		},
+	})
+}
+
+// HandleCreateRoom creates a room from {"name": ...} with the client as its
+// first member
+func (s *Server) HandleCreateRoom(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || !utils.ValidRoomName(data.Name) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    400,
+			"message": "房间名称无效",
+		})
+		return
+	}
+
+	room, err := s.rooms.Create(data.Name, getClientIP(r))
+	if err == utils.ErrRoomExists {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    409,
+			"message": "房间已存在",
+		})
+		return
+	}
+	if err != nil {
+		s.logger.Printf("create room error: %v\n", err)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    500,
+			"message": "创建房间失败",
+		})
+		return
+	}
+
+	s.publish("room.created", map[string]string{"name": room.Name, "createdBy": room.CreatedBy})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    200,
+		"data":    roomInfo{Room: room, Joined: true},
+		"message": "创建成功",
+	})
+}
+
+// HandleGetRoom returns a room with its members
+func (s *Server) HandleGetRoom(w http.ResponseWriter, r *http.Request) {
+	room, err := s.rooms.Get(r.PathValue("name"))
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    404,
+			"message": "房间不存在",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code": 200,
+		"data": roomInfo{Room: room, Joined: room.HasMember(getClientIP(r))},
+	})
+}
+
+// HandleDeleteRoom deletes a room the client joined together with the
+// files and texts shared in it. The shared files themselves stay on disk,
+// only uploads no other entry refers to are removed.
+func (s *Server) HandleDeleteRoom(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if name == utils.DefaultRoom {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    400,
+			"message": "默认房间不能删除",
+		})
+		return
+	}
+	room, err := s.rooms.Get(name)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    404,
+			"message": "房间不存在",
+		})
+		return
+	}
+	if !room.HasMember(getClientIP(r)) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    403,
+			"message": "未加入该房间",
+		})
+		return
+	}
+
+	// Tell the members while they still are
+	s.publishRoom(name, "room.deleted", map[string]string{"name": name})
+	if err := s.rooms.Delete(name); err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    500,
+			"message": "删除房间失败",
+		})
+		return
+	}
+
+	files, err := s.db.ListFiles()
+	if err == nil {
+		for _, file := range files {
+			if file.Room == name {
+				s.RemoveFile(file)
+			}
+		}
+	}
+	ids, err := s.texts.DeleteRoom(name)
+	if err != nil {
+		s.logger.Printf("delete room texts error: %v\n", err)
+	}
+	for _, id := range ids {
+		s.index.Remove(textIndexID(id))
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    200,
+		"message": "删除成功",
+	})
+}
+
+// HandleJoinRoom adds the client to a room
+func (s *Server) HandleJoinRoom(w http.ResponseWriter, r *http.Request) {
+	s.updateMembership(w, r, true)
+}
+
+// HandleLeaveRoom removes the client from a room
+func (s *Server) HandleLeaveRoom(w http.ResponseWriter, r *http.Request) {
+	s.updateMembership(w, r, false)
+}
+
+// updateMembership joins or leaves the room of the request path and
+// announces it to the members with a room.joined or room.left event
+func (s *Server) updateMembership(w http.ResponseWriter, r *http.Request, join bool) {
+	name := r.PathValue("name")
+	if name == utils.DefaultRoom {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    400,
+			"message": "默认房间无需加入或离开",
+		})
+		return
+	}
+
+	client := getClientIP(r)
+	update, eventType := s.rooms.Join, "room.joined"
+	if !join {
+		update, eventType = s.rooms.Leave, "room.left"
+	}
+	room, err := update(name, client)
+	if err == utils.ErrNoMember {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    400,
+			"message": "无法识别客户端地址",
+		})
+		return
+	}
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    404,
+			"message": "房间不存在",
+		})
+		return
+	}
+
+	s.publishRoom(name, eventType, map[string]string{"room": name, "member": client})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code": 200,
+		"data": roomInfo{Room: room, Joined: join},
+	})
+}
+
+// entryRoom returns the room of the shared entry that relPath, a path as
+// accepted by /api/download, lies in
+func (s *Server) entryRoom(relPath string) string {
+	entry, _, _ := strings.Cut(strings.TrimPrefix(relPath, "/"), "/")
+	file, err := s.db.GetFile(entry)
+	if err != nil {
+		return utils.DefaultRoom
+	}
+	return utils.RoomName(file.Room)
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wwqdrh/file-share/utils"
+)
+
+const (
+	defaultSearchLimit   = 200
+	maxSearchLimit       = 5000
+	defaultSearchTimeout = 10 * time.Second
+	maxSearchTimeout     = 60 * time.Second
+)
+
+// searchResult is one line of the /api/search stream. Path is the path to
+// pass to /api/files or /api/download, or the id of a text message.
+type searchResult struct {
+	Type string          `json:"type"`
+	Path string          `json:"path,omitempty"`
+	File *utils.FileInfo `json:"file,omitempty"`
+	Hit  *utils.TextHit  `json:"hit,omitempty"`
+	Data interface{}     `json:"data,omitempty"`
+}
+
+// HandleSearch searches the content of text snippets and text files through
+// the full-text index, the names of all shared entries and everything below
+// shared directories, limited to the requested room.
+//
+// Query parameters: q is the query, mode one of substring, name, glob or
+// regex to only match names, content to only search the full-text index or
+// empty for both, room the room to search, limit the maximum number of
+// results (default 200) and timeout the time budget in seconds (default 10).
+//
+// Results are streamed as newline delimited JSON while the search runs.
+// Ranked {"type":"content"} hits with a highlighted excerpt come first,
+// then one {"type":"result"} object per name match, followed by a final
+// {"type":"done"} object reporting the count and whether the limit or the
+// timeout ended the search early.
+func (s *Server) HandleSearch(w http.ResponseWriter, r *http.Request) {
+	room, ok := s.joinedRoom(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	mode := query.Get("mode")
+	nameMode := mode
+	if mode == "" || mode == "content" {
+		nameMode = "substring"
+	}
+	match, err := utils.NewMatcher(nameMode, query.Get("q"))
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    400,
+			"message": "搜索条件无效: " + err.Error(),
+		})
+		return
+	}
+
+	limit := defaultSearchLimit
+	if n, err := strconv.Atoi(query.Get("limit")); err == nil && n > 0 {
+		limit = min(n, maxSearchLimit)
+	}
+	timeout := defaultSearchTimeout
+	if n, err := strconv.Atoi(query.Get("timeout")); err == nil && n > 0 {
+		timeout = min(time.Duration(n)*time.Second, maxSearchTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	count := 0
+	emit := func(relPath string, file utils.FileInfo) bool {
+		if file.Type == "file" && utils.CanThumbnail(file.Name) {
+			file.Thumbnail = thumbnailURL(relPath)
+		}
+		if err := encoder.Encode(searchResult{Type: "result", Path: relPath, File: &file}); err != nil {
+			cancel()
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		count++
+		return count < limit
+	}
+
+	// Index ids are text ids or paths below a shared entry
+	files := s.ListRoomFiles(room)
+	inRoom := make(map[string]bool, len(files))
+	for _, file := range files {
+		if file.Type == "text" {
+			inRoom[textIndexID(file.ID)] = true
+		} else {
+			inRoom[file.Name] = true
+		}
+	}
+	keep := func(id string) bool {
+		entry, _, _ := strings.Cut(id, "/")
+		return inRoom[id] || inRoom[entry]
+	}
+
+	withContent := mode == "" || mode == "content"
+	if withContent {
+		s.requestIndexSync(false)
+		for _, hit := range s.index.Search(query.Get("q"), limit, keep) {
+			path := strings.TrimPrefix(hit.ID, textIndexID(""))
+			if err := encoder.Encode(searchResult{Type: "content", Path: path, Hit: &hit}); err != nil {
+				return
+			}
+			count++
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if mode != "content" {
+		s.searchNames(ctx, files, match, !withContent, func() bool {
+			return count < limit
+		}, emit)
+	}
+
+	encoder.Encode(searchResult{Type: "done", Data: map[string]interface{}{
+		"count":     count,
+		"truncated": count >= limit,
+		"timedOut":  ctx.Err() == context.DeadlineExceeded,
+	}})
+	if flusher != nil {
+		flusher.Flush()
+	}
+	s.logger.Printf("search %q: %d results\n", strings.TrimSpace(query.Get("q")), count)
+}
+
+// searchNames matches the names of the shared entries files and, while
+// more is true, of everything below shared directories. The content of
+// text snippets is matched too unless the full-text index already covered it.
+func (s *Server) searchNames(ctx context.Context, files []utils.FileInfo, match func(string) bool, textContent bool, more func() bool, emit func(string, utils.FileInfo) bool) {
+	// Top-level entries first so the cheap matches arrive immediately
+	var roots []utils.FileInfo
+	for _, file := range files {
+		if !more() || ctx.Err() != nil {
+			return
+		}
+		switch file.Type {
+		case "text":
+			if match(file.Name) || textContent && match(file.Content) {
+				emit(file.ID, file)
+			}
+		case "directory":
+			roots = append(roots, file)
+			fallthrough
+		default:
+			if match(file.Name) {
+				emit(file.Name, file)
+			}
+		}
+	}
+
+	for _, root := range roots {
+		if !more() || ctx.Err() != nil {
+			return
+		}
+		prefix := root.Name
+		utils.WalkMatches(ctx, root.Path, match, func(relPath string, file utils.FileInfo) bool {
+			return emit(prefix+"/"+relPath, file)
+		})
+	}
+}
@@ -0,0 +1,613 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wwqdrh/file-share/discovery"
+	"github.com/wwqdrh/file-share/utils"
+)
+
+const (
+	StatusStart = "start"
+	StatusStop  = "stop"
+)
+
+// Event is a message published to SSE subscribers and the OnEvent hook
+type Event struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+	// Room scopes the event to the members of a room, empty for events
+	// everyone receives
+	Room string `json:"room,omitempty"`
+}
+
+// Options configures a Server. The zero value serves the API only, using
+// the default storage and settings.
+type Options struct {
+	// Static is the web UI served at "/", nil serves the API only
+	Static fs.FS
+	// Paths locates the data and config directories everything else derives
+	// from. Defaults to the directory of Storage when given, otherwise to
+	// utils.DefaultPaths().
+	Paths utils.Paths
+	// Storage persists the shared file list. Defaults to a storage in
+	// Paths.StorageFile().
+	Storage *utils.Storage
+	// Settings holds authentication and upload settings. Defaults to
+	// settings loaded from Paths.SettingsFile().
+	Settings *utils.SettingsStore
+	// Logger receives diagnostic output. Defaults to standard output.
+	Logger utils.Logger
+	// OnEvent is called for every event published to subscribers
+	OnEvent func(Event)
+
+	// Port is the port Listen binds, defaults to 5421
+	Port int
+	// Bind lists the addresses Listen binds, see utils.ResolveBindAddresses
+	Bind []string
+	// TLSConfig makes Listen serve HTTPS
+	TLSConfig *tls.Config
+	// MDNS advertises the server on the LAN while it is listening
+	MDNS bool
+	// Watch watches the shared files while the server is running and
+	// publishes file.created, file.changed and file.deleted events
+	Watch bool
+	// TrustedProxies lists the addresses or CIDR ranges of reverse proxies
+	// whose X-Real-IP header names the client. Everyone else is identified
+	// by the address of the connection.
+	TrustedProxies []string
+}
+
+// Server is a single file-share instance. It owns the HTTP server, the
+// routes, the SSE hub, the sessions and the file storage.
+type Server struct {
+	options Options
+	// httpServer serves the current run, a stopped http.Server cannot
+	// serve again so Start creates a new one. Guarded by statusLock.
+	httpServer *http.Server
+	handler    http.Handler
+	mux        *http.ServeMux
+	hub        *Hub
+	db         *utils.FileStore
+	texts      *utils.TextStore
+	rooms      *utils.RoomStore
+	settings   *utils.SettingsStore
+	paths      utils.Paths
+	hashes     *utils.HashCache
+	thumbnails *utils.ThumbnailCache
+	dirSizes   *utils.DirSizeCache
+	index      *utils.TextIndex
+
+	indexLock    sync.Mutex
+	indexSyncing bool
+	indexQueued  bool
+	indexSynced  time.Time
+
+	watcher     *utils.Watcher
+	watcherLock sync.Mutex
+
+	offers     map[string]*offer
+	offersLock sync.Mutex
+
+	transfers     map[string]*transfer
+	transfersLock sync.Mutex
+	bandwidth     *bandwidth
+	logger        utils.Logger
+
+	sessions     map[string]bool
+	sessionMutex sync.RWMutex
+
+	proxies      []netip.Prefix
+	proxyWarning sync.Once
+
+	// status, candidates, responder, errCh and done belong to the current
+	// run and are guarded by statusLock
+	status     string
+	statusLock sync.RWMutex
+	candidates []utils.AddressCandidate
+	responder  *discovery.Responder
+	errCh      chan error
+	done       chan struct{}
+}
+
+// New creates a server from opts. The returned server can be mounted as an
+// http.Handler or started with Listen or Start.
+func New(opts Options) (*Server, error) {
+	paths := opts.Paths
+	if paths.DataDir == "" {
+		if opts.Storage != nil {
+			paths = utils.NewPaths(opts.Storage.Dir())
+		} else {
+			defaultPaths, err := utils.DefaultPaths()
+			if err != nil {
+				return nil, err
+			}
+			paths = defaultPaths
+		}
+	}
+	if paths.ConfigDir == "" {
+		paths.ConfigDir = paths.DataDir
+	}
+	if err := paths.Ensure(); err != nil {
+		return nil, err
+	}
+
+	if opts.Storage == nil {
+		opts.Storage = utils.NewStorage(paths.StorageFile())
+	}
+	if opts.Settings == nil {
+		settings, err := utils.NewSettingsStore(paths.SettingsFile())
+		if err != nil {
+			return nil, err
+		}
+		opts.Settings = settings
+	}
+	if opts.Logger == nil {
+		opts.Logger = utils.StdoutLogger()
+	}
+	if opts.Port == 0 {
+		opts.Port = 5421
+	}
+	proxies, err := parseTrustedProxies(opts.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		options:    opts,
+		mux:        http.NewServeMux(),
+		hub:        NewHub(opts.Logger),
+		db:         utils.NewFileStore(opts.Storage, opts.Logger),
+		texts:      utils.NewTextStore(opts.Storage, opts.Logger),
+		rooms:      utils.NewRoomStore(opts.Storage, opts.Logger),
+		settings:   opts.Settings,
+		paths:      paths,
+		hashes:     utils.NewHashCache(),
+		thumbnails: utils.NewThumbnailCache(paths.ThumbnailDir()),
+		dirSizes:   utils.NewDirSizeCache(time.Minute),
+		logger:     opts.Logger,
+		sessions:   make(map[string]bool),
+		offers:     make(map[string]*offer),
+		transfers:  make(map[string]*transfer),
+		bandwidth:  newBandwidth(opts.Settings.Get().Bandwidth),
+		proxies:    proxies,
+		status:     StatusStop,
+	}
+
+	s.index = utils.NewTextIndex(s.indexedTexts)
+	s.hub.members = func(name string) []string {
+		room, _ := s.rooms.Get(name)
+		return room.Members
+	}
+	s.hub.onPresence = s.publishPresence
+	s.settings.OnChange(func(settings utils.Settings) {
+		s.bandwidth.apply(settings.Bandwidth)
+	})
+
+	// Texts of older versions were kept with the files
+	if err := s.texts.Import(s.db); err != nil {
+		s.logger.Printf("import texts error: %v\n", err)
+	}
+
+	// Static file server with the embedded files
+	if opts.Static != nil {
+		s.mux.Handle("/", http.FileServer(http.FS(opts.Static)))
+	}
+
+	// API routes
+	s.mux.HandleFunc("/api/files", s.HandleFiles)
+	s.mux.HandleFunc("/api/download", s.HandleDownload)
+	s.mux.HandleFunc("/api/preview", s.HandlePreview)
+	s.mux.HandleFunc("/api/thumbnail", s.HandleThumbnail)
+	s.mux.HandleFunc("/api/search", s.HandleSearch)
+	s.mux.HandleFunc("/api/login", s.HandleLogin)
+	s.mux.HandleFunc("/api/addFile", s.HandleAddFile)
+	s.mux.HandleFunc("/api/addText", s.HandleAddText)
+	s.mux.HandleFunc("GET /api/texts", s.HandleListTexts)
+	s.mux.HandleFunc("POST /api/texts", s.HandleCreateText)
+	s.mux.HandleFunc("GET /api/texts/{id}", s.HandleGetText)
+	s.mux.HandleFunc("GET /api/texts/{id}/raw", s.HandleRawText)
+	s.mux.HandleFunc("PATCH /api/texts/{id}", s.HandleUpdateText)
+	s.mux.HandleFunc("DELETE /api/texts/{id}", s.HandleDeleteText)
+	s.mux.HandleFunc("GET /api/rooms", s.HandleListRooms)
+	s.mux.HandleFunc("POST /api/rooms", s.HandleCreateRoom)
+	s.mux.HandleFunc("GET /api/rooms/{name}", s.HandleGetRoom)
+	s.mux.HandleFunc("DELETE /api/rooms/{name}", s.HandleDeleteRoom)
+	s.mux.HandleFunc("POST /api/rooms/{name}/join", s.HandleJoinRoom)
+	s.mux.HandleFunc("POST /api/rooms/{name}/leave", s.HandleLeaveRoom)
+	s.mux.HandleFunc("GET /api/devices", s.HandleListDevices)
+	s.mux.HandleFunc("GET /api/presence", s.HandlePresence)
+	s.mux.HandleFunc("POST /api/presence/{id}", s.HandleHeartbeat)
+	s.mux.HandleFunc("POST /api/devices/{id}/send", s.HandleSendToDevice)
+	s.mux.HandleFunc("POST /api/offers/{id}/accept", s.HandleAcceptOffer)
+	s.mux.HandleFunc("POST /api/offers/{id}/decline", s.HandleDeclineOffer)
+	s.mux.HandleFunc("GET /api/offers/{id}/download", s.HandleDownloadOffer)
+	s.mux.HandleFunc("GET /api/transfers", s.HandleListTransfers)
+	s.mux.HandleFunc("POST /api/transfers/{id}/cancel", s.HandleCancelTransfer)
+	s.mux.HandleFunc("GET /api/settings/bandwidth", s.HandleGetBandwidth)
+	s.mux.HandleFunc("PUT /api/settings/bandwidth", s.HandleUpdateBandwidth)
+	s.mux.HandleFunc("/api/registrySSE", s.hub.RegistrySSE)
+	s.mux.HandleFunc("GET /api/ws", s.HandleWebSocket)
+
+	// Wrap all API routes with auth filter
+	s.handler = s.realIP(s.AuthFilter(s.mux))
+	s.httpServer = &http.Server{Handler: s.handler}
+	return s, nil
+}
+
+// ServeHTTP lets the server be mounted into another mux
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Files returns the shared file list of the server
+func (s *Server) Files() *utils.FileStore {
+	return s.db
+}
+
+// Paths returns the directories the server persists its state in
+func (s *Server) Paths() utils.Paths {
+	return s.paths
+}
+
+// Settings returns the settings of the server
+func (s *Server) Settings() *utils.SettingsStore {
+	return s.settings
+}
+
+// Handler returns the root handler of the server
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// Hub returns the SSE hub of the server
+func (s *Server) Hub() *Hub {
+	return s.hub
+}
+
+// Start serves on every listener in the background. All listeners share
+// the same handler; wrap them with tls.NewListener to serve HTTPS. A
+// stopped server may be started again.
+func (s *Server) Start(listeners ...net.Listener) error {
+	s.statusLock.Lock()
+	if s.status == StatusStart {
+		s.statusLock.Unlock()
+		return fmt.Errorf("server already started")
+	}
+	s.status = StatusStart
+	errCh := make(chan error, len(listeners))
+	s.errCh = errCh
+	s.done = make(chan struct{})
+	s.httpServer = &http.Server{Handler: s.handler}
+	httpServer := s.httpServer
+	s.statusLock.Unlock()
+	s.hub.reopen()
+
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			if err := httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+				errCh <- fmt.Errorf("serve %s: %v", ln.Addr(), err)
+			}
+		}(ln)
+	}
+
+	s.requestIndexSync(true)
+	go s.watchPresence()
+	if s.options.Watch {
+		s.startWatcher()
+	}
+	s.notifyStatus(StatusStart)
+	return nil
+}
+
+// Listen binds the addresses configured in the options, advertises them
+// over mDNS when enabled and starts serving in the background
+func (s *Server) Listen() error {
+	if s.Status() == StatusStart {
+		return fmt.Errorf("server already started")
+	}
+	binds, err := utils.ResolveBindAddresses(s.options.Bind, s.options.Port)
+	if err != nil {
+		return err
+	}
+
+	// All listeners share the same server and handler
+	listeners := make([]net.Listener, 0, len(binds))
+	for _, b := range binds {
+		ln, err := net.Listen(b.Network, b.Addr())
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("failed to listen on %s: %v", b.Addr(), err)
+		}
+		if s.options.TLSConfig != nil {
+			ln = tls.NewListener(ln, s.options.TLSConfig)
+		}
+		listeners = append(listeners, ln)
+	}
+	candidates := reachableCandidates(binds)
+
+	var responder *discovery.Responder
+	if s.options.MDNS {
+		responder = discovery.NewResponder(discovery.Service{
+			Port:         s.options.Port,
+			Path:         "/",
+			AuthRequired: s.GetAuthEnable(),
+			TLS:          s.options.TLSConfig != nil,
+			IPs:          candidateIPs(candidates),
+		})
+		if err := responder.Start(); err != nil {
+			s.logger.Printf("mdns advertise error: %v\n", err)
+			responder = nil
+		}
+	}
+
+	// Another Listen or Start may have won the race since the check above
+	if err := s.Start(listeners...); err != nil {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		if responder != nil {
+			responder.Close()
+		}
+		return err
+	}
+	s.statusLock.Lock()
+	s.candidates = candidates
+	s.responder = responder
+	s.statusLock.Unlock()
+	return nil
+}
+
+// Addresses returns the local addresses accepted by the listeners bound by
+// Listen, best candidates first
+func (s *Server) Addresses() []utils.AddressCandidate {
+	s.statusLock.RLock()
+	defer s.statusLock.RUnlock()
+	return s.candidates
+}
+
+// Scheme returns "https" when the server is configured with TLS
+func (s *Server) Scheme() string {
+	if s.options.TLSConfig != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// Port returns the port Listen binds
+func (s *Server) Port() int {
+	return s.options.Port
+}
+
+// Wait blocks until the current run of the server was stopped or shut
+// down, or returns the first error of a listener that failed to serve
+func (s *Server) Wait() error {
+	s.statusLock.RLock()
+	done, errCh := s.done, s.errCh
+	s.statusLock.RUnlock()
+	if done == nil {
+		return fmt.Errorf("server not started")
+	}
+
+	select {
+	case <-done:
+		return nil
+	case err := <-errCh:
+		return err
+	}
+}
+
+// Stop closes all listeners and connections immediately
+func (s *Server) Stop() error {
+	if s.setStopped() {
+		s.notifyStatus(StatusStop)
+	}
+	s.closeResponder()
+	s.closeWatcher()
+	s.dropOffers()
+	s.hub.Close()
+	defer s.markDone()
+	return s.currentHTTPServer().Close()
+}
+
+// Shutdown notifies SSE subscribers, stops accepting new connections and
+// waits for in-flight requests such as downloads to finish or ctx to expire.
+// Wait returns either way; when ctx expires the remaining connections stay
+// open until Stop is called.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !s.setStopped() {
+		return nil
+	}
+	s.notifyStatus(StatusStop)
+	s.closeResponder()
+	s.closeWatcher()
+	s.dropOffers()
+
+	// SSE streams never finish on their own, end them so they do not hold
+	// up the drain of the other requests
+	s.hub.Close()
+	defer s.markDone()
+	return s.currentHTTPServer().Shutdown(ctx)
+}
+
+// Status returns StatusStart while the server is serving
+func (s *Server) Status() string {
+	s.statusLock.RLock()
+	defer s.statusLock.RUnlock()
+	return s.status
+}
+
+// currentHTTPServer returns the http.Server of the current or last run
+func (s *Server) currentHTTPServer() *http.Server {
+	s.statusLock.RLock()
+	defer s.statusLock.RUnlock()
+	return s.httpServer
+}
+
+// setStopped marks the server as stopped and reports whether it was running
+func (s *Server) setStopped() bool {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	if s.status == StatusStop {
+		return false
+	}
+	s.status = StatusStop
+	return true
+}
+
+// closeResponder withdraws the mDNS advertisement
+func (s *Server) closeResponder() {
+	s.statusLock.Lock()
+	responder := s.responder
+	s.responder = nil
+	s.statusLock.Unlock()
+	if responder != nil {
+		responder.Close()
+	}
+}
+
+// markDone releases Wait once the server has stopped
+func (s *Server) markDone() {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	if s.done == nil {
+		return
+	}
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+}
+
+func (s *Server) notifyStatus(status string) {
+	s.publish("server.statusChange", map[string]string{"status": status})
+}
+
+// publish sends an event to the SSE subscribers and the OnEvent hook
+func (s *Server) publish(eventType string, data interface{}) {
+	s.publishRoom("", eventType, data)
+}
+
+// publishRoom sends an event to the subscribers joined to room and the
+// OnEvent hook
+func (s *Server) publishRoom(room, eventType string, data interface{}) {
+	event := Event{Type: eventType, Data: data, Room: room}
+	if s.options.OnEvent != nil {
+		s.options.OnEvent(event)
+	}
+	if err := s.hub.SendEvent(event); err != nil {
+		s.logger.Printf("send event error: %v\n", err)
+	}
+}
+
+// parseTrustedProxies parses addresses and CIDR ranges of proxies
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(proxy); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// untrustedProxyKey marks the context of loopback requests that carry
+// forwarding headers of a proxy missing from Options.TrustedProxies
+type untrustedProxyKey struct{}
+
+// realIP identifies requests forwarded by a trusted proxy by the client
+// address in their X-Real-IP header instead of the proxy address. Loopback
+// requests forwarded by any other proxy are marked, as they do not come
+// from the host even though their connection does.
+func (s *Server) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := getClientIP(r)
+		realIP := strings.TrimSpace(r.Header.Get("X-Real-IP"))
+		if realIP != "" && s.trustedProxy(client) {
+			if addr, err := netip.ParseAddr(realIP); err == nil {
+				r = r.WithContext(r.Context())
+				r.RemoteAddr = netip.AddrPortFrom(addr.Unmap(), 0).String()
+			}
+		} else if utils.IsLoopback(client) && !s.trustedProxy(client) && isForwarded(r) {
+			s.proxyWarning.Do(func() {
+				s.logger.Printf("warning: request from %s was forwarded by a proxy, add it with --trusted-proxy; until then proxied clients are not treated as the host\n", client)
+			})
+			r = r.WithContext(context.WithValue(r.Context(), untrustedProxyKey{}, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isForwarded reports whether r carries the headers of a reverse proxy
+func isForwarded(r *http.Request) bool {
+	return r.Header.Get("X-Forwarded-For") != "" || r.Header.Get("X-Real-IP") != "" || r.Header.Get("Forwarded") != ""
+}
+
+// trustedProxy reports whether ip is one of Options.TrustedProxies
+func (s *Server) trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range s.proxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// reachableCandidates returns the local addresses accepted by binds
+func reachableCandidates(binds []utils.BindAddress) []utils.AddressCandidate {
+	var candidates []utils.AddressCandidate
+	for _, c := range utils.GetAddressCandidates() {
+		for _, b := range binds {
+			if b.Covers(net.ParseIP(c.IP)) {
+				candidates = append(candidates, c)
+				break
+			}
+		}
+	}
+	// Listening on loopback only still deserves a usable URL
+	for _, b := range binds {
+		if ip := net.ParseIP(b.Host); ip != nil && ip.IsLoopback() {
+			family := "ipv6"
+			if ip.To4() != nil {
+				family = "ipv4"
+			}
+			candidates = append(candidates, utils.AddressCandidate{Interface: "lo", IP: b.Host, Family: family})
+		}
+	}
+	return candidates
+}
+
+// candidateIPs returns the parsed IPs of candidates
+func candidateIPs(candidates []utils.AddressCandidate) []net.IP {
+	ips := make([]net.IP, 0, len(candidates))
+	for _, c := range candidates {
+		ips = append(ips, net.ParseIP(c.IP))
+	}
+	return ips
+}
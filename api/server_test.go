@@ -0,0 +1,242 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wwqdrh/file-share/utils"
+)
+
+// newTestServer returns a server keeping its state in a temp directory
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	s, err := New(Options{
+		Paths:    utils.NewPaths(t.TempDir()),
+		Settings: utils.NewMemorySettingsStore(utils.DefaultSettings()),
+		Logger:   utils.DiscardLogger(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// startOnLoopback starts s on a free loopback port and returns its URL
+func startOnLoopback(t *testing.T, s *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(ln); err != nil {
+		t.Fatal(err)
+	}
+	return "http://" + ln.Addr().String()
+}
+
+func TestServerRestart(t *testing.T) {
+	s := newTestServer(t)
+
+	for run := 0; run < 3; run++ {
+		url := startOnLoopback(t, s)
+		if s.Status() != StatusStart {
+			t.Fatalf("run %d: status %q after Start", run, s.Status())
+		}
+		resp, err := http.Get(url + "/api/rooms")
+		if err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+		resp.Body.Close()
+
+		if run%2 == 0 {
+			err = s.Stop()
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			err = s.Shutdown(ctx)
+			cancel()
+		}
+		if err != nil {
+			t.Fatalf("run %d: stop: %v", run, err)
+		}
+
+		waited := make(chan error, 1)
+		go func() { waited <- s.Wait() }()
+		select {
+		case err := <-waited:
+			if err != nil {
+				t.Fatalf("run %d: Wait: %v", run, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("run %d: Wait did not return after stopping", run)
+		}
+		if s.Status() != StatusStop {
+			t.Fatalf("run %d: status %q after stopping", run, s.Status())
+		}
+	}
+}
+
+func TestServerStartTwice(t *testing.T) {
+	s := newTestServer(t)
+	startOnLoopback(t, s)
+	defer s.Stop()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if err := s.Start(ln); err == nil {
+		t.Fatal("second Start of a running server succeeded")
+	}
+}
+
+func TestServerListenWhileStarted(t *testing.T) {
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+
+	s, err := New(Options{
+		Paths:    utils.NewPaths(t.TempDir()),
+		Settings: utils.NewMemorySettingsStore(utils.DefaultSettings()),
+		Logger:   utils.DiscardLogger(),
+		Port:     port,
+		Bind:     []string{"127.0.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startOnLoopback(t, s)
+	defer s.Stop()
+
+	if err := s.Listen(); err == nil {
+		t.Fatal("Listen of a running server succeeded")
+	}
+	// The failed Listen left the configured port free
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("port still bound after the failed Listen: %v", err)
+	}
+	ln.Close()
+}
+
+func TestServerWaitBeforeStart(t *testing.T) {
+	s := newTestServer(t)
+	waited := make(chan error, 1)
+	go func() { waited <- s.Wait() }()
+	select {
+	case err := <-waited:
+		if err == nil {
+			t.Error("Wait of a server never started returned nil")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait blocked on a server never started")
+	}
+}
+
+func TestServerWaitAfterFailedShutdown(t *testing.T) {
+	s := newTestServer(t)
+	url := startOnLoopback(t, s)
+	defer s.Stop()
+
+	// A request that never completes keeps the connection active
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET /api/rooms HTTP/1.1\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err == nil {
+		t.Fatal("Shutdown with an active connection succeeded")
+	}
+
+	waited := make(chan error, 1)
+	go func() { waited <- s.Wait() }()
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Errorf("Wait: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait blocked after a failed Shutdown")
+	}
+}
+
+// countingLogger counts the lines logged through it
+type countingLogger struct {
+	lines int
+}
+
+func (l *countingLogger) Printf(format string, v ...interface{}) {
+	l.lines++
+}
+
+func TestHostClientBehindProxy(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies []string
+		remote  string
+		header  string
+		value   string
+		host    bool
+	}{
+		{"local browser", nil, "127.0.0.1:1000", "", "", true},
+		{"lan client", nil, "192.0.2.1:1000", "", "", false},
+		{"untrusted x-forwarded-for", nil, "127.0.0.1:1000", "X-Forwarded-For", "192.0.2.1", false},
+		{"untrusted x-real-ip", nil, "[::1]:1000", "X-Real-IP", "192.0.2.1", false},
+		{"untrusted forwarded", nil, "127.0.0.1:1000", "Forwarded", "for=192.0.2.1", false},
+		{"trusted proxy for lan client", []string{"127.0.0.1"}, "127.0.0.1:1000", "X-Real-IP", "192.0.2.1", false},
+		{"trusted proxy for local browser", []string{"127.0.0.1"}, "127.0.0.1:1000", "X-Real-IP", "127.0.0.1", true},
+	}
+	for _, tt := range tests {
+		logger := &countingLogger{}
+		s, err := New(Options{
+			Paths:          utils.NewPaths(t.TempDir()),
+			Settings:       utils.NewMemorySettingsStore(utils.DefaultSettings()),
+			Logger:         logger,
+			TrustedProxies: tt.proxies,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var host bool
+		handler := s.realIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host = isHostClient(r)
+		}))
+
+		// An untrusted proxy is reported once, however many requests it relays
+		warnings := logger.lines
+		for i := 0; i < 2; i++ {
+			r := httptest.NewRequest(http.MethodGet, "/api/transfers", nil)
+			r.RemoteAddr = tt.remote
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			if host != tt.host {
+				t.Errorf("%s: isHostClient = %v, want %v", tt.name, host, tt.host)
+			}
+		}
+		wantWarnings := 0
+		if tt.header != "" && tt.proxies == nil {
+			wantWarnings = 1
+		}
+		if got := logger.lines - warnings; got != wantWarnings {
+			t.Errorf("%s: %d warnings, want %d", tt.name, got, wantWarnings)
+		}
+	}
+}
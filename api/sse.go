@@ -5,83 +5,310 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/wwqdrh/file-share/utils"
 )
 
+// subscriberBuffer is how many events may queue up for a slow subscriber
+// before further events are dropped
+const subscriberBuffer = 64
+
 type Subscriber struct {
 	ID       string
 	Response http.ResponseWriter
+	// Client identifies the connecting client for room membership
+	Client string
+	// Device describes the connected browser or client
+	Device Device
+	// types and rooms restrict the events delivered, nil accepts all.
+	// types may end in "*" to match a prefix.
+	types  []string
+	rooms  map[string]bool
+	events chan []byte
 }
 
-var (
-	subscribers []Subscriber
-	subLock     sync.RWMutex
-)
+// accepts reports whether the filter of the subscriber lets event through.
+// Events without a room pass any room filter.
+func (sub *Subscriber) accepts(event Event) bool {
+	if sub.rooms != nil && event.Room != "" && !sub.rooms[utils.RoomName(event.Room)] {
+		return false
+	}
+	if sub.types == nil {
+		return true
+	}
+	for _, t := range sub.types {
+		if t == event.Type || strings.HasSuffix(t, "*") && strings.HasPrefix(event.Type, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
 
-// RegistrySSE registers a new SSE connection
-func RegistrySSE(w http.ResponseWriter, r *http.Request) {
-	// Set headers for SSE
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Cache-Control", "no-cache")
+// Hub fans events out to the connected SSE subscribers
+type Hub struct {
+	logger utils.Logger
+	// members returns the clients joined to a room, nil lets every
+	// subscriber receive the events of every room
+	members func(room string) []string
+	// onPresence is called with presence.connected, presence.disconnected
+	// and presence.changed when a device comes, goes or changes
+	onPresence  func(eventType string, device Device)
+	subscribers []*Subscriber
+	// offline keeps the devices of closed connections by subscriber ID
+	offline map[string]Device
+	subLock sync.RWMutex
+	// closed is closed by Close and replaced by reopen, guarded by subLock
+	closed chan struct{}
+}
+
+// NewHub creates an empty event hub
+func NewHub(logger utils.Logger) *Hub {
+	return &Hub{logger: logger, offline: make(map[string]Device), closed: make(chan struct{})}
+}
 
+// subscribe adds a subscriber for the connection of r, listed as a device
+// named by the name query parameter or after its user agent. It also
+// returns the device as registered, sub.Device may only be read under
+// subLock once the subscriber is listed.
+func (h *Hub) subscribe(w http.ResponseWriter, r *http.Request) (*Subscriber, Device) {
 	// Generate unique ID for subscriber
 	subscriberID := generateUUID()
-	fmt.Printf("%s Connection connected\n", subscriberID)
+	h.logger.Printf("%s Connection connected\n", subscriberID)
 
-	// Send initial registration message
+	sub := &Subscriber{
+		ID:       subscriberID,
+		Response: w,
+		Client:   getClientIP(r),
+		events:   make(chan []byte, subscriberBuffer),
+	}
+	h.addDevice(sub, r)
+	device := sub.Device
+
+	h.subLock.Lock()
+	h.subscribers = append(h.subscribers, sub)
+	h.subLock.Unlock()
+	h.notifyPresence("presence.connected", device)
+	return sub, device
+}
+
+// notifyPresence passes a presence change to onPresence
+func (h *Hub) notifyPresence(eventType string, device Device) {
+	if h.onPresence != nil {
+		h.onPresence(eventType, device)
+	}
+}
+
+// registryMessage is the first message of every connection, telling the
+// client its subscriber ID
+func registryMessage(device Device) []byte {
 	data := map[string]interface{}{
 		"type": "registry",
 		"data": map[string]string{
-			"id": subscriberID,
+			"id":   device.ID,
+			"name": device.Name,
 		},
 	}
 	jsonData, _ := json.Marshal(data)
-	fmt.Fprintf(w, "%s\n", jsonData)
-	w.(http.Flusher).Flush()
+	return jsonData
+}
 
-	// Add subscriber to list
-	subLock.Lock()
-	subscribers = append(subscribers, Subscriber{
-		ID:       subscriberID,
-		Response: w,
-	})
-	subLock.Unlock()
+// RegistrySSE registers a new SSE connection and streams events to it until
+// the client disconnects or the hub is closed. Every event is a "data:"
+// line with the JSON event, as EventSource clients expect.
+func (h *Hub) RegistrySSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
+	// Set headers for SSE
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	closed := h.done()
+	sub, device := h.subscribe(w, r)
 	// Remove subscriber when connection closes
-	notify := w.(http.CloseNotifier).CloseNotify()
-	go func() {
-		<-notify
-		subLock.Lock()
-		for i, sub := range subscribers {
-			if sub.ID == subscriberID {
-				subscribers = append(subscribers[:i], subscribers[i+1:]...)
-				break
+	defer func() {
+		h.remove(sub.ID)
+		h.logger.Printf("%s Connection closed\n", sub.ID)
+	}()
+
+	// Send initial registration message
+	fmt.Fprintf(w, "data: %s\n\n", registryMessage(device))
+	flusher.Flush()
+
+	for {
+		select {
+		case event := <-sub.events:
+			fmt.Fprintf(w, "data: %s\n\n", event)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-closed:
+			// Deliver what was queued before the hub closed, e.g. the
+			// final status change
+			for {
+				select {
+				case event := <-sub.events:
+					fmt.Fprintf(w, "data: %s\n\n", event)
+				default:
+					flusher.Flush()
+					return
+				}
 			}
 		}
-		subLock.Unlock()
-		fmt.Printf("%s Connection closed\n", subscriberID)
-	}()
+	}
+}
+
+func (h *Hub) remove(subscriberID string) {
+	h.subLock.Lock()
+	var (
+		device  Device
+		removed bool
+	)
+	for i, sub := range h.subscribers {
+		if sub.ID == subscriberID {
+			h.subscribers = append(h.subscribers[:i], h.subscribers[i+1:]...)
+			device = sub.Device
+			device.Online = false
+			device.LastSeen = time.Now().UnixMilli()
+			h.offline[subscriberID] = device
+			removed = true
+			break
+		}
+	}
+	h.subLock.Unlock()
+
+	if removed {
+		h.notifyPresence("presence.disconnected", device)
+	}
 }
 
-// SendEvent sends an event to all connected subscribers
-func SendEvent(data interface{}) error {
+// SendEvent sends an event to all connected subscribers. An Event of a
+// room other than the default room only reaches the subscribers whose
+// client joined that room.
+func (h *Hub) SendEvent(data interface{}) error {
+	return h.sendEvent(data, "")
+}
+
+// sendEvent sends an event like SendEvent to every subscriber but the one
+// with the ID except
+func (h *Hub) sendEvent(data interface{}, except string) error {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return fmt.Errorf("error marshaling event data: %v", err)
 	}
+	event, isEvent := data.(Event)
+	var joined map[string]bool
+	if isEvent && utils.RoomName(event.Room) != utils.DefaultRoom && h.members != nil {
+		joined = make(map[string]bool)
+		for _, client := range h.members(event.Room) {
+			joined[client] = true
+		}
+	}
 
-	subLock.RLock()
-	defer subLock.RUnlock()
+	h.subLock.RLock()
+	defer h.subLock.RUnlock()
 
-	for _, sub := range subscribers {
-		fmt.Fprintf(sub.Response, "%s\n", jsonData)
-		sub.Response.(http.Flusher).Flush()
+	for _, sub := range h.subscribers {
+		if sub.ID == except || joined != nil && !joined[sub.Client] || isEvent && !sub.accepts(event) {
+			continue
+		}
+		select {
+		case sub.events <- jsonData:
+		default:
+			h.logger.Printf("%s event dropped, subscriber too slow\n", sub.ID)
+		}
 	}
 
 	return nil
 }
 
+// sendToClient sends an event to the subscribers of client only, subject
+// to their filters
+func (h *Hub) sendToClient(client string, event Event) error {
+	jsonData, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error marshaling event data: %v", err)
+	}
+
+	h.subLock.RLock()
+	defer h.subLock.RUnlock()
+	for _, sub := range h.subscribers {
+		if sub.Client != client || !sub.accepts(event) {
+			continue
+		}
+		select {
+		case sub.events <- jsonData:
+		default:
+			h.logger.Printf("%s event dropped, subscriber too slow\n", sub.ID)
+		}
+	}
+	return nil
+}
+
+// setFilter restricts the events delivered to the subscriber with id to
+// types and rooms, nil accepts all
+func (h *Hub) setFilter(id string, types []string, rooms []string) {
+	h.subLock.Lock()
+	defer h.subLock.Unlock()
+	for _, sub := range h.subscribers {
+		if sub.ID != id {
+			continue
+		}
+		sub.types = types
+		sub.rooms = nil
+		if rooms != nil {
+			sub.rooms = make(map[string]bool, len(rooms))
+			for _, room := range rooms {
+				sub.rooms[utils.RoomName(room)] = true
+			}
+		}
+	}
+}
+
+// Len returns the number of connected subscribers
+func (h *Hub) Len() int {
+	h.subLock.RLock()
+	defer h.subLock.RUnlock()
+	return len(h.subscribers)
+}
+
+// Close ends every SSE stream after its queued events are written
+func (h *Hub) Close() {
+	h.subLock.Lock()
+	defer h.subLock.Unlock()
+	select {
+	case <-h.closed:
+	default:
+		close(h.closed)
+	}
+}
+
+// reopen lets a closed hub serve new connections again, e.g. when the
+// server is restarted
+func (h *Hub) reopen() {
+	h.subLock.Lock()
+	defer h.subLock.Unlock()
+	select {
+	case <-h.closed:
+		h.closed = make(chan struct{})
+	default:
+	}
+}
+
+// done returns a channel closed once the hub is closed
+func (h *Hub) done() <-chan struct{} {
+	h.subLock.RLock()
+	defer h.subLock.RUnlock()
+	return h.closed
+}
+
 // Helper function to generate UUID
 func generateUUID() string {
 	// This is a simple implementation. In production, you should use a proper UUID library
@@ -0,0 +1,351 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wwqdrh/file-share/utils"
+)
+
+const (
+	defaultTextPageSize = 50
+	maxTextPageSize     = 500
+)
+
+// HandleListTexts returns a page of the text history of the requested
+// room in chronological order. limit sets the page size, before continues
+// with the messages older than the given id (the before cursor of the
+// previous page) and pinned=1 lists pinned messages only.
+func (s *Server) HandleListTexts(w http.ResponseWriter, r *http.Request) {
+	room, ok := s.joinedRoom(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	limit := defaultTextPageSize
+	if n, err := strconv.Atoi(query.Get("limit")); err == nil && n > 0 {
+		limit = min(n, maxTextPageSize)
+	}
+
+	page, err := s.texts.Page(room, query.Get("before"), limit, query.Get("pinned") == "1")
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    400,
+			"message": "分页游标无效",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code": 200,
+		"data": page,
+	})
+}
+
+// HandleCreateText adds a message to the text history of the requested
+// room. format is plain, markdown or code, language names the language of
+// code.
+func (s *Server) HandleCreateText(w http.ResponseWriter, r *http.Request) {
+	room, ok := s.joinedRoom(w, r)
+	if !ok {
+		return
+	}
+
+	var data struct {
+		Content  string `json:"content"`
+		Format   string `json:"format"`
+		Language string `json:"language"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || strings.TrimSpace(data.Content) == "" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    500,
+			"message": "消息不能为空",
+		})
+		return
+	}
+	if len(data.Content) > utils.MaxTextSize {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    413,
+			"message": "消息过长",
+		})
+		return
+	}
+	if _, _, err := utils.ParseTextFormat(data.Format, data.Language); err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    400,
+			"message": "消息格式无效",
+		})
+		return
+	}
+
+	message, err := s.AddText(utils.TextMessage{
+		Content:  data.Content,
+		Format:   data.Format,
+		Language: data.Language,
+		Author:   getClientIP(r),
+		Client:   getClientIP(r),
+		Room:     room,
+	})
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    500,
+			"message": "保存消息失败",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    200,
+		"data":    message,
+		"message": "添加成功",
+	})
+}
+
+// requestText returns the message of the request path when the client
+// joined its room. Otherwise it writes the error response and returns false.
+func (s *Server) requestText(w http.ResponseWriter, r *http.Request) (utils.TextMessage, bool) {
+	message, err := s.texts.Get(r.PathValue("id"))
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    404,
+			"message": "消息不存在",
+		})
+		return message, false
+	}
+	if !s.canAccess(r, message.Room) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    403,
+			"message": "未加入该房间",
+		})
+		return message, false
+	}
+	return message, true
+}
+
+// HandleGetText returns a single message
+func (s *Server) HandleGetText(w http.ResponseWriter, r *http.Request) {
+	message, ok := s.requestText(w, r)
+	if !ok {
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code": 200,
+		"data": message,
+	})
+}
+
+// canEditText reports whether the client of r may change or delete
+// message, which only its author and the host can
+func canEditText(r *http.Request, message utils.TextMessage) bool {
+	return (message.Client != "" && message.Client == getClientIP(r)) || isHostClient(r)
+}
+
+// HandleUpdateText edits the content or format of a message and pins or
+// unpins it. Fields missing from the body are left unchanged. Only the
+// author and the host may edit, anyone in the room may pin.
+func (s *Server) HandleUpdateText(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Content  *string `json:"content"`
+		Format   *string `json:"format"`
+		Language *string `json:"language"`
+		Pinned   *bool   `json:"pinned"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	original, ok := s.requestText(w, r)
+	if !ok {
+		return
+	}
+	if (data.Content != nil || data.Format != nil || data.Language != nil) && !canEditText(r, original) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    403,
+			"message": "只能修改自己的消息",
+		})
+		return
+	}
+	if data.Content != nil && strings.TrimSpace(*data.Content) == "" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    500,
+			"message": "消息不能为空",
+		})
+		return
+	}
+	if data.Content != nil && len(*data.Content) > utils.MaxTextSize {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    413,
+			"message": "消息过长",
+		})
+		return
+	}
+
+	if data.Format != nil || data.Language != nil {
+		format, language := "", ""
+		if data.Format != nil {
+			format = *data.Format
+		}
+		if data.Language != nil {
+			language = *data.Language
+		}
+		// A language alone is checked against the code format
+		if data.Format == nil {
+			format = utils.TextCode
+		}
+		if _, _, err := utils.ParseTextFormat(format, language); err != nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"code":    400,
+				"message": "消息格式无效",
+			})
+			return
+		}
+	}
+
+	message, err := s.texts.Update(r.PathValue("id"), func(m *utils.TextMessage) {
+		if data.Content != nil {
+			m.Content = *data.Content
+		}
+		if data.Format != nil {
+			m.Format = *data.Format
+		}
+		if data.Language != nil {
+			m.Language = *data.Language
+		}
+		if data.Pinned != nil {
+			m.Pinned = *data.Pinned
+		}
+	})
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    404,
+			"message": "消息不存在",
+		})
+		return
+	}
+
+	s.index.AddText(textIndexID(message.ID), message.Title, message.Content)
+	s.publishRoom(message.Room, "text.updated", message)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    200,
+		"data":    message,
+		"message": "修改成功",
+	})
+}
+
+// HandleDeleteText removes a message from the history, only its author
+// and the host may delete it
+func (s *Server) HandleDeleteText(w http.ResponseWriter, r *http.Request) {
+	message, ok := s.requestText(w, r)
+	if !ok {
+		return
+	}
+	if !canEditText(r, message) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    403,
+			"message": "只能删除自己的消息",
+		})
+		return
+	}
+	id := message.ID
+	if err := s.texts.Delete(id); err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    404,
+			"message": "消息不存在",
+		})
+		return
+	}
+
+	s.index.Remove(textIndexID(id))
+	s.publishRoom(message.Room, "text.deleted", map[string]string{"id": id})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    200,
+		"message": "删除成功",
+	})
+}
+
+// rawTextExts maps the language of code snippets to a file extension.
+// Snippets are always served as plain text, so that none can be loaded as
+// a script or stylesheet of this origin.
+var rawTextExts = map[string]string{
+	"go":         ".go",
+	"python":     ".py",
+	"py":         ".py",
+	"javascript": ".js",
+	"js":         ".js",
+	"typescript": ".ts",
+	"ts":         ".ts",
+	"json":       ".json",
+	"yaml":       ".yaml",
+	"yml":        ".yaml",
+	"toml":       ".toml",
+	"css":        ".css",
+	"html":       ".html",
+	"xml":        ".xml",
+	"svg":        ".svg",
+	"shell":      ".sh",
+	"sh":         ".sh",
+	"bash":       ".sh",
+	"sql":        ".sql",
+	"c":          ".c",
+	"cpp":        ".cpp",
+	"c++":        ".cpp",
+	"java":       ".java",
+	"rust":       ".rs",
+	"rs":         ".rs",
+}
+
+// rawTextType returns the file extension and content type of a message
+func rawTextType(message utils.TextMessage) (string, string) {
+	switch message.Format {
+	case utils.TextMarkdown:
+		return ".md", "text/markdown; charset=utf-8"
+	case utils.TextCode:
+		if ext, ok := rawTextExts[message.Language]; ok {
+			return ext, "text/plain; charset=utf-8"
+		}
+	}
+	return ".txt", "text/plain; charset=utf-8"
+}
+
+// isRawTextPath reports whether path is /api/texts/{id}/raw, which checks
+// its token itself so it can be fetched with a token query parameter
+func isRawTextPath(path string) bool {
+	return strings.HasPrefix(path, "/api/texts/") && strings.HasSuffix(path, "/raw")
+}
+
+// HandleRawText serves the content of a message as a file with the content
+// type of its format, e.g. for curl. The session token is read from the
+// Authorization header or the token query parameter, download=1 asks the
+// browser to save it.
+func (s *Server) HandleRawText(w http.ResponseWriter, r *http.Request) {
+	if s.GetAuthEnable() && !s.validSession(requestToken(r)) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	message, err := s.texts.Get(r.PathValue("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.canAccess(r, message.Room) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	ext, contentType := rawTextType(message)
+	disposition := "inline"
+	if r.URL.Query().Get("download") == "1" {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", disposition+"; filename=\""+message.ID+ext+"\"")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'")
+	http.ServeContent(w, r, "", time.UnixMilli(message.UpdatedAt), strings.NewReader(message.Content))
+}
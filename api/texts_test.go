@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/wwqdrh/file-share/utils"
+)
+
+// apiCall sends a JSON request from remoteAddr and decodes the response
+func apiCall(t *testing.T, s *Server, method, target, remoteAddr, body string) (int, utils.TextMessage) {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var resp struct {
+		Code int               `json:"code"`
+		Data utils.TextMessage `json:"data"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("%s %s: %v", method, target, err)
+	}
+	return resp.Code, resp.Data
+}
+
+func TestTextEditRestrictedToAuthor(t *testing.T) {
+	s := newTestServer(t)
+	const author, other, host = "192.0.2.1:1000", "192.0.2.2:1000", "127.0.0.1:1000"
+
+	code, message := apiCall(t, s, http.MethodPost, "/api/texts", author, `{"content":"hello"}`)
+	if code != 200 || message.Client != "192.0.2.1" {
+		t.Fatalf("create: %d %+v", code, message)
+	}
+	target := "/api/texts/" + message.ID
+
+	if code, _ := apiCall(t, s, http.MethodPatch, target, other, `{"content":"forged"}`); code != 403 {
+		t.Errorf("edit by another client: %d", code)
+	}
+	if code, _ := apiCall(t, s, http.MethodPatch, target, other, `{"format":"markdown"}`); code != 403 {
+		t.Errorf("format change by another client: %d", code)
+	}
+	if code, _ := apiCall(t, s, http.MethodDelete, target, other, ""); code != 403 {
+		t.Errorf("delete by another client: %d", code)
+	}
+	if stored, _ := s.texts.Get(message.ID); stored.Content != "hello" {
+		t.Fatalf("content %q after rejected edits", stored.Content)
+	}
+
+	// Anyone in the room may pin
+	if code, pinned := apiCall(t, s, http.MethodPatch, target, other, `{"pinned":true}`); code != 200 || !pinned.Pinned {
+		t.Errorf("pin by another client: %d %+v", code, pinned)
+	}
+
+	code, edited := apiCall(t, s, http.MethodPatch, target, author, `{"content":"hello again"}`)
+	if code != 200 || edited.Content != "hello again" || edited.Client != "192.0.2.1" {
+		t.Errorf("edit by the author: %d %+v", code, edited)
+	}
+	if code, _ := apiCall(t, s, http.MethodDelete, target, host, ""); code != 200 {
+		t.Errorf("delete by the host: %d", code)
+	}
+}
+
+func TestRawTextIsPlainText(t *testing.T) {
+	s := newTestServer(t)
+	for _, language := range []string{"javascript", "js", "css", "html", "svg", "json", "go", "unknown"} {
+		message, err := s.AddText(utils.TextMessage{Content: "x", Format: utils.TextCode, Language: language})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/api/texts/"+message.ID+"/raw", nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+
+		if got := w.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+			t.Errorf("%s: Content-Type %q", language, got)
+		}
+		ext := rawTextExts[language]
+		if ext == "" {
+			ext = ".txt"
+		}
+		if got := w.Header().Get("Content-Disposition"); !strings.HasSuffix(got, ext+`"`) {
+			t.Errorf("%s: Content-Disposition %q", language, got)
+		}
+	}
+}
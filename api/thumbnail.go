@@ -0,0 +1,38 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/wwqdrh/file-share/utils"
+)
+
+// HandleThumbnail serves a scaled down copy of a shared image. The optional
+// size parameter sets the bounding box in pixels (default 256, at most 1024).
+// Thumbnails are generated once and cached on disk until the image changes.
+func (s *Server) HandleThumbnail(w http.ResponseWriter, r *http.Request) {
+	file, ok := s.resolveRequestFile(w, r)
+	if !ok {
+		return
+	}
+	if file.Info.IsDir() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !utils.CanThumbnail(file.Name) {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+	thumbPath, contentType, err := s.thumbnails.Thumbnail(file.Path, size)
+	if err != nil {
+		s.logger.Printf("thumbnail error: %v\n", err)
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeFile(w, r, thumbPath)
+}
@@ -0,0 +1,387 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wwqdrh/file-share/utils"
+)
+
+// Kinds and statuses of a transfer
+const (
+	TransferUpload   = "upload"
+	TransferDownload = "download"
+
+	TransferActive    = "active"
+	TransferDone      = "done"
+	TransferCancelled = "cancelled"
+	TransferFailed    = "failed"
+)
+
+// transferProgressInterval is the least time between two
+// transfer.progress events of one transfer
+const transferProgressInterval = 500 * time.Millisecond
+
+// errTransferCancelled fails reads and writes of a cancelled transfer
+var errTransferCancelled = errors.New("transfer cancelled")
+
+// Transfer is an upload or download as reported by /api/transfers and the
+// transfer.progress events
+type Transfer struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Client string `json:"client"`
+	Room   string `json:"room"`
+	// Offer is the id of the offer a transfer between two devices belongs
+	// to. Such transfers have no room and only their client sees them.
+	Offer string `json:"offer,omitempty"`
+	Bytes int64  `json:"bytes"`
+	// Total is the expected size in bytes, 0 when unknown. For uploads it
+	// is the request size, which includes a little multipart framing.
+	Total int64 `json:"total"`
+	// Rate is the current speed in bytes per second and ETA the expected
+	// seconds left, -1 when unknown
+	Rate   int64  `json:"rate"`
+	ETA    int64  `json:"eta"`
+	Status string `json:"status"`
+	// StartedAt is unix milliseconds
+	StartedAt int64 `json:"startedAt"`
+}
+
+// transfer is a running Transfer. Its progress is only announced once the
+// first byte moved, so that conditional and HEAD requests stay silent.
+type transfer struct {
+	lock sync.Mutex
+	Transfer
+	cancelled bool
+	// interrupt unblocks a read or write waiting on the connection
+	interrupt func()
+	// ctx ends with the request or when stop is called
+	ctx  context.Context
+	stop context.CancelFunc
+	// limiters are the rate limits the transfer passes, release gives them
+	// back
+	limiters []*utils.RateLimiter
+	release  func()
+	// lastEvent and lastBytes are the time and progress of the last event
+	lastEvent time.Time
+	lastBytes int64
+}
+
+// snapshot returns the transfer with its rate and ETA as of now. The
+// caller holds t.lock.
+func (t *transfer) snapshot(now time.Time) Transfer {
+	view := t.Transfer
+	view.Rate, view.ETA = -1, -1
+	since, from := t.lastEvent, t.lastBytes
+	if since.IsZero() {
+		since, from = time.UnixMilli(t.StartedAt), 0
+	}
+	if elapsed := now.Sub(since); elapsed > 0 {
+		view.Rate = int64(float64(view.Bytes-from) / elapsed.Seconds())
+	}
+	if view.Rate > 0 && view.Total > view.Bytes {
+		view.ETA = (view.Total - view.Bytes) / view.Rate
+	}
+	return view
+}
+
+// startTransfer tracks a new transfer of the client of r. interrupt is
+// called when the transfer is cancelled.
+func (s *Server) startTransfer(r *http.Request, kind, name, room string, total int64, interrupt func()) *transfer {
+	return s.trackTransfer(r, Transfer{Kind: kind, Name: name, Room: utils.RoomName(room), Total: total}, interrupt)
+}
+
+// startOfferTransfer tracks a new transfer of the file of offer o, see
+// startTransfer
+func (s *Server) startOfferTransfer(r *http.Request, kind string, o *offer, total int64, interrupt func()) *transfer {
+	return s.trackTransfer(r, Transfer{Kind: kind, Name: o.Name, Offer: o.ID, Total: total}, interrupt)
+}
+
+// trackTransfer tracks the transfer described by view, filling in its id,
+// client and start
+func (s *Server) trackTransfer(r *http.Request, view Transfer, interrupt func()) *transfer {
+	view.ID = newOfferID()
+	view.Client = getClientIP(r)
+	view.Status = TransferActive
+	view.StartedAt = time.Now().UnixMilli()
+	if view.Total < 0 {
+		view.Total = 0
+	}
+	ctx, stop := context.WithCancel(r.Context())
+	limiters, release := s.bandwidth.acquire(view.Client, view.Kind)
+	t := &transfer{
+		Transfer:  view,
+		interrupt: interrupt,
+		ctx:       ctx,
+		stop:      stop,
+		limiters:  limiters,
+		release:   release,
+	}
+	s.transfersLock.Lock()
+	s.transfers[t.ID] = t
+	s.transfersLock.Unlock()
+	return t
+}
+
+// countTransfer adds n moved bytes to t and publishes a transfer.progress
+// event unless one was sent within transferProgressInterval. It fails once
+// the transfer was cancelled.
+func (s *Server) countTransfer(t *transfer, n int) error {
+	now := time.Now()
+	t.lock.Lock()
+	if t.cancelled {
+		t.lock.Unlock()
+		return errTransferCancelled
+	}
+	t.Bytes += int64(n)
+	var view Transfer
+	due := now.Sub(t.lastEvent) >= transferProgressInterval
+	if due {
+		view = t.snapshot(now)
+		t.lastEvent, t.lastBytes = now, t.Bytes
+	}
+	t.lock.Unlock()
+
+	if due {
+		s.publishTransfer(view)
+	}
+	return nil
+}
+
+// publishTransfer sends a transfer.progress event to the room of the
+// transfer, or to its client for transfers of offers
+func (s *Server) publishTransfer(view Transfer) {
+	if view.Offer == "" {
+		s.publishRoom(view.Room, "transfer.progress", view)
+		return
+	}
+	event := Event{Type: "transfer.progress", Data: view}
+	if s.options.OnEvent != nil {
+		s.options.OnEvent(event)
+	}
+	if err := s.hub.sendToClient(view.Client, event); err != nil {
+		s.logger.Printf("send event error: %v\n", err)
+	}
+}
+
+// throttle waits until the rate limits of t let n more bytes through
+func (t *transfer) throttle(n int) error {
+	for _, limiter := range t.limiters {
+		if err := limiter.WaitN(t.ctx, n); err != nil {
+			t.lock.Lock()
+			defer t.lock.Unlock()
+			if t.cancelled {
+				return errTransferCancelled
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// finishTransfer stops tracking t and publishes its final state: done when
+// err is nil, cancelled or failed otherwise
+func (s *Server) finishTransfer(t *transfer, err error) {
+	s.transfersLock.Lock()
+	delete(s.transfers, t.ID)
+	s.transfersLock.Unlock()
+	t.stop()
+	t.release()
+
+	t.lock.Lock()
+	switch {
+	case t.cancelled:
+		t.Status = TransferCancelled
+	case err != nil:
+		t.Status = TransferFailed
+	default:
+		t.Status = TransferDone
+		t.Total = t.Bytes
+	}
+	announced := !t.lastEvent.IsZero()
+	view := t.snapshot(time.Now())
+	t.lock.Unlock()
+
+	if announced || t.Status == TransferCancelled {
+		s.publishTransfer(view)
+	}
+}
+
+// Transfers returns the running transfers, oldest first
+func (s *Server) Transfers() []Transfer {
+	s.transfersLock.Lock()
+	running := make([]*transfer, 0, len(s.transfers))
+	for _, t := range s.transfers {
+		running = append(running, t)
+	}
+	s.transfersLock.Unlock()
+
+	now := time.Now()
+	transfers := make([]Transfer, 0, len(running))
+	for _, t := range running {
+		t.lock.Lock()
+		transfers = append(transfers, t.snapshot(now))
+		t.lock.Unlock()
+	}
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].StartedAt < transfers[j].StartedAt
+	})
+	return transfers
+}
+
+// transferReader counts the bytes read from an upload and holds it to the
+// rate limits
+type transferReader struct {
+	io.Reader
+	s *Server
+	t *transfer
+}
+
+func (r *transferReader) Read(p []byte) (int, error) {
+	if len(p) > transferChunk {
+		p = p[:transferChunk]
+	}
+	n, err := r.Reader.Read(p)
+	if countErr := r.s.countTransfer(r.t, n); countErr != nil {
+		return n, countErr
+	}
+	if limitErr := r.t.throttle(n); limitErr != nil {
+		return n, limitErr
+	}
+	return n, err
+}
+
+// transferWriter counts the bytes of a download written to the response
+// and holds it to the rate limits
+type transferWriter struct {
+	http.ResponseWriter
+	s *Server
+	t *transfer
+	// err is the first failed write
+	err error
+}
+
+// WriteHeader takes the expected size from Content-Length, which is the
+// length of the requested range for partial downloads
+func (w *transferWriter) WriteHeader(status int) {
+	if size := w.Header().Get("Content-Length"); size != "" {
+		if total, err := strconv.ParseInt(size, 10, 64); err == nil {
+			w.t.lock.Lock()
+			w.t.Total = total
+			w.t.lock.Unlock()
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *transferWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(written+transferChunk, len(p))]
+		err := w.t.throttle(len(chunk))
+		if err == nil {
+			var n int
+			n, err = w.ResponseWriter.Write(chunk)
+			written += n
+			if countErr := w.s.countTransfer(w.t, n); countErr != nil {
+				err = countErr
+			}
+		}
+		if err != nil {
+			if w.err == nil {
+				w.err = err
+			}
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (w *transferWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// serveTransfer serves the file at path like http.ServeFile as a download
+// tracked by the transfer start returns. start gets the function that
+// interrupts the response. HEAD requests are not tracked.
+func (s *Server) serveTransfer(w http.ResponseWriter, r *http.Request, path string, start func(interrupt func()) *transfer) {
+	if r.Method == http.MethodHead {
+		http.ServeFile(w, r, path)
+		return
+	}
+	controller := http.NewResponseController(w)
+	t := start(func() {
+		controller.SetWriteDeadline(time.Now())
+	})
+	tw := &transferWriter{ResponseWriter: w, s: s, t: t}
+	http.ServeFile(tw, r, path)
+	s.finishTransfer(t, tw.err)
+}
+
+// HandleListTransfers lists the running uploads and downloads of the rooms
+// the client joined and the transfers of its offers
+func (s *Server) HandleListTransfers(w http.ResponseWriter, r *http.Request) {
+	client := getClientIP(r)
+	transfers := make([]Transfer, 0)
+	for _, t := range s.Transfers() {
+		if t.Offer != "" && t.Client == client || t.Offer == "" && s.canAccess(r, t.Room) {
+			transfers = append(transfers, t)
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code": 200,
+		"data": map[string]interface{}{
+			"transfers": transfers,
+		},
+	})
+}
+
+// HandleCancelTransfer cancels a running transfer. Clients may cancel their
+// own transfers, the machine running the server any of them.
+func (s *Server) HandleCancelTransfer(w http.ResponseWriter, r *http.Request) {
+	s.transfersLock.Lock()
+	t := s.transfers[r.PathValue("id")]
+	s.transfersLock.Unlock()
+	if t == nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    404,
+			"message": "传输不存在或已结束",
+		})
+		return
+	}
+
+	client := getClientIP(r)
+	t.lock.Lock()
+	allowed := t.Client == client || isHostClient(r)
+	if allowed && !t.cancelled {
+		t.cancelled = true
+		t.stop()
+		if t.interrupt != nil {
+			t.interrupt()
+		}
+	}
+	t.lock.Unlock()
+
+	if !allowed {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":    403,
+			"message": "无权取消该传输",
+		})
+		return
+	}
+	s.logger.Printf("transfer %s of %s cancelled by %s\n", t.ID, t.Name, client)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    200,
+		"message": "已取消",
+	})
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"github.com/wwqdrh/file-share/utils"
+)
+
+// watchSyncInterval is how often the watched roots are compared with the
+// shared entries, which also catches entries shared by other processes
+const watchSyncInterval = 30 * time.Second
+
+// startWatcher watches the shared files and directories and publishes
+// their changes as file.created, file.changed and file.deleted events
+func (s *Server) startWatcher() {
+	watcher, err := utils.NewWatcher(s.logger)
+	if err != nil {
+		s.logger.Printf("watch error: %v\n", err)
+		return
+	}
+	s.watcherLock.Lock()
+	s.watcher = watcher
+	s.watcherLock.Unlock()
+
+	go func() {
+		// Adding large trees takes a while, do not hold up the start
+		s.syncWatches(watcher)
+		ticker := time.NewTicker(watchSyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case event, ok := <-watcher.Events():
+				if !ok {
+					return
+				}
+				s.handleWatchEvent(watcher, event)
+			case <-ticker.C:
+				s.syncWatches(watcher)
+			}
+		}
+	}()
+}
+
+// closeWatcher stops watching the shared entries
+func (s *Server) closeWatcher() {
+	s.watcherLock.Lock()
+	defer s.watcherLock.Unlock()
+	if s.watcher != nil {
+		s.watcher.Close()
+		s.watcher = nil
+	}
+}
+
+// syncWatches watches new shared entries, stops watching removed ones and
+// prunes entries whose file is gone from the list
+func (s *Server) syncWatches(watcher *utils.Watcher) {
+	files, err := s.db.ListFiles()
+	if err != nil {
+		s.logger.Printf("watch sync error: %v\n", err)
+		return
+	}
+
+	watched := watcher.Roots()
+	shared := make(map[string]bool)
+	for _, file := range files {
+		if file.Type != "file" && file.Type != "directory" {
+			continue
+		}
+		if _, err := os.Stat(file.Path); os.IsNotExist(err) {
+			s.pruneEntry(file)
+			continue
+		}
+		// Uploaded blobs never change behind our back
+		if utils.IsBlobPath(s.paths.BlobDir(), file.Path) {
+			continue
+		}
+		shared[file.Name] = true
+		if root, ok := watched[file.Name]; !ok || root != file.Path {
+			err := watcher.Add(file.Name, file.Path)
+			if err == utils.ErrWatcherClosed {
+				return
+			}
+			if err != nil {
+				s.logger.Printf("watch %s error: %v\n", file.Path, err)
+			}
+		}
+	}
+	for key := range watched {
+		if !shared[key] {
+			watcher.Remove(key)
+		}
+	}
+}
+
+// pruneEntry removes a shared entry whose file no longer exists
+func (s *Server) pruneEntry(file utils.FileInfo) {
+	s.logger.Printf("file not exist: %s\n", file.Path)
+	s.RemoveFile(file)
+	s.publishRoom(file.Room, "file.deleted", map[string]string{"path": file.Name, "name": file.Name, "type": file.Type})
+}
+
+// handleWatchEvent updates the search index and notifies subscribers of a
+// change below a shared entry
+func (s *Server) handleWatchEvent(watcher *utils.Watcher, event utils.WatchEvent) {
+	relPath := event.Key
+	if rel := event.RelPath(); rel != "" {
+		relPath += "/" + rel
+	}
+
+	if event.Op == utils.WatchDeleted && event.Path == event.Root {
+		// Editors often replace files by renaming over them, the entry
+		// is only gone if nothing took its place
+		if _, err := os.Stat(event.Root); err == nil {
+			watcher.Add(event.Key, event.Root)
+			event.Op = utils.WatchChanged
+		} else {
+			watcher.Remove(event.Key)
+			file, _ := s.db.GetFile(event.Key)
+			if file.Name == "" {
+				return
+			}
+			s.pruneEntry(file)
+			return
+		}
+	}
+
+	fileType := "file"
+	if event.IsDir {
+		fileType = "directory"
+	}
+	switch event.Op {
+	case utils.WatchCreated, utils.WatchChanged:
+		if !event.IsDir {
+			s.index.AddFile(relPath, path.Base(relPath), event.Path)
+		}
+	case utils.WatchDeleted:
+		s.index.RemovePrefix(relPath)
+	}
+
+	s.publishRoom(s.entryRoom(event.Key), "file."+event.Op, map[string]string{
+		"path": relPath,
+		"name": path.Base(relPath),
+		"type": fileType,
+	})
+}
@@ -0,0 +1,234 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/wwqdrh/file-share/utils"
+	"github.com/wwqdrh/file-share/websocket"
+)
+
+const (
+	// wsPingInterval is how often the server pings an idle WebSocket
+	wsPingInterval = 30 * time.Second
+	// wsReadTimeout closes connections that sent nothing, not even a pong,
+	// for this long
+	wsReadTimeout = 2*wsPingInterval + 10*time.Second
+)
+
+// wsMessage is a message of the /api/ws protocol in both directions. ID is
+// chosen by the client and echoed in the reply to its request.
+type wsMessage struct {
+	Type string          `json:"type"`
+	ID   string          `json:"id,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// wsReply is a reply to a client message: ack, error or pong
+type wsReply struct {
+	Type string      `json:"type"`
+	ID   string      `json:"id,omitempty"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// HandleWebSocket serves /api/ws, a WebSocket carrying the same events as
+// /api/registrySSE, one JSON event per text message, starting with the
+// registry message. Browsers cannot set headers on WebSockets, so the
+// session token may also be passed as the token query parameter, and
+// handshakes from pages of other origins are refused.
+//
+// Clients send JSON messages {"type", "id", "data"}:
+//   - subscribe {"types": [...], "rooms": [...]} limits the delivered
+//     events to the given types (a trailing "*" matches a prefix) and rooms
+//   - publish {"content", "format", "language", "room"} adds a text message
+//   - ping is answered with a pong
+//   - typing {"room", "typing"} announces typing to the room
+//   - presence {"name", "status"} sets the display name or the status of
+//     the device, e.g. away
+//
+// Requests are answered with an ack, error or pong message carrying the
+// same id. Every message counts as a presence heartbeat.
+func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if s.GetAuthEnable() && !s.validSession(requestToken(r)) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		s.logger.Printf("websocket upgrade error: %v\n", err)
+		return
+	}
+
+	conn.ReadTimeout = wsReadTimeout
+	sub, device := s.hub.subscribe(nil, r)
+	defer func() {
+		s.hub.remove(sub.ID)
+		s.logger.Printf("%s Connection closed\n", sub.ID)
+	}()
+
+	if err := conn.WriteMessage(websocket.TextMessage, registryMessage(device)); err != nil {
+		conn.Close(websocket.CloseGoingAway, "")
+		return
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.writeEvents(conn, sub, done)
+
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			conn.Close(websocket.CloseGoingAway, "")
+			return
+		}
+		if messageType != websocket.TextMessage {
+			conn.Close(websocket.CloseUnsupportedData, "text messages only")
+			return
+		}
+
+		var message wsMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			s.replyWS(conn, wsReply{Type: "error", Data: map[string]string{"message": "消息格式无效"}})
+			continue
+		}
+		s.setPresence(sub.ID, presenceUpdate{})
+		s.replyWS(conn, s.handleWSMessage(sub, message))
+	}
+}
+
+// writeEvents forwards the events of sub to conn and pings it while idle
+// until done is closed or the hub closes
+func (s *Server) writeEvents(conn *websocket.Conn, sub *Subscriber, done chan struct{}) {
+	closed := s.hub.done()
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-sub.events:
+			if err := conn.WriteMessage(websocket.TextMessage, event); err != nil {
+				conn.Close(websocket.CloseGoingAway, "")
+				return
+			}
+		case <-ticker.C:
+			conn.WriteMessage(websocket.PingMessage, nil)
+		case <-done:
+			return
+		case <-closed:
+			// Deliver what was queued before the hub closed
+			for {
+				select {
+				case event := <-sub.events:
+					conn.WriteMessage(websocket.TextMessage, event)
+				default:
+					conn.Close(websocket.CloseGoingAway, "server stopped")
+					return
+				}
+			}
+		}
+	}
+}
+
+// replyWS writes a reply to conn
+func (s *Server) replyWS(conn *websocket.Conn, reply wsReply) {
+	jsonData, err := json.Marshal(reply)
+	if err != nil {
+		s.logger.Printf("websocket reply error: %v\n", err)
+		return
+	}
+	conn.WriteMessage(websocket.TextMessage, jsonData)
+}
+
+// wsError returns an error reply to the message with id
+func wsError(id, message string) wsReply {
+	return wsReply{Type: "error", ID: id, Data: map[string]string{"message": message}}
+}
+
+// handleWSMessage runs a client message of the subscriber sub and returns
+// the reply
+func (s *Server) handleWSMessage(sub *Subscriber, message wsMessage) wsReply {
+	switch message.Type {
+	case "ping":
+		return wsReply{Type: "pong", ID: message.ID, Data: map[string]int64{"time": time.Now().UnixMilli()}}
+
+	case "subscribe":
+		var data struct {
+			Types []string `json:"types"`
+			Rooms []string `json:"rooms"`
+		}
+		if len(message.Data) > 0 && json.Unmarshal(message.Data, &data) != nil {
+			return wsError(message.ID, "消息格式无效")
+		}
+		s.hub.setFilter(sub.ID, data.Types, data.Rooms)
+		return wsReply{Type: "ack", ID: message.ID}
+
+	case "publish":
+		var data struct {
+			Content  string `json:"content"`
+			Format   string `json:"format"`
+			Language string `json:"language"`
+			Room     string `json:"room"`
+		}
+		if json.Unmarshal(message.Data, &data) != nil || strings.TrimSpace(data.Content) == "" {
+			return wsError(message.ID, "消息不能为空")
+		}
+		if len(data.Content) > utils.MaxTextSize {
+			return wsError(message.ID, "消息过长")
+		}
+		if _, _, err := utils.ParseTextFormat(data.Format, data.Language); err != nil {
+			return wsError(message.ID, "消息格式无效")
+		}
+		room := utils.RoomName(data.Room)
+		if !s.rooms.IsMember(room, sub.Client) {
+			return wsError(message.ID, "未加入该房间")
+		}
+		text, err := s.AddText(utils.TextMessage{
+			Content:  data.Content,
+			Format:   data.Format,
+			Language: data.Language,
+			Author:   sub.Client,
+			Client:   sub.Client,
+			Room:     room,
+		})
+		if err != nil {
+			return wsError(message.ID, "保存消息失败")
+		}
+		return wsReply{Type: "ack", ID: message.ID, Data: text}
+
+	case "typing":
+		var data struct {
+			Room   string `json:"room"`
+			Typing bool   `json:"typing"`
+		}
+		if json.Unmarshal(message.Data, &data) != nil {
+			return wsError(message.ID, "消息格式无效")
+		}
+		room := utils.RoomName(data.Room)
+		if !s.rooms.IsMember(room, sub.Client) {
+			return wsError(message.ID, "未加入该房间")
+		}
+		// Device copies the device under the hub lock, a heartbeat may be
+		// renaming it
+		device, _ := s.hub.Device(sub.ID)
+		s.publishRoom(room, "typing", map[string]interface{}{
+			"device": sub.ID,
+			"name":   device.Name,
+			"typing": data.Typing,
+		})
+		return wsReply{Type: "ack", ID: message.ID}
+
+	case "presence":
+		var update presenceUpdate
+		if json.Unmarshal(message.Data, &update) != nil || update.Status != "" && !validPresence(update.Status) {
+			return wsError(message.ID, "状态无效")
+		}
+		device, ok := s.setPresence(sub.ID, update)
+		if !ok {
+			return wsError(message.ID, "设备不在线")
+		}
+		return wsReply{Type: "ack", ID: message.ID, Data: device}
+	}
+	return wsError(message.ID, "未知的消息类型")
+}
@@ -0,0 +1,429 @@
+// Package client talks to a remote file-share server over its HTTP API
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/wwqdrh/file-share/utils"
+)
+
+// ProgressFunc is called while transferring with the bytes done so far and
+// the total size, total is -1 when unknown
+type ProgressFunc func(done, total int64)
+
+// Event is an event received from the server's SSE stream
+type Event struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+	// Room is the room the event belongs to, empty for global events
+	Room string `json:"room,omitempty"`
+}
+
+// Client is a file-share API client. The zero value is not usable, create
+// one with New.
+type Client struct {
+	// BaseURL is the server address, e.g. http://192.168.1.10:5421
+	BaseURL string
+	// Token is the session token returned by Login
+	Token string
+	// Room is the room files and texts are listed in and sent to, empty
+	// for the default room
+	Room string
+	// HTTPClient performs the requests
+	HTTPClient *http.Client
+}
+
+// response is the envelope of every JSON API response
+type response struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// New creates a client for the server at baseURL
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{},
+	}
+}
+
+// TLSConfig returns a client TLS configuration for a server using a
+// self-signed certificate. With a fingerprint (as printed by the server on
+// startup) only that certificate is accepted; otherwise verification is
+// skipped entirely when insecure is true.
+func TLSConfig(fingerprint string, insecure bool) *tls.Config {
+	if fingerprint == "" {
+		return &tls.Config{InsecureSkipVerify: insecure}
+	}
+
+	want := strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(fingerprint))
+	return &tls.Config{
+		// The certificate is verified against the pinned fingerprint below
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("server sent no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if hex.EncodeToString(sum[:]) != want {
+				return fmt.Errorf("certificate fingerprint mismatch")
+			}
+			return nil
+		},
+	}
+}
+
+// Login exchanges the password for a session token. Servers without
+// authentication accept any password.
+func (c *Client) Login(ctx context.Context, password string) error {
+	body, _ := json.Marshal(map[string]string{"password": password})
+	var data struct {
+		Authorization string `json:"Authorization"`
+	}
+	if err := c.call(ctx, http.MethodPost, "/api/login", nil, bytes.NewReader(body), "application/json", &data); err != nil {
+		return err
+	}
+	c.Token = data.Authorization
+	return nil
+}
+
+// List returns the entries at path, or the shared list when path is empty
+func (c *Client) List(ctx context.Context, path string) ([]utils.FileInfo, error) {
+	var data struct {
+		Files []utils.FileInfo `json:"files"`
+	}
+	query := url.Values{"path": {path}}
+	if err := c.call(ctx, http.MethodGet, "/api/files", query, nil, "", &data); err != nil {
+		return nil, err
+	}
+	return data.Files, nil
+}
+
+// Rooms returns the rooms of the server
+func (c *Client) Rooms(ctx context.Context) ([]utils.Room, error) {
+	var data struct {
+		Rooms []utils.Room `json:"rooms"`
+	}
+	if err := c.call(ctx, http.MethodGet, "/api/rooms", nil, nil, "", &data); err != nil {
+		return nil, err
+	}
+	return data.Rooms, nil
+}
+
+// CreateRoom creates a room called name, the client becomes its member
+func (c *Client) CreateRoom(ctx context.Context, name string) error {
+	body, _ := json.Marshal(map[string]string{"name": name})
+	return c.call(ctx, http.MethodPost, "/api/rooms", nil, bytes.NewReader(body), "application/json", nil)
+}
+
+// JoinRoom makes the client a member of the room called name
+func (c *Client) JoinRoom(ctx context.Context, name string) error {
+	return c.call(ctx, http.MethodPost, "/api/rooms/"+url.PathEscape(name)+"/join", nil, nil, "", nil)
+}
+
+// SendText posts a text message
+func (c *Client) SendText(ctx context.Context, text string) error {
+	return c.SendSnippet(ctx, text, "", "")
+}
+
+// SendSnippet posts a text message with a format of plain, markdown or code
+// and the language of code
+func (c *Client) SendSnippet(ctx context.Context, text, format, language string) error {
+	body, _ := json.Marshal(map[string]string{"message": text, "format": format, "language": language})
+	return c.call(ctx, http.MethodPost, "/api/addText", nil, bytes.NewReader(body), "application/json", nil)
+}
+
+// UploadFile uploads the local file at path
+func (c *Client) UploadFile(ctx context.Context, path string, progress ProgressFunc) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return c.Upload(ctx, filepath.Base(path), f, info.Size(), progress)
+}
+
+// Upload streams r to the server as a file called name. size is only used
+// to report progress and may be -1.
+func (c *Client) Upload(ctx context.Context, name string, r io.Reader, size int64, progress ProgressFunc) error {
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+
+	go func() {
+		part, err := form.CreateFormFile("file", name)
+		if err == nil {
+			_, err = io.Copy(part, &progressReader{r: r, total: size, progress: progress})
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	err := c.call(ctx, http.MethodPost, "/api/addFile", nil, pr, form.FormDataContentType(), nil)
+	pr.Close()
+	return err
+}
+
+// Download fetches remotePath into localPath. An existing localPath+".part"
+// from an interrupted download is resumed with a Range request, guarded by
+// the ETag saved next to it so that a changed remote file starts over.
+func (c *Client) Download(ctx context.Context, remotePath, localPath string, progress ProgressFunc) error {
+	partPath := localPath + ".part"
+	etagPath := partPath + ".etag"
+	var offset int64
+	var etag string
+	if info, err := os.Stat(partPath); err == nil {
+		// A part of unknown version can not be resumed safely
+		if data, err := os.ReadFile(etagPath); err == nil && len(data) > 0 {
+			offset, etag = info.Size(), string(data)
+		}
+	}
+
+	resp, err := c.requestDownload(ctx, remotePath, offset, etag)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// The part does not fit the remote file, start over
+		resp.Body.Close()
+		offset = 0
+		if resp, err = c.requestDownload(ctx, remotePath, 0, ""); err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if offset == 0 || !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return fmt.Errorf("download %s: unexpected range %q", remotePath, resp.Header.Get("Content-Range"))
+		}
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		// The server ignored the range or the file changed, start over
+		offset = 0
+		flags |= os.O_TRUNC
+		if err := saveETag(etagPath, resp.Header.Get("ETag")); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("download %s: %s", remotePath, resp.Status)
+	}
+
+	out, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	reader := &progressReader{r: resp.Body, done: offset, total: total, progress: progress}
+	if _, err := io.Copy(out, reader); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	// The digest covers the whole file, which also catches a resumed part
+	// that belonged to an older version of the file
+	if err := verifyDigest(partPath, resp.Header.Get("Repr-Digest")); err != nil {
+		os.Remove(partPath)
+		os.Remove(etagPath)
+		return fmt.Errorf("download %s: %v", remotePath, err)
+	}
+	if err := os.Rename(partPath, localPath); err != nil {
+		return err
+	}
+	os.Remove(etagPath)
+	return nil
+}
+
+// requestDownload requests remotePath from offset on. A resumed request
+// carries etag as If-Range, so the server sends the whole file when it
+// changed since the part was written.
+func (c *Client) requestDownload(ctx context.Context, remotePath string, offset int64, etag string) (*http.Response, error) {
+	query := url.Values{"filename": {remotePath}}
+	if c.Token != "" {
+		query.Set("token", c.Token)
+	}
+	req, err := c.newRequest(ctx, http.MethodGet, "/api/download", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", etag)
+	}
+	return c.HTTPClient.Do(req)
+}
+
+// saveETag records the ETag of a part file. Weak ETags can not be used with
+// If-Range, so without a strong one any old record is removed instead.
+func saveETag(path, etag string) error {
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(path, []byte(etag), 0644)
+}
+
+// verifyDigest checks the file against a "sha-256=:<base64>:" Repr-Digest
+// header value. A missing header is not an error.
+func verifyDigest(path, reprDigest string) error {
+	var want string
+	for _, item := range strings.Split(reprDigest, ",") {
+		algo, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if ok && strings.EqualFold(algo, "sha-256") {
+			want = strings.Trim(value, ":")
+		}
+	}
+	if want == "" {
+		return nil
+	}
+
+	hash, err := utils.HashFile(path)
+	if err != nil {
+		return err
+	}
+	raw, _ := hex.DecodeString(hash)
+	if base64.StdEncoding.EncodeToString(raw) != want {
+		return fmt.Errorf("sha-256 digest mismatch")
+	}
+	return nil
+}
+
+// Subscribe streams server events to handler until ctx is done or the
+// server closes the connection
+func (c *Client) Subscribe(ctx context.Context, handler func(Event)) error {
+	req, err := c.newRequest(ctx, http.MethodGet, "/api/registrySSE", nil, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("subscribe: %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// Accept both bare JSON lines and standard "data:" framing
+		line = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if line == "" || !strings.HasPrefix(line, "{") {
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			continue
+		}
+		handler(event)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return scanner.Err()
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", c.Token)
+	}
+	if c.Room != "" {
+		req.Header.Set("X-Room", c.Room)
+	}
+	return req, nil
+}
+
+// call performs a JSON API request and decodes the data field into out
+func (c *Client) call(ctx context.Context, method, path string, query url.Values, body io.Reader, contentType string, out interface{}) error {
+	req, err := c.newRequest(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope response
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if envelope.Code != 0 && envelope.Code != http.StatusOK {
+		return fmt.Errorf("%s %s: %d %s", method, path, envelope.Code, envelope.Message)
+	}
+	if out != nil && len(envelope.Data) > 0 {
+		return json.Unmarshal(envelope.Data, out)
+	}
+	return nil
+}
+
+// progressReader reports the bytes read through it
+type progressReader struct {
+	r        io.Reader
+	done     int64
+	total    int64
+	progress ProgressFunc
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+	if p.progress != nil && (n > 0 || err == io.EOF) {
+		p.progress(p.done, p.total)
+	}
+	return n, err
+}
@@ -0,0 +1,302 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wwqdrh/file-share/utils"
+)
+
+// fakeServer implements the parts of the API the client uses
+type fakeServer struct {
+	t *testing.T
+
+	mutex sync.Mutex
+	// content is served by /api/download, with its digest as ETag
+	content []byte
+	// ignoreRange makes downloads always answer 200
+	ignoreRange bool
+	// badDigest makes downloads send a wrong Repr-Digest
+	badDigest bool
+	// requests holds the headers of every download request
+	requests []http.Header
+	// uploads maps uploaded file names to their content
+	uploads map[string]string
+}
+
+func newFakeServer(t *testing.T, content string) (*fakeServer, *Client) {
+	f := &fakeServer{t: t, content: []byte(content), uploads: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/login", f.login)
+	mux.HandleFunc("POST /api/addFile", f.addFile)
+	mux.HandleFunc("GET /api/download", f.download)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return f, New(server.URL)
+}
+
+func (f *fakeServer) reply(w http.ResponseWriter, code int, message string, data interface{}) {
+	json.NewEncoder(w).Encode(map[string]interface{}{"code": code, "message": message, "data": data})
+}
+
+func (f *fakeServer) login(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Password string `json:"password"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	if body.Password != "secret" {
+		f.reply(w, http.StatusUnauthorized, "密码错误", nil)
+		return
+	}
+	f.reply(w, http.StatusOK, "登录成功", map[string]string{"Authorization": "token-1"})
+}
+
+func (f *fakeServer) addFile(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "token-1" {
+		f.reply(w, http.StatusUnauthorized, "未登录", nil)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		f.reply(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	defer file.Close()
+	data, _ := io.ReadAll(file)
+	f.mutex.Lock()
+	f.uploads[header.Filename] = string(data)
+	f.mutex.Unlock()
+	f.reply(w, http.StatusOK, "上传成功", nil)
+}
+
+func (f *fakeServer) download(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	f.requests = append(f.requests, r.Header.Clone())
+	content, ignoreRange, badDigest := f.content, f.ignoreRange, f.badDigest
+	f.mutex.Unlock()
+
+	sum := sha256.Sum256(content)
+	etag, _, reprDigest := utils.DigestHeaders(hex.EncodeToString(sum[:]))
+	if badDigest {
+		_, _, reprDigest = utils.DigestHeaders(strings.Repeat("00", 32))
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Repr-Digest", reprDigest)
+	if ignoreRange {
+		r.Header.Del("Range")
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+// etagOf returns the ETag the fake server sends for content
+func etagOf(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	etag, _, _ := utils.DigestHeaders(hex.EncodeToString(sum[:]))
+	return etag
+}
+
+// writePart leaves an interrupted download of localPath with the given
+// content and ETag, no ETag file is written when etag is empty
+func writePart(t *testing.T, localPath, content, etag string) {
+	t.Helper()
+	if err := os.WriteFile(localPath+".part", []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if etag != "" {
+		if err := os.WriteFile(localPath+".part.etag", []byte(etag), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkDownloaded fails unless localPath holds want and no part is left
+func checkDownloaded(t *testing.T, localPath, want string) {
+	t.Helper()
+	got, err := os.ReadFile(localPath)
+	if err != nil || string(got) != want {
+		t.Fatalf("downloaded %q, %v, want %q", got, err, want)
+	}
+	for _, leftover := range []string{localPath + ".part", localPath + ".part.etag"} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Errorf("%s was left behind", leftover)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	_, c := newFakeServer(t, "")
+	if err := c.Login(context.Background(), "wrong"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("login with a wrong password: %v", err)
+	}
+	if c.Token != "" {
+		t.Errorf("token %q set by a failed login", c.Token)
+	}
+	if err := c.Login(context.Background(), "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if c.Token != "token-1" {
+		t.Errorf("token = %q", c.Token)
+	}
+}
+
+func TestUploadFile(t *testing.T) {
+	f, c := newFakeServer(t, "")
+	path := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(path, []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Uploads are sent with the session token
+	if err := c.UploadFile(context.Background(), path, nil); err == nil {
+		t.Error("upload without a token succeeded")
+	}
+	c.Token = "token-1"
+	var done, total int64
+	progress := func(d, t int64) { done, total = d, t }
+	if err := c.UploadFile(context.Background(), path, progress); err != nil {
+		t.Fatal(err)
+	}
+	if f.uploads["a.txt"] != "hello" {
+		t.Errorf("uploads = %v", f.uploads)
+	}
+	if done != 5 || total != 5 {
+		t.Errorf("progress %d/%d, want 5/5", done, total)
+	}
+
+	if err := c.UploadFile(context.Background(), filepath.Dir(path), nil); err == nil {
+		t.Error("uploading a directory succeeded")
+	}
+}
+
+func TestDownload(t *testing.T) {
+	f, c := newFakeServer(t, "0123456789")
+	localPath := filepath.Join(t.TempDir(), "a.txt")
+	if err := c.Download(context.Background(), "a.txt", localPath, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkDownloaded(t, localPath, "0123456789")
+	if h := f.requests[0]; h.Get("Range") != "" || h.Get("If-Range") != "" {
+		t.Errorf("fresh download sent Range %q, If-Range %q", h.Get("Range"), h.Get("If-Range"))
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		part    string
+		etag    string
+		// ignoreRange makes the server answer 200 to ranges
+		ignoreRange bool
+		// wantRange is the Range header of the first request
+		wantRange string
+	}{
+		{"resumed", "0123456789", "01234", etagOf("0123456789"), false, "bytes=5-"},
+		{"range ignored", "0123456789", "01234", etagOf("0123456789"), true, "bytes=5-"},
+		// If-Range makes the server send the new version whole
+		{"remote changed", "abcdefghij", "01234", etagOf("0123456789"), false, "bytes=5-"},
+		// The 416 for a part larger than the file restarts the download
+		{"part too large", "0123", "0123456789", etagOf("0123"), false, "bytes=10-"},
+		// A part without an ETag is never resumed
+		{"unknown version", "0123456789", "abcde", "", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, c := newFakeServer(t, tt.content)
+			f.ignoreRange = tt.ignoreRange
+			localPath := filepath.Join(t.TempDir(), "a.txt")
+			writePart(t, localPath, tt.part, tt.etag)
+
+			if err := c.Download(context.Background(), "a.txt", localPath, nil); err != nil {
+				t.Fatal(err)
+			}
+			checkDownloaded(t, localPath, tt.content)
+			first := f.requests[0]
+			if first.Get("Range") != tt.wantRange {
+				t.Errorf("Range = %q, want %q", first.Get("Range"), tt.wantRange)
+			}
+			if tt.wantRange != "" && first.Get("If-Range") != tt.etag {
+				t.Errorf("If-Range = %q, want %q", first.Get("If-Range"), tt.etag)
+			}
+		})
+	}
+}
+
+func TestDownloadInterruptedKeepsETag(t *testing.T) {
+	f, c := newFakeServer(t, "0123456789")
+	f.badDigest = true
+	localPath := filepath.Join(t.TempDir(), "a.txt")
+
+	// A download failing verification leaves nothing to resume
+	if err := c.Download(context.Background(), "a.txt", localPath, nil); err == nil {
+		t.Fatal("download with a wrong digest succeeded")
+	}
+	for _, path := range []string{localPath, localPath + ".part", localPath + ".part.etag"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s exists after a failed download", path)
+		}
+	}
+
+	// A download cut short keeps its part with the ETag for the next try
+	f.badDigest = false
+	ctx, cancel := context.WithCancel(context.Background())
+	progress := func(done, total int64) {
+		if done > 0 {
+			cancel()
+		}
+	}
+	c.HTTPClient = &http.Client{Transport: slowTransport{}}
+	if err := c.Download(ctx, "a.txt", localPath, progress); err == nil {
+		t.Fatal("cancelled download succeeded")
+	}
+	etag, err := os.ReadFile(localPath + ".part.etag")
+	if err != nil || string(etag) != etagOf("0123456789") {
+		t.Fatalf("part ETag %q, %v", etag, err)
+	}
+
+	c.HTTPClient = &http.Client{}
+	if err := c.Download(context.Background(), "a.txt", localPath, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkDownloaded(t, localPath, "0123456789")
+	if last := f.requests[len(f.requests)-1]; last.Get("Range") == "" {
+		t.Error("interrupted download was not resumed")
+	}
+}
+
+// slowTransport hands out response bodies one byte per read, so that a
+// download can be cancelled halfway through
+type slowTransport struct{}
+
+func (slowTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &slowBody{ctx: r.Context(), ReadCloser: resp.Body}
+	return resp, nil
+}
+
+type slowBody struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	if err := b.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return b.ReadCloser.Read(p[:1])
+}
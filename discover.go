@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/wwqdrh/file-share/discovery"
+)
+
+// runDiscover lists the file-share instances advertised on the LAN
+func runDiscover(args []string) {
+	fset := flag.NewFlagSet("discover", flag.ExitOnError)
+	timeout := fset.Duration("timeout", 3*time.Second, "等待响应的时间")
+	fset.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	instances, err := discovery.Browse(ctx, discovery.ServiceType)
+	if err != nil {
+		fmt.Printf("discover error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(instances) == 0 {
+		fmt.Println("no file-share instance found")
+		return
+	}
+
+	for _, inst := range instances {
+		auth := ""
+		if inst.AuthRequired {
+			auth = " (需要密码)"
+		}
+		fmt.Printf("%s\n  %s%s\n", inst.Name, inst.URL(), auth)
+	}
+}
@@ -0,0 +1,277 @@
+package discovery
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DNS record types used by mDNS service discovery
+const (
+	typeA    uint16 = 1
+	typePTR  uint16 = 12
+	typeTXT  uint16 = 16
+	typeAAAA uint16 = 28
+	typeSRV  uint16 = 33
+	typeANY  uint16 = 255
+
+	classIN uint16 = 1
+	// cacheFlush marks a record as the complete set for its name (RFC 6762 10.2)
+	cacheFlush uint16 = 1 << 15
+	// unicastResponse is the QU bit of a question (RFC 6762 5.4)
+	unicastResponse uint16 = 1 << 15
+)
+
+// question is a single entry of the question section
+type question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// record is a single resource record. Only the fields relevant to Type are set.
+type record struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+
+	Target string   // PTR and SRV
+	Port   uint16   // SRV
+	Text   []string // TXT
+	IP     net.IP   // A and AAAA
+}
+
+// message is a DNS message restricted to what mDNS needs
+type message struct {
+	ID        uint16
+	Response  bool
+	Questions []question
+	Answers   []record
+	Extra     []record
+}
+
+// pack encodes the message without name compression
+func (m *message) pack() ([]byte, error) {
+	buf := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(buf[0:], m.ID)
+	if m.Response {
+		// QR and AA bits
+		binary.BigEndian.PutUint16(buf[2:], 0x8400)
+	}
+	binary.BigEndian.PutUint16(buf[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(buf[6:], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(buf[10:], uint16(len(m.Extra)))
+
+	var err error
+	for _, q := range m.Questions {
+		if buf, err = appendName(buf, q.Name); err != nil {
+			return nil, err
+		}
+		buf = binary.BigEndian.AppendUint16(buf, q.Type)
+		buf = binary.BigEndian.AppendUint16(buf, q.Class)
+	}
+	for _, rr := range append(append([]record{}, m.Answers...), m.Extra...) {
+		if buf, err = appendRecord(buf, rr); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func appendRecord(buf []byte, rr record) ([]byte, error) {
+	var err error
+	if buf, err = appendName(buf, rr.Name); err != nil {
+		return nil, err
+	}
+	buf = binary.BigEndian.AppendUint16(buf, rr.Type)
+	buf = binary.BigEndian.AppendUint16(buf, rr.Class)
+	buf = binary.BigEndian.AppendUint32(buf, rr.TTL)
+
+	var data []byte
+	switch rr.Type {
+	case typePTR:
+		if data, err = appendName(nil, rr.Target); err != nil {
+			return nil, err
+		}
+	case typeSRV:
+		data = make([]byte, 6)
+		binary.BigEndian.PutUint16(data[4:], rr.Port)
+		if data, err = appendName(data, rr.Target); err != nil {
+			return nil, err
+		}
+	case typeTXT:
+		for _, t := range rr.Text {
+			if len(t) > 255 {
+				return nil, fmt.Errorf("txt entry too long: %s", t)
+			}
+			data = append(data, byte(len(t)))
+			data = append(data, t...)
+		}
+		if len(data) == 0 {
+			data = []byte{0}
+		}
+	case typeA:
+		data = rr.IP.To4()
+	case typeAAAA:
+		data = rr.IP.To16()
+	default:
+		return nil, fmt.Errorf("unsupported record type %d", rr.Type)
+	}
+
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(data)))
+	return append(buf, data...), nil
+}
+
+func appendName(buf []byte, name string) ([]byte, error) {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		if len(label) > 63 {
+			return nil, fmt.Errorf("label too long: %s", label)
+		}
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+	return append(buf, 0), nil
+}
+
+// unpack decodes a message, skipping records of unknown types
+func unpack(data []byte) (*message, error) {
+	if len(data) < 12 {
+		return nil, fmt.Errorf("message too short")
+	}
+	m := &message{
+		ID:       binary.BigEndian.Uint16(data[0:]),
+		Response: data[2]&0x80 != 0,
+	}
+	qdCount := int(binary.BigEndian.Uint16(data[4:]))
+	anCount := int(binary.BigEndian.Uint16(data[6:]))
+	nsCount := int(binary.BigEndian.Uint16(data[8:]))
+	arCount := int(binary.BigEndian.Uint16(data[10:]))
+
+	off := 12
+	for i := 0; i < qdCount; i++ {
+		name, n, err := readName(data, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n
+		if off+4 > len(data) {
+			return nil, fmt.Errorf("truncated question")
+		}
+		m.Questions = append(m.Questions, question{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(data[off:]),
+			Class: binary.BigEndian.Uint16(data[off+2:]),
+		})
+		off += 4
+	}
+
+	for i := 0; i < anCount+nsCount+arCount; i++ {
+		rr, n, err := readRecord(data, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n
+		if rr == nil {
+			continue
+		}
+		if i < anCount {
+			m.Answers = append(m.Answers, *rr)
+		} else {
+			m.Extra = append(m.Extra, *rr)
+		}
+	}
+	return m, nil
+}
+
+func readRecord(data []byte, off int) (*record, int, error) {
+	name, off, err := readName(data, off)
+	if err != nil {
+		return nil, 0, err
+	}
+	if off+10 > len(data) {
+		return nil, 0, fmt.Errorf("truncated record")
+	}
+	rr := &record{
+		Name:  name,
+		Type:  binary.BigEndian.Uint16(data[off:]),
+		Class: binary.BigEndian.Uint16(data[off+2:]),
+		TTL:   binary.BigEndian.Uint32(data[off+4:]),
+	}
+	length := int(binary.BigEndian.Uint16(data[off+8:]))
+	off += 10
+	end := off + length
+	if end > len(data) {
+		return nil, 0, fmt.Errorf("truncated record data")
+	}
+	rdata := data[off:end]
+
+	switch rr.Type {
+	case typePTR:
+		if rr.Target, _, err = readName(data, off); err != nil {
+			return nil, 0, err
+		}
+	case typeSRV:
+		if length < 7 {
+			return nil, 0, fmt.Errorf("invalid srv record")
+		}
+		rr.Port = binary.BigEndian.Uint16(rdata[4:])
+		if rr.Target, _, err = readName(data, off+6); err != nil {
+			return nil, 0, err
+		}
+	case typeTXT:
+		for i := 0; i < len(rdata); {
+			n := int(rdata[i])
+			if i+1+n > len(rdata) {
+				return nil, 0, fmt.Errorf("invalid txt record")
+			}
+			if n > 0 {
+				rr.Text = append(rr.Text, string(rdata[i+1:i+1+n]))
+			}
+			i += 1 + n
+		}
+	case typeA, typeAAAA:
+		rr.IP = net.IP(append([]byte{}, rdata...))
+	default:
+		return nil, end, nil
+	}
+	return rr, end, nil
+}
+
+// readName reads a possibly compressed name starting at off and returns it
+// together with the offset following the name in the original position
+func readName(data []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for hops := 0; ; hops++ {
+		if off >= len(data) || hops > 64 {
+			return "", 0, fmt.Errorf("invalid name")
+		}
+		n := int(data[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(data) {
+				return "", 0, fmt.Errorf("invalid name pointer")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(data[off:]) & 0x3FFF)
+		default:
+			if off+1+n > len(data) {
+				return "", 0, fmt.Errorf("invalid label")
+			}
+			labels = append(labels, string(data[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
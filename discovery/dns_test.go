@@ -0,0 +1,173 @@
+package discovery
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPackUnpack(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  message
+	}{
+		{"empty query", message{ID: 7}},
+		{"question", message{Questions: []question{{Name: "_file-share._tcp.local.", Type: typePTR, Class: classIN | unicastResponse}}}},
+		{"ptr", message{Response: true, Answers: []record{{Name: "_http._tcp.local.", Type: typePTR, Class: classIN, TTL: 120, Target: "a b._http._tcp.local."}}}},
+		{"srv", message{Response: true, Answers: []record{{Name: "a._file-share._tcp.local.", Type: typeSRV, Class: classIN | cacheFlush, TTL: 120, Target: "host.local.", Port: 5421}}}},
+		{"txt", message{Response: true, Answers: []record{{Name: "a.local.", Type: typeTXT, Class: classIN, TTL: 120, Text: []string{"path=/", "auth=false"}}}}},
+		{"a", message{Response: true, Answers: []record{{Name: "host.local.", Type: typeA, Class: classIN, TTL: 0, IP: net.IPv4(192, 0, 2, 1).To4()}}}},
+		{"aaaa", message{Response: true, Extra: []record{{Name: "host.local.", Type: typeAAAA, Class: classIN, TTL: 120, IP: net.ParseIP("2001:db8::1")}}}},
+	}
+	for _, tt := range tests {
+		data, err := tt.msg.pack()
+		if err != nil {
+			t.Errorf("%s: pack: %v", tt.name, err)
+			continue
+		}
+		got, err := unpack(data)
+		if err != nil {
+			t.Errorf("%s: unpack: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, tt.msg) {
+			t.Errorf("%s: round trip = %+v, want %+v", tt.name, *got, tt.msg)
+		}
+	}
+}
+
+func TestPackErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rr   record
+	}{
+		{"long label", record{Name: strings.Repeat("a", 64) + ".local.", Type: typeA, IP: net.IPv4(127, 0, 0, 1)}},
+		{"long txt", record{Name: "a.local.", Type: typeTXT, Text: []string{strings.Repeat("a", 256)}}},
+		{"unknown type", record{Name: "a.local.", Type: 99}},
+	}
+	for _, tt := range tests {
+		msg := message{Answers: []record{tt.rr}}
+		if _, err := msg.pack(); err == nil {
+			t.Errorf("%s: pack succeeded", tt.name)
+		}
+	}
+}
+
+func TestEmptyTXT(t *testing.T) {
+	// An empty TXT record still holds one empty string (RFC 6763 6.1)
+	data, err := (&message{Answers: []record{{Name: "a.local.", Type: typeTXT}}}).pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(data), "\x00\x01\x00") {
+		t.Errorf("packed %q", data)
+	}
+}
+
+// header returns a message header with the given section counts
+func header(questions, answers int) []byte {
+	return []byte{0, 0, 0x84, 0, 0, byte(questions), 0, byte(answers), 0, 0, 0, 0}
+}
+
+func TestUnpackCompressed(t *testing.T) {
+	data := header(0, 2)
+	// host.local. at offset 12, then a PTR whose target points back at it
+	data = append(data, "\x04host\x05local\x00"...)
+	data = append(data, 0, byte(typeA), 0, 1, 0, 0, 0, 120, 0, 4, 10, 0, 0, 1)
+	data = append(data, "\x03ptr\xc0\x11"...)
+	data = append(data, 0, byte(typePTR), 0, 1, 0, 0, 0, 120, 0, 7)
+	data = append(data, "\x02my\xc0\x0c"...)
+	// The PTR record's rdata is 7 bytes long but only 5 are the target
+	data = append(data, 0, 0)
+
+	msg, err := unpack(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answers) != 2 {
+		t.Fatalf("answers %+v", msg.Answers)
+	}
+	if msg.Answers[0].Name != "host.local." || !msg.Answers[0].IP.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("a record %+v", msg.Answers[0])
+	}
+	if msg.Answers[1].Name != "ptr.local." || msg.Answers[1].Target != "my.host.local." {
+		t.Errorf("ptr record %+v", msg.Answers[1])
+	}
+}
+
+func TestUnpackSkipsUnknownTypes(t *testing.T) {
+	data := header(0, 2)
+	data = append(data, "\x01x\x00"...)
+	data = append(data, 0, 99, 0, 1, 0, 0, 0, 1, 0, 3, 'a', 'b', 'c')
+	data = append(data, "\x01y\x00"...)
+	data = append(data, 0, byte(typeA), 0, 1, 0, 0, 0, 1, 0, 4, 1, 2, 3, 4)
+
+	msg, err := unpack(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answers) != 1 || msg.Answers[0].Name != "y." {
+		t.Errorf("answers %+v", msg.Answers)
+	}
+}
+
+func TestUnpackMalformed(t *testing.T) {
+	record := func(name string, rrType byte, rdata ...byte) []byte {
+		b := append([]byte(name), 0, rrType, 0, 1, 0, 0, 0, 1, 0, byte(len(rdata)))
+		return append(b, rdata...)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"short header", []byte{0, 0, 0}},
+		{"missing question", header(1, 0)},
+		{"truncated question", append(header(1, 0), "\x01a\x00\x00"...)},
+		{"truncated label", append(header(1, 0), "\x05ab"...)},
+		{"pointer loop", append(header(1, 0), 0xc0, 12, 0, 1, 0, 1)},
+		{"pointer out of range", append(header(1, 0), 0xc0, 0xff, 0, 1, 0, 1)},
+		{"truncated pointer", append(header(1, 0), 0xc0)},
+		{"missing record", header(0, 1)},
+		{"truncated record", append(header(0, 1), "\x01a\x00\x00\x01"...)},
+		{"truncated rdata", append(header(0, 1), append([]byte("\x01a\x00"), 0, 1, 0, 1, 0, 0, 0, 1, 0, 9, 1)...)},
+		{"short srv", append(header(0, 1), record("\x01a\x00", byte(typeSRV), 0, 0, 0, 0, 0, 1)...)},
+		{"bad txt length", append(header(0, 1), record("\x01a\x00", byte(typeTXT), 5, 'a')...)},
+		{"bad ptr target", append(header(0, 1), record("\x01a\x00", byte(typePTR), 3, 'a')...)},
+	}
+	for _, tt := range tests {
+		if msg, err := unpack(tt.data); err == nil {
+			t.Errorf("%s: unpack = %+v, want an error", tt.name, msg)
+		}
+	}
+}
+
+func TestCollectInstances(t *testing.T) {
+	service := ServiceType + "." + domain
+	records := []record{
+		{Name: service, Type: typePTR, TTL: 120, Target: "one." + service},
+		{Name: "one." + service, Type: typeSRV, Target: "host.local.", Port: 80},
+		{Name: "one." + service, Type: typeTXT, Text: []string{"path=/x/", "auth=true", "tls=true"}},
+		{Name: "HOST.local.", Type: typeA, IP: net.IPv4(192, 0, 2, 1)},
+		{Name: "host.local.", Type: typeA, IP: net.IPv4(192, 0, 2, 1)},
+		// A goodbye withdraws the instance
+		{Name: service, Type: typePTR, TTL: 0, Target: "gone." + service},
+		{Name: "gone." + service, Type: typeSRV, Target: "host.local.", Port: 81},
+		// Without an SRV record the port is unknown
+		{Name: service, Type: typePTR, TTL: 120, Target: "nosrv." + service},
+		// Records of other services are ignored
+		{Name: "_other._tcp.local.", Type: typePTR, TTL: 120, Target: "x._other._tcp.local."},
+	}
+
+	instances := collectInstances(service, records)
+	if len(instances) != 1 {
+		t.Fatalf("instances %+v", instances)
+	}
+	inst := instances[0]
+	if inst.Name != "one" || inst.Port != 80 || inst.Path != "/x/" || !inst.AuthRequired || !inst.TLS || len(inst.IPs) != 1 {
+		t.Errorf("instance %+v", inst)
+	}
+	if got := inst.URL(); got != "https://192.0.2.1:80/x/" {
+		t.Errorf("URL = %q", got)
+	}
+}
@@ -0,0 +1,360 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ServiceType is the DNS-SD service type file-share instances advertise
+	ServiceType = "_file-share._tcp"
+	// HTTPServiceType lets generic browsers find the web UI as well
+	HTTPServiceType = "_http._tcp"
+
+	domain       = "local."
+	servicesName = "_services._dns-sd._udp.local."
+	defaultTTL   = 120
+)
+
+// mdnsGroup is the IPv4 mDNS multicast group and port
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// Service describes the running instance to advertise
+type Service struct {
+	Instance     string
+	Port         int
+	Path         string
+	AuthRequired bool
+	TLS          bool
+	IPs          []net.IP
+}
+
+// Instance is a file-share instance found on the network
+type Instance struct {
+	Name         string            `json:"name"`
+	Host         string            `json:"host"`
+	Port         int               `json:"port"`
+	IPs          []net.IP          `json:"ips"`
+	Path         string            `json:"path"`
+	AuthRequired bool              `json:"authRequired"`
+	TLS          bool              `json:"tls"`
+	Text         map[string]string `json:"text"`
+}
+
+// URL returns the address of the instance's web UI
+func (i Instance) URL() string {
+	scheme := "http"
+	if i.TLS {
+		scheme = "https"
+	}
+	host := strings.TrimSuffix(i.Host, ".")
+	for _, ip := range i.IPs {
+		if ip.To4() != nil {
+			host = ip.String()
+			break
+		}
+	}
+	if host == "" && len(i.IPs) > 0 {
+		host = i.IPs[0].String()
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(host, strconv.Itoa(i.Port)), i.Path)
+}
+
+// Responder answers mDNS queries for a Service
+type Responder struct {
+	service  Service
+	hostName string
+	names    []string
+
+	conn *net.UDPConn
+	wg   sync.WaitGroup
+}
+
+// NewResponder creates a responder for service. Call Start to begin
+// answering queries.
+func NewResponder(service Service) *Responder {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "file-share"
+	}
+	hostname = strings.Split(hostname, ".")[0]
+	if service.Instance == "" {
+		service.Instance = "file-share on " + hostname
+	}
+	// Dots would split the instance label
+	service.Instance = strings.ReplaceAll(service.Instance, ".", "-")
+	if service.Path == "" {
+		service.Path = "/"
+	}
+
+	return &Responder{
+		service:  service,
+		hostName: hostname + "." + domain,
+		names:    []string{ServiceType + "." + domain, HTTPServiceType + "." + domain},
+	}
+}
+
+// Start joins the multicast group, announces the service and answers
+// queries until Close is called
+func (r *Responder) Start() error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return fmt.Errorf("failed to join mdns group: %v", err)
+	}
+	r.conn = conn
+
+	r.wg.Add(1)
+	go r.serve()
+
+	return r.announce(defaultTTL)
+}
+
+// Close sends a goodbye packet and stops answering queries
+func (r *Responder) Close() error {
+	if r.conn == nil {
+		return nil
+	}
+	r.announce(0)
+	err := r.conn.Close()
+	r.wg.Wait()
+	return err
+}
+
+func (r *Responder) serve() {
+	defer r.wg.Done()
+
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		msg, err := unpack(buf[:n])
+		if err != nil || msg.Response {
+			continue
+		}
+		r.handleQuery(msg, src)
+	}
+}
+
+func (r *Responder) handleQuery(query *message, src *net.UDPAddr) {
+	resp := &message{Response: true}
+	unicast := src.Port != mdnsGroup.Port
+	for _, q := range query.Questions {
+		answers, extra := r.answer(q)
+		resp.Answers = append(resp.Answers, answers...)
+		resp.Extra = append(resp.Extra, extra...)
+		if q.Class&unicastResponse != 0 {
+			unicast = true
+		}
+	}
+	if len(resp.Answers) == 0 {
+		return
+	}
+
+	dst := mdnsGroup
+	if unicast {
+		dst = src
+		if src.Port != mdnsGroup.Port {
+			// Legacy unicast queries expect the ID and questions echoed back
+			resp.ID = query.ID
+			resp.Questions = query.Questions
+		}
+	}
+	r.send(resp, dst)
+}
+
+// answer returns the answer and additional records for a question
+func (r *Responder) answer(q question) ([]record, []record) {
+	name := strings.ToLower(q.Name)
+	instanceName := func(service string) string {
+		return r.service.Instance + "." + service
+	}
+
+	if name == servicesName && (q.Type == typePTR || q.Type == typeANY) {
+		var answers []record
+		for _, service := range r.names {
+			answers = append(answers, record{Name: servicesName, Type: typePTR, Class: classIN, TTL: defaultTTL, Target: service})
+		}
+		return answers, nil
+	}
+
+	for _, service := range r.names {
+		if name == strings.ToLower(service) && (q.Type == typePTR || q.Type == typeANY) {
+			ptr := record{Name: service, Type: typePTR, Class: classIN, TTL: defaultTTL, Target: instanceName(service)}
+			return []record{ptr}, append(r.instanceRecords(service, defaultTTL), r.addressRecords(defaultTTL)...)
+		}
+		if name == strings.ToLower(instanceName(service)) && (q.Type == typeSRV || q.Type == typeTXT || q.Type == typeANY) {
+			return r.instanceRecords(service, defaultTTL), r.addressRecords(defaultTTL)
+		}
+	}
+
+	if name == strings.ToLower(r.hostName) && (q.Type == typeA || q.Type == typeAAAA || q.Type == typeANY) {
+		return r.addressRecords(defaultTTL), nil
+	}
+	return nil, nil
+}
+
+func (r *Responder) instanceRecords(service string, ttl uint32) []record {
+	name := r.service.Instance + "." + service
+	return []record{
+		{Name: name, Type: typeSRV, Class: classIN | cacheFlush, TTL: ttl, Target: r.hostName, Port: uint16(r.service.Port)},
+		{Name: name, Type: typeTXT, Class: classIN | cacheFlush, TTL: ttl, Text: r.txt()},
+	}
+}
+
+func (r *Responder) addressRecords(ttl uint32) []record {
+	var records []record
+	for _, ip := range r.service.IPs {
+		if ip.To4() != nil {
+			records = append(records, record{Name: r.hostName, Type: typeA, Class: classIN | cacheFlush, TTL: ttl, IP: ip})
+		} else {
+			records = append(records, record{Name: r.hostName, Type: typeAAAA, Class: classIN | cacheFlush, TTL: ttl, IP: ip})
+		}
+	}
+	return records
+}
+
+func (r *Responder) txt() []string {
+	return []string{
+		"txtvers=1",
+		"path=" + r.service.Path,
+		"port=" + strconv.Itoa(r.service.Port),
+		"auth=" + strconv.FormatBool(r.service.AuthRequired),
+		"tls=" + strconv.FormatBool(r.service.TLS),
+	}
+}
+
+// announce multicasts every record of the service; a ttl of 0 withdraws them
+func (r *Responder) announce(ttl uint32) error {
+	msg := &message{Response: true}
+	for _, service := range r.names {
+		msg.Answers = append(msg.Answers, record{Name: service, Type: typePTR, Class: classIN, TTL: ttl, Target: r.service.Instance + "." + service})
+		msg.Answers = append(msg.Answers, r.instanceRecords(service, ttl)...)
+	}
+	msg.Answers = append(msg.Answers, r.addressRecords(ttl)...)
+	return r.send(msg, mdnsGroup)
+}
+
+func (r *Responder) send(msg *message, dst *net.UDPAddr) error {
+	data, err := msg.pack()
+	if err != nil {
+		return err
+	}
+	_, err = r.conn.WriteToUDP(data, dst)
+	return err
+}
+
+// Browse queries the network for instances of serviceType until ctx is done
+func Browse(ctx context.Context, serviceType string) ([]Instance, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open socket: %v", err)
+	}
+	defer conn.Close()
+
+	serviceName := serviceType + "." + domain
+	query := &message{
+		ID:        1,
+		Questions: []question{{Name: serviceName, Type: typePTR, Class: classIN | unicastResponse}},
+	}
+	data, err := query.pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(data, mdnsGroup); err != nil {
+		return nil, fmt.Errorf("failed to send query: %v", err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.SetReadDeadline(time.Now())
+	}()
+
+	var records []record
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		msg, err := unpack(buf[:n])
+		if err != nil || !msg.Response {
+			continue
+		}
+		records = append(records, msg.Answers...)
+		records = append(records, msg.Extra...)
+	}
+
+	return collectInstances(serviceName, records), nil
+}
+
+// collectInstances assembles instances from the records received while browsing
+func collectInstances(serviceName string, records []record) []Instance {
+	instances := make(map[string]*Instance)
+	hosts := make(map[string][]net.IP)
+	for _, rr := range records {
+		name := strings.ToLower(rr.Name)
+		switch rr.Type {
+		case typePTR:
+			if name == strings.ToLower(serviceName) && rr.TTL > 0 {
+				key := strings.ToLower(rr.Target)
+				if _, ok := instances[key]; !ok {
+					instances[key] = &Instance{Name: strings.TrimSuffix(rr.Target, "."+serviceName), Text: map[string]string{}}
+				}
+			}
+		case typeA, typeAAAA:
+			hosts[name] = appendIP(hosts[name], rr.IP)
+		}
+	}
+
+	for _, rr := range records {
+		inst, ok := instances[strings.ToLower(rr.Name)]
+		if !ok {
+			continue
+		}
+		switch rr.Type {
+		case typeSRV:
+			inst.Host = rr.Target
+			inst.Port = int(rr.Port)
+		case typeTXT:
+			for _, t := range rr.Text {
+				key, value, _ := strings.Cut(t, "=")
+				inst.Text[key] = value
+			}
+		}
+	}
+
+	result := make([]Instance, 0, len(instances))
+	for _, inst := range instances {
+		if inst.Port == 0 {
+			continue
+		}
+		inst.IPs = hosts[strings.ToLower(inst.Host)]
+		inst.Path = inst.Text["path"]
+		inst.AuthRequired = inst.Text["auth"] == "true"
+		inst.TLS = inst.Text["tls"] == "true"
+		result = append(result, *inst)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func appendIP(ips []net.IP, ip net.IP) []net.IP {
+	for _, existing := range ips {
+		if existing.Equal(ip) {
+			return ips
+		}
+	}
+	return append(ips, ip)
+}
@@ -0,0 +1,116 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// useTestGroup moves mDNS to a free port of the multicast group for the
+// duration of the test, so it neither disturbs nor hears real responders
+func useTestGroup(t *testing.T) {
+	t.Helper()
+	probe, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	group := mdnsGroup
+	mdnsGroup = &net.UDPAddr{IP: group.IP, Port: port}
+	t.Cleanup(func() { mdnsGroup = group })
+}
+
+// startResponder starts a responder for service or skips the test when the
+// host cannot join the multicast group
+func startResponder(t *testing.T, service Service) *Responder {
+	t.Helper()
+	r := NewResponder(service)
+	if err := r.Start(); err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestBrowseFindsResponder(t *testing.T) {
+	useTestGroup(t)
+	startResponder(t, Service{
+		Instance:     "test.instance",
+		Port:         5421,
+		Path:         "/share/",
+		AuthRequired: true,
+		IPs:          []net.IP{net.IPv4(127, 0, 0, 1), net.ParseIP("::1")},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	instances, err := Browse(ctx, ServiceType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) == 0 {
+		t.Skip("no multicast route to the responder")
+	}
+
+	inst := instances[0]
+	if len(instances) != 1 || inst.Name != "test-instance" || inst.Port != 5421 || inst.Path != "/share/" || !inst.AuthRequired || inst.TLS {
+		t.Fatalf("Browse = %+v", instances)
+	}
+	if len(inst.IPs) != 2 {
+		t.Errorf("IPs = %v", inst.IPs)
+	}
+	if got := inst.URL(); got != "http://127.0.0.1:5421/share/" {
+		t.Errorf("URL = %q", got)
+	}
+}
+
+func TestResponderUnicastQuery(t *testing.T) {
+	useTestGroup(t)
+	r := startResponder(t, Service{Instance: "unicast", Port: 8080, IPs: []net.IP{net.IPv4(192, 0, 2, 7)}})
+
+	// A query sent straight to the responder's socket from another port is
+	// a legacy unicast query, answered to the sender with the ID echoed
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	query := &message{ID: 42, Questions: []question{{Name: "unicast." + ServiceType + "." + domain, Type: typeSRV, Class: classIN}}}
+	data, err := query.pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: r.conn.LocalAddr().(*net.UDPAddr).Port}
+	if _, err := conn.WriteToUDP(data, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 9000)
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no answer: %v", err)
+	}
+	resp, err := unpack(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Response || resp.ID != 42 || len(resp.Questions) != 1 {
+		t.Fatalf("response %+v", resp)
+	}
+	var srv *record
+	for i := range resp.Answers {
+		if resp.Answers[i].Type == typeSRV {
+			srv = &resp.Answers[i]
+		}
+	}
+	if srv == nil || srv.Port != 8080 {
+		t.Fatalf("answers %+v", resp.Answers)
+	}
+	if len(resp.Extra) != 1 || !resp.Extra[0].IP.Equal(net.IPv4(192, 0, 2, 7)) {
+		t.Errorf("extra %+v", resp.Extra)
+	}
+}
@@ -2,10 +2,12 @@ module github.com/wwqdrh/file-share
 
 go 1.23.7
 
-require github.com/mdp/qrterminal/v3 v3.2.1
+require (
+	github.com/mdp/qrterminal/v3 v3.2.1
+	golang.org/x/sys v0.29.0
+)
 
 require (
-	golang.org/x/sys v0.29.0 // indirect
 	golang.org/x/term v0.13.0 // indirect
 	rsc.io/qr v0.2.0 // indirect
 )
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"embed"
 	"flag"
 	"fmt"
 	"io/fs"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/mdp/qrterminal/v3"
 
@@ -15,7 +23,21 @@ import (
 )
 
 var (
-	port *int = flag.Int("port", 5421, "端口号")
+	port         *int    = flag.Int("port", 5421, "端口号")
+	tlsEnable    *bool   = flag.Bool("tls", false, "启用 HTTPS，未指定证书时自动生成自签名证书")
+	certFile     *string = flag.String("cert", "", "TLS 证书文件路径")
+	keyFile      *string = flag.String("key", "", "TLS 私钥文件路径")
+	redirectPort *int    = flag.Int("http-redirect", 0, "启用 HTTPS 时将该端口的 HTTP 请求重定向到 HTTPS，0 表示不启用")
+	advertise    *string = flag.String("advertise", "", "二维码中使用的地址（IP 或主机名），默认自动选择")
+	ifaceName    *string = flag.String("interface", "", "从指定网卡选择二维码中使用的地址")
+	qrAll        *bool   = flag.Bool("qr-all", false, "为每个可访问地址都输出二维码")
+	bind         *string = flag.String("bind", "all", "监听地址列表，逗号分隔：all、dual、loopback、IP 地址或网卡名")
+	mdnsEnable   *bool   = flag.Bool("mdns", true, "通过 mDNS/DNS-SD 在局域网中广播服务")
+	watchEnable  *bool   = flag.Bool("watch", true, "监听分享文件的变化并实时通知")
+	trustedProxy *string = flag.String("trusted-proxy", "", "反向代理地址列表，逗号分隔，可为 IP 或 CIDR；仅信任这些代理发送的 X-Real-IP 头")
+	dataDir      *string = flag.String("data-dir", "", "数据目录，存放分享列表、设置、上传文件与临时文件，默认遵循 XDG_DATA_HOME/XDG_CONFIG_HOME")
+
+	shutdownTimeout *time.Duration = flag.Duration("shutdown-timeout", 30*time.Second, "退出时等待进行中的下载完成的最长时间")
 )
 
 //go:embed dist/*
@@ -24,37 +46,181 @@ var embeddedFiles embed.FS
 func main() {
 	flag.Parse()
 
-	mux := http.NewServeMux()
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "discover":
+			runDiscover(flag.Args()[1:])
+		case "push", "pull", "ls", "send-text":
+			runRemote(flag.Arg(0), flag.Args()[1:])
+		default:
+			fmt.Printf("unknown command: %s\n", flag.Arg(0))
+			os.Exit(2)
+		}
+		return
+	}
 
 	// Create a sub filesystem from the embedded files, stripping the "dist" prefix
+	// The files will be served from root "/" without the "dist" prefix in URL
 	fsys, err := fs.Sub(embeddedFiles, "dist")
 	if err != nil {
 		panic(fmt.Sprintf("failed to create sub filesystem: %v", err))
 	}
 
-	// Static file server with the embedded files
-	// The files will be served from root "/" without the "dist" prefix in URL
-	mux.Handle("/", http.FileServer(http.FS(fsys)))
+	paths, err := resolvePaths()
+	if err != nil {
+		panic(err.Error())
+	}
+
+	var tlsConfig *tls.Config
+	fingerprint := ""
+	if *tlsEnable {
+		cert, err := loadCertificate(paths)
+		if err != nil {
+			panic(fmt.Sprintf("failed to load tls certificate: %v", err))
+		}
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		fingerprint = utils.CertificateFingerprint(cert)
+		if *redirectPort > 0 {
+			go serveRedirect(*redirectPort, *port)
+		}
+	}
+
+	server, err := api.New(api.Options{
+		Static:    fsys,
+		Paths:     paths,
+		Port:      *port,
+		Bind:      strings.Split(*bind, ","),
+		TLSConfig: tlsConfig,
+		MDNS:      *mdnsEnable,
+		Watch:     *watchEnable,
+
+		TrustedProxies: strings.Split(*trustedProxy, ","),
+	})
+	if err != nil {
+		panic(err.Error())
+	}
+	if err := server.Listen(); err != nil {
+		panic(err.Error())
+	}
+
+	if err := printAddresses(server); err != nil {
+		panic(err.Error())
+	}
+	if fingerprint != "" {
+		fmt.Printf("certificate SHA-256 fingerprint: %s\n", fingerprint)
+	}
+	go handleSignals(server)
+
+	if err := server.Wait(); err != nil {
+		fmt.Printf("Server error: %v\n", err)
+	}
+}
+
+// handleSignals shuts the server down gracefully on SIGINT/SIGTERM. A second
+// signal, or an expired --shutdown-timeout, closes remaining connections.
+func handleSignals(server *api.Server) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	fmt.Printf("received %s, shutting down\n", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Printf("graceful shutdown failed: %v\n", err)
+		server.Stop()
+	}
+}
 
-	// API routes
-	mux.HandleFunc("/api/files", api.HandleFiles)
-	mux.HandleFunc("/api/download", api.HandleDownload)
-	mux.HandleFunc("/api/login", api.HandleLogin)
-	mux.HandleFunc("/api/addFile", api.HandleAddFile)
-	mux.HandleFunc("/api/addText", api.HandleAddText)
-	mux.HandleFunc("/api/registrySSE", api.RegistrySSE)
+// printAddresses lists every URL the server is reachable on and prints a QR
+// code for the advertised one (or for all of them with --qr-all)
+func printAddresses(server *api.Server) error {
+	candidates := server.Addresses()
+	scheme := server.Scheme()
 
-	// Wrap all API routes with auth filter
-	handler := api.AuthFilter(mux)
+	advertised := *advertise
+	if advertised == "" {
+		selected, err := utils.SelectAddressCandidate(candidates, *ifaceName)
+		if err != nil {
+			return err
+		}
+		advertised = selected.IP
+	}
 
-	server := &http.Server{
-		Addr:    fmt.Sprintf("0.0.0.0:%d", *port), // 监听所有网络接口
-		Handler: handler,
+	fmt.Println("servers is reachable on:")
+	for _, c := range candidates {
+		url := utils.FormatURL(scheme, c.IP, *port)
+		marker := " "
+		if c.IP == advertised {
+			marker = "*"
+		}
+		fmt.Printf(" %s %-40s (%s)\n", marker, url, c.Interface)
+		if *qrAll && c.IP != advertised {
+			qrterminal.Generate(url, qrterminal.L, os.Stdout)
+		}
 	}
-	url := fmt.Sprintf("http://%s:%d", utils.GetWlan0IPAddress("ipv4"), *port)
+
+	url := utils.FormatURL(scheme, advertised, *port)
 	fmt.Printf("servers is start on %s\n", url)
 	qrterminal.Generate(url, qrterminal.L, os.Stdout)
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		fmt.Printf("Server error: %v\n", err)
+	return nil
+}
+
+// resolvePaths returns the directories from --data-dir or the XDG defaults
+func resolvePaths() (utils.Paths, error) {
+	if *dataDir != "" {
+		abs, err := filepath.Abs(*dataDir)
+		if err != nil {
+			return utils.Paths{}, err
+		}
+		return utils.NewPaths(abs), nil
+	}
+	return utils.DefaultPaths()
+}
+
+// loadCertificate loads the user provided certificate, or generates and
+// persists a self-signed one covering all local addresses
+func loadCertificate(paths utils.Paths) (tls.Certificate, error) {
+	if *certFile != "" || *keyFile != "" {
+		if *certFile == "" || *keyFile == "" {
+			return tls.Certificate{}, fmt.Errorf("both --cert and --key are required")
+		}
+		return utils.LoadOrCreateCertificate(*certFile, *keyFile, nil, false)
+	}
+
+	certDir := paths.CertDir()
+	return utils.LoadOrCreateCertificate(
+		filepath.Join(certDir, "cert.pem"),
+		filepath.Join(certDir, "key.pem"),
+		utils.GetCertHosts(),
+		true,
+	)
+}
+
+// serveRedirect redirects plain HTTP requests on httpPort to HTTPS on tlsPort
+func serveRedirect(httpPort, tlsPort int) {
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		target := fmt.Sprintf("https://%s%s", net.JoinHostPort(host, fmt.Sprint(tlsPort)), r.URL.RequestURI())
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+	addr := fmt.Sprintf("0.0.0.0:%d", httpPort)
+	if err := http.ListenAndServe(addr, redirect); err != nil {
+		fmt.Printf("Redirect server error: %v\n", err)
 	}
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/wwqdrh/file-share/client"
+	"github.com/wwqdrh/file-share/discovery"
+	"github.com/wwqdrh/file-share/utils"
+)
+
+// remoteFlags are the connection flags shared by the remote commands
+type remoteFlags struct {
+	server      *string
+	password    *string
+	insecure    *bool
+	fingerprint *string
+	room        *string
+}
+
+func newRemoteFlags(fset *flag.FlagSet) remoteFlags {
+	return remoteFlags{
+		server:      fset.String("server", os.Getenv("FILE_SHARE_SERVER"), "服务地址，默认读取 FILE_SHARE_SERVER 或通过 mDNS 自动发现"),
+		password:    fset.String("password", os.Getenv("FILE_SHARE_PASSWORD"), "登录密码，默认读取 FILE_SHARE_PASSWORD"),
+		insecure:    fset.Bool("insecure", false, "HTTPS 时不校验服务端证书"),
+		fingerprint: fset.String("fingerprint", "", "HTTPS 时只接受该 SHA-256 指纹的证书"),
+		room:        fset.String("room", os.Getenv("FILE_SHARE_ROOM"), "使用的房间，默认读取 FILE_SHARE_ROOM，为空时使用默认房间"),
+	}
+}
+
+// connect creates a logged in client for the configured or discovered server
+func (f remoteFlags) connect(ctx context.Context) (*client.Client, error) {
+	server := *f.server
+	if server == "" {
+		discoverCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		instances, err := discovery.Browse(discoverCtx, discovery.ServiceType)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		if len(instances) != 1 {
+			return nil, fmt.Errorf("found %d file-share instances, choose one with --server", len(instances))
+		}
+		server = instances[0].URL()
+	}
+	if !strings.Contains(server, "://") {
+		server = "http://" + server
+	}
+
+	c := client.New(server)
+	c.HTTPClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: client.TLSConfig(*f.fingerprint, *f.insecure),
+		},
+	}
+	if err := c.Login(ctx, *f.password); err != nil {
+		return nil, err
+	}
+	if *f.room != "" && *f.room != utils.DefaultRoom {
+		if err := c.JoinRoom(ctx, *f.room); err != nil {
+			return nil, err
+		}
+		c.Room = *f.room
+	}
+	return c, nil
+}
+
+// runRemote runs one of the push/pull/ls/send-text commands
+func runRemote(command string, args []string) {
+	fset := flag.NewFlagSet(command, flag.ExitOnError)
+	remote := newRemoteFlags(fset)
+	output := fset.String("o", ".", "pull 时的保存目录")
+	format := fset.String("format", "", "send-text 时的消息格式：plain、markdown 或 code")
+	language := fset.String("lang", "", "send-text 格式为 code 时的编程语言")
+	fset.Parse(args)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	c, err := remote.connect(ctx)
+	if err == nil {
+		switch command {
+		case "push":
+			err = push(ctx, c, fset.Args())
+		case "pull":
+			err = pull(ctx, c, fset.Args(), *output)
+		case "ls":
+			err = list(ctx, c, fset.Arg(0))
+		case "send-text":
+			err = sendText(ctx, c, fset.Args(), *format, *language)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s error: %v\n", command, err)
+		os.Exit(1)
+	}
+}
+
+func push(ctx context.Context, c *client.Client, files []string) error {
+	if len(files) == 0 {
+		return fmt.Errorf("no file given")
+	}
+	for _, file := range files {
+		if err := c.UploadFile(ctx, file, printProgress(filepath.Base(file))); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		fmt.Fprintln(os.Stderr)
+	}
+	return nil
+}
+
+func pull(ctx context.Context, c *client.Client, remotePaths []string, outDir string) error {
+	if len(remotePaths) == 0 {
+		return fmt.Errorf("no remote path given")
+	}
+	for _, remotePath := range remotePaths {
+		name := path.Base(strings.Trim(remotePath, "/"))
+		localPath := filepath.Join(outDir, name)
+		if err := c.Download(ctx, remotePath, localPath, printProgress(name)); err != nil {
+			return fmt.Errorf("%s: %v", remotePath, err)
+		}
+		fmt.Fprintln(os.Stderr)
+	}
+	return nil
+}
+
+func list(ctx context.Context, c *client.Client, remotePath string) error {
+	files, err := c.List(ctx, remotePath)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		switch f.Type {
+		case "directory":
+			fmt.Printf("%s/\t%d items\n", f.Name, f.ItemCount)
+		case "text":
+			fmt.Printf("%s\t[text] %s\n", f.Name, f.Username)
+		default:
+			fmt.Printf("%s\t%s\n", f.Name, f.SizeText)
+		}
+	}
+	return nil
+}
+
+func sendText(ctx context.Context, c *client.Client, args []string, format, language string) error {
+	text := strings.Join(args, " ")
+	if text == "" || text == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		text = string(data)
+	}
+	if strings.TrimSpace(text) == "" {
+		return fmt.Errorf("empty message")
+	}
+	return c.SendSnippet(ctx, text, format, language)
+}
+
+// printProgress returns a ProgressFunc rewriting one status line on stderr
+func printProgress(name string) client.ProgressFunc {
+	var last time.Time
+	return func(done, total int64) {
+		if time.Since(last) < 200*time.Millisecond && done != total {
+			return
+		}
+		last = time.Now()
+		if total > 0 {
+			fmt.Fprintf(os.Stderr, "\r%s %s / %s (%d%%)", name, utils.ConvertBytes(done), utils.ConvertBytes(total), done*100/total)
+		} else {
+			fmt.Fprintf(os.Stderr, "\r%s %s", name, utils.ConvertBytes(done))
+		}
+	}
+}
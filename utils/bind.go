@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// BindAddress is a single address the server listens on
+type BindAddress struct {
+	Network string `json:"network"`
+	Host    string `json:"host"`
+	Port    int    `json:"port"`
+}
+
+// Addr returns the host:port form of the address, bracketing IPv6 hosts
+func (b BindAddress) Addr() string {
+	return net.JoinHostPort(b.Host, fmt.Sprint(b.Port))
+}
+
+// Covers reports whether connections to ip are accepted by the address
+func (b BindAddress) Covers(ip net.IP) bool {
+	host := net.ParseIP(b.Host)
+	if b.Host == "" || (host != nil && host.IsUnspecified()) {
+		switch b.Network {
+		case "tcp4":
+			return ip.To4() != nil
+		case "tcp6":
+			return ip.To4() == nil
+		}
+		return true
+	}
+	return host != nil && host.Equal(ip)
+}
+
+// ResolveBindAddresses turns the user supplied bind list into listen
+// addresses. Every entry may be one of:
+//
+//	all       every interface, dual stack on a single socket (default)
+//	dual      every interface, separate IPv4 and IPv6 sockets
+//	loopback  127.0.0.1 and ::1 only
+//	an IP     such as 0.0.0.0, ::, 192.168.1.10 or fe80::1
+//	a name    every address of that network interface, e.g. eth0
+func ResolveBindAddresses(binds []string, port int) ([]BindAddress, error) {
+	var result []BindAddress
+	seen := make(map[string]bool)
+	add := func(network, host string) {
+		b := BindAddress{Network: network, Host: host, Port: port}
+		if !seen[b.Addr()] {
+			seen[b.Addr()] = true
+			result = append(result, b)
+		}
+	}
+
+	for _, bind := range binds {
+		bind = strings.TrimSpace(bind)
+		switch strings.ToLower(bind) {
+		case "", "all":
+			add("tcp", "")
+			continue
+		case "dual":
+			add("tcp4", "0.0.0.0")
+			add("tcp6", "::")
+			continue
+		case "loopback", "localhost":
+			add("tcp4", GetLoopback("ipv4"))
+			add("tcp6", GetLoopback("ipv6"))
+			continue
+		}
+
+		if ip := net.ParseIP(strings.Trim(bind, "[]")); ip != nil {
+			if ip.To4() != nil {
+				add("tcp4", ip.String())
+			} else {
+				add("tcp6", ip.String())
+			}
+			continue
+		}
+
+		ipv4 := GetIPAddresses(bind, "ipv4")
+		ipv6 := GetIPAddresses(bind, "ipv6")
+		if len(ipv4) == 0 && len(ipv6) == 0 {
+			return nil, fmt.Errorf("unknown bind address or interface: %s", bind)
+		}
+		for _, ip := range ipv4 {
+			add("tcp4", ip)
+		}
+		for _, ip := range ipv6 {
+			if net.ParseIP(ip).IsLinkLocalUnicast() {
+				ip += "%" + bind
+			}
+			add("tcp6", ip)
+		}
+	}
+
+	if len(result) == 0 {
+		add("tcp", "")
+	}
+	return result, nil
+}
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BlobInfo is an uploaded content stored once under its SHA-256 and shared
+// by every file entry with the same content
+type BlobInfo struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	RefCount int    `json:"refCount"`
+}
+
+// BlobDB maps content hashes to the stored blobs
+type BlobDB map[string]BlobInfo
+
+// getBlobDBKey returns the storage key for the blob database
+func getBlobDBKey() string {
+	return "Blobs:" + getMachineID()
+}
+
+// getBlobDb retrieves the blob database
+func (s *FileStore) getBlobDb() (BlobDB, error) {
+	value, err := s.storage.GetItem(getBlobDBKey(), "{}")
+	if err != nil {
+		return nil, err
+	}
+
+	var blobDb BlobDB
+	if err := json.Unmarshal([]byte(value.(string)), &blobDb); err != nil {
+		return nil, fmt.Errorf("failed to parse blob database: %v", err)
+	}
+	return blobDb, nil
+}
+
+// saveBlobDb persists the blob database
+func (s *FileStore) saveBlobDb(blobDb BlobDB) error {
+	jsonData, err := json.Marshal(blobDb)
+	if err != nil {
+		return fmt.Errorf("failed to marshal blob database: %v", err)
+	}
+	return s.storage.SetItem(getBlobDBKey(), string(jsonData))
+}
+
+// blobPath returns where content with hash is stored below blobDir
+func blobPath(blobDir, hash string) string {
+	return filepath.Join(blobDir, hash[:2], hash)
+}
+
+// IsBlobPath reports whether path lies inside the blob store blobDir
+func IsBlobPath(blobDir, path string) bool {
+	rel, err := filepath.Rel(blobDir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// AddUpload stores the uploaded temp file content-addressed in blobDir and
+// adds it to the database as file.Name in file.Room. A name taken in another
+// room gets a numeric suffix. Identical content already stored is
+// reused and the temp file removed. It returns the stored entry and whether
+// the content was deduplicated.
+func (s *FileStore) AddUpload(tempPath, blobDir string, file FileInfo) (FileInfo, bool, error) {
+	if len(file.Hash) < 2 {
+		return FileInfo{}, false, fmt.Errorf("invalid content hash")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	blobDb, err := s.getBlobDb()
+	if err != nil {
+		return FileInfo{}, false, err
+	}
+	fileDb, err := s.getFileDb()
+	if err != nil {
+		return FileInfo{}, false, err
+	}
+
+	// An entry of the same name in another room is kept, the upload gets
+	// a numeric suffix instead
+	room := RoomName(file.Room)
+	ext := filepath.Ext(file.Name)
+	file.Name = freeName(fileDb, strings.TrimSuffix(file.Name, ext), ext, func(existing FileInfo) bool {
+		return existing.Room != room
+	})
+
+	// Replacing an entry of the same name releases its old content first,
+	// the temp file is still around should that delete the very same blob
+	if existing, ok := fileDb[file.Name]; ok {
+		s.releaseBlob(blobDb, existing)
+	}
+
+	blob, deduplicated := blobDb[file.Hash]
+	if _, statErr := os.Stat(blob.Path); !deduplicated || statErr != nil {
+		path := blobPath(blobDir, file.Hash)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return FileInfo{}, false, fmt.Errorf("failed to create blob directory: %v", err)
+		}
+		if err := os.Rename(tempPath, path); err != nil {
+			return FileInfo{}, false, fmt.Errorf("failed to store blob: %v", err)
+		}
+		blob = BlobInfo{Path: path, Size: file.Size, RefCount: blob.RefCount}
+		deduplicated = false
+	} else {
+		os.Remove(tempPath)
+	}
+
+	blob.RefCount++
+	blobDb[file.Hash] = blob
+
+	info, err := os.Stat(blob.Path)
+	if err != nil {
+		return FileInfo{}, false, fmt.Errorf("failed to stat blob: %v", err)
+	}
+	entry := FileInfo{
+		Type:     "file",
+		Name:     file.Name,
+		Path:     blob.Path,
+		Username: file.Username,
+		Hash:     file.Hash,
+		Size:     info.Size(),
+		ModTime:  info.ModTime().UnixMilli(),
+		Room:     room,
+	}
+	fileDb[file.Name] = entry
+
+	if err := s.saveBlobDb(blobDb); err != nil {
+		return FileInfo{}, false, err
+	}
+	return entry, deduplicated, s.saveFileDb(fileDb)
+}
+
+// releaseBlob drops the reference file holds on its blob, deleting the
+// blob once nothing references it. Files outside the blob store are ignored.
+func (s *FileStore) releaseBlob(blobDb BlobDB, file FileInfo) {
+	blob, ok := blobDb[file.Hash]
+	if file.Hash == "" || !ok || blob.Path != file.Path {
+		return
+	}
+
+	blob.RefCount--
+	if blob.RefCount > 0 {
+		blobDb[file.Hash] = blob
+		return
+	}
+	delete(blobDb, file.Hash)
+	if err := os.Remove(blob.Path); err != nil && !os.IsNotExist(err) {
+		s.logger.Printf("remove blob error: %v\n", err)
+	}
+}
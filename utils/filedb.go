@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 )
 
@@ -41,52 +43,123 @@ func getFileDBKey() string {
 
 // FileInfo represents the structure of file information
 type FileInfo struct {
-	Type     string `json:"type"`
+	Type string `json:"type"`
+	// ID identifies text entries
+	ID       string `json:"id,omitempty"`
 	Name     string `json:"name"`
 	Path     string `json:"path"`
 	Username string `json:"username"`
 	Content  string `json:"content,omitempty"`
 	Intro    string `json:"intro,omitempty"`
+	// Hash is the hex SHA-256 of the content, valid for Size and ModTime
+	// (unix milliseconds). It is computed lazily on first download.
+	Hash    string `json:"hash,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	ModTime int64  `json:"modTime,omitempty"`
+	// Thumbnail is the URL of a thumbnail for images
+	Thumbnail string `json:"thumbnail,omitempty"`
+	// SizeText is Size in human-readable form
+	SizeText string `json:"sizeText,omitempty"`
+	MimeType string `json:"mimeType,omitempty"`
+	// Mode is the permission string, e.g. -rw-r--r--
+	Mode string `json:"mode,omitempty"`
+	// ItemCount is the number of entries of a directory
+	ItemCount int `json:"itemCount,omitempty"`
+	// SizePending is set while the recursive size of a directory is still
+	// being computed
+	SizePending bool `json:"sizePending,omitempty"`
+	// Pinned marks pinned text entries
+	Pinned bool `json:"pinned,omitempty"`
+	// Format and Language describe text entries, see TextMessage
+	Format   string `json:"format,omitempty"`
+	Language string `json:"language,omitempty"`
+	// Room is the room the entry was shared in, see RoomName
+	Room string `json:"room,omitempty"`
 }
 
 // FileDB represents the file database structure
 type FileDB map[string]FileInfo
 
+// FileStore is the list of shared files and texts persisted in a Storage
+type FileStore struct {
+	mutex   sync.Mutex
+	storage *Storage
+	logger  Logger
+}
+
+var defaultFileStore = NewFileStore(defaultStorage, nil)
+
+// NewFileStore creates a file store persisted in storage. A nil logger
+// prints to standard output.
+func NewFileStore(storage *Storage, logger Logger) *FileStore {
+	if logger == nil {
+		logger = StdoutLogger()
+	}
+	return &FileStore{storage: storage, logger: logger}
+}
+
+// Storage returns the storage the file store is persisted in
+func (s *FileStore) Storage() *Storage {
+	return s.storage
+}
+
+// DefaultFileStore returns the file store backed by the default storage
+func DefaultFileStore() *FileStore {
+	return defaultFileStore
+}
+
 // addFileToDb adds a file to the database
-func addFileToDb(fileName string, fileInfo FileInfo) error {
-	fileDb, err := getFileDb()
+func (s *FileStore) addFileToDb(fileName string, fileInfo FileInfo) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	fileDb, err := s.getFileDb()
 	if err != nil {
 		return err
 	}
 
 	fileDb[fileName] = fileInfo
-	jsonData, err := json.Marshal(fileDb)
-	if err != nil {
-		return fmt.Errorf("failed to marshal file database: %v", err)
-	}
-
-	return SetStorageItem(getFileDBKey(), string(jsonData))
+	return s.saveFileDb(fileDb)
 }
 
 // removeFileToDb removes a file from the database
-func removeFileToDb(fileName string) error {
-	fileDb, err := getFileDb()
+func (s *FileStore) removeFileToDb(fileName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	fileDb, err := s.getFileDb()
 	if err != nil {
 		return err
 	}
 
+	if existing, ok := fileDb[fileName]; ok && existing.Hash != "" {
+		blobDb, err := s.getBlobDb()
+		if err != nil {
+			return err
+		}
+		s.releaseBlob(blobDb, existing)
+		if err := s.saveBlobDb(blobDb); err != nil {
+			return err
+		}
+	}
+
 	delete(fileDb, fileName)
+	return s.saveFileDb(fileDb)
+}
+
+// saveFileDb persists the file database
+func (s *FileStore) saveFileDb(fileDb FileDB) error {
 	jsonData, err := json.Marshal(fileDb)
 	if err != nil {
 		return fmt.Errorf("failed to marshal file database: %v", err)
 	}
 
-	return SetStorageItem(getFileDBKey(), string(jsonData))
+	return s.storage.SetItem(getFileDBKey(), string(jsonData))
 }
 
 // getFileDb retrieves the file database
-func getFileDb() (FileDB, error) {
-	value, err := GetStorageItem(getFileDBKey(), "{}")
+func (s *FileStore) getFileDb() (FileDB, error) {
+	value, err := s.storage.GetItem(getFileDBKey(), "{}")
 	if err != nil {
 		return nil, err
 	}
@@ -95,13 +168,59 @@ func getFileDb() (FileDB, error) {
 	if err := json.Unmarshal([]byte(value.(string)), &fileDb); err != nil {
 		return nil, fmt.Errorf("failed to parse file database: %v", err)
 	}
+	// Entries stored before rooms existed belong to the default room
+	for name, file := range fileDb {
+		if file.Room == "" {
+			file.Room = DefaultRoom
+			fileDb[name] = file
+		}
+	}
 
 	return fileDb, nil
 }
 
-// AddFileToDb adds a file to the database
+// freeName returns base+ext, or base_N+ext when the entry of that name is
+// taken, e.g. belongs to another room
+func freeName(fileDb FileDB, base, ext string, taken func(FileInfo) bool) string {
+	name := base + ext
+	for suffix := 1; ; suffix++ {
+		if existing, exists := fileDb[name]; !exists || !taken(existing) {
+			return name
+		}
+		name = fmt.Sprintf("%s_%d%s", base, suffix, ext)
+	}
+}
+
+// AddFileToDb adds a file to the default file store
 func AddFileToDb(file FileInfo) error {
-	fmt.Printf("--- addFile --- %+v\n", file)
+	return defaultFileStore.AddFile(file)
+}
+
+// AddTextToDb adds a text entry to the default file store
+func AddTextToDb(text, username string) error {
+	return defaultFileStore.AddText(text, username)
+}
+
+// RemoveFileFromDb removes a file from the default file store
+func RemoveFileFromDb(file FileInfo) error {
+	return defaultFileStore.RemoveFile(file)
+}
+
+// ListFilesFromDb returns all files in the default file store
+func ListFilesFromDb() ([]FileInfo, error) {
+	return defaultFileStore.ListFiles()
+}
+
+// GetFileFromDb retrieves a file from the default file store by name
+func GetFileFromDb(fileName string) (FileInfo, error) {
+	return defaultFileStore.GetFile(fileName)
+}
+
+// AddFile adds a file to the database in file.Room. A name taken in
+// another room gets a numeric suffix, an entry of the same name in the
+// room is replaced and its uploaded content released.
+func (s *FileStore) AddFile(file FileInfo) error {
+	s.logger.Printf("--- addFile --- %+v\n", file)
 
 	fileInfo := filepath.Clean(file.Path)
 	fileStat, err := os.Stat(fileInfo)
@@ -109,56 +228,62 @@ func AddFileToDb(file FileInfo) error {
 		return fmt.Errorf("failed to stat file: %v", err)
 	}
 
-	if fileStat.IsDir() {
-		filename := filepath.Base(fileInfo)
-		finalFilename := filename
-		suffix := 1
-
-		fileDb, err := getFileDb()
-		if err != nil {
-			return err
-		}
-
-		for {
-			if existingFile, exists := fileDb[finalFilename]; !exists || existingFile.Path == fileInfo {
-				break
-			}
-			finalFilename = fmt.Sprintf("%s_%d", filename, suffix)
-			suffix++
-		}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-		fmt.Printf("%s finalFilename\n", finalFilename)
-		return addFileToDb(finalFilename, FileInfo{
-			Type:     "directory",
-			Name:     finalFilename,
-			Path:     fileInfo,
-			Username: file.Username,
-		})
+	fileDb, err := s.getFileDb()
+	if err != nil {
+		return err
 	}
+	room := RoomName(file.Room)
 
-	return addFileToDb(file.Name, FileInfo{
+	entry := FileInfo{
 		Type:     "file",
-		Name:     file.Name,
 		Path:     fileInfo,
 		Username: file.Username,
-	})
-}
-
-// AddTextToDb adds a text entry to the database
-func AddTextToDb(text, username string) error {
-	fmt.Printf("--- addText --- %s\n", text)
-	fmt.Printf("--- username --- %s\n", username)
-
-	name := text
-	if len(text) > 20 {
-		name = text[:20] + "..."
+		Room:     room,
+	}
+	if fileStat.IsDir() {
+		entry.Type = "directory"
+		entry.Name = freeName(fileDb, filepath.Base(fileInfo), "", func(existing FileInfo) bool {
+			return existing.Path != fileInfo || existing.Room != room
+		})
+		s.logger.Printf("%s finalFilename\n", entry.Name)
+	} else {
+		ext := filepath.Ext(file.Name)
+		entry.Name = freeName(fileDb, strings.TrimSuffix(file.Name, ext), ext, func(existing FileInfo) bool {
+			return existing.Room != room
+		})
 	}
 
-	intro := text
-	if len(text) > 100 {
-		intro = text[:100]
+	if existing, ok := fileDb[entry.Name]; ok && existing.Hash != "" {
+		if existing.Path == entry.Path {
+			// Sharing the blob itself again keeps its reference
+			entry.Hash = existing.Hash
+		} else {
+			blobDb, err := s.getBlobDb()
+			if err != nil {
+				return err
+			}
+			s.releaseBlob(blobDb, existing)
+			if err := s.saveBlobDb(blobDb); err != nil {
+				return err
+			}
+		}
 	}
 
+	fileDb[entry.Name] = entry
+	return s.saveFileDb(fileDb)
+}
+
+// AddText adds a text entry to the database
+func (s *FileStore) AddText(text, username string) error {
+	s.logger.Printf("--- addText --- %s\n", text)
+	s.logger.Printf("--- username --- %s\n", username)
+
+	name := truncateRunes(text, textTitleRunes, "...")
+	intro := truncateRunes(text, textIntroRunes, "")
+
 	textBody := FileInfo{
 		Type:     "text",
 		Name:     name,
@@ -167,18 +292,18 @@ func AddTextToDb(text, username string) error {
 		Username: username,
 	}
 
-	return addFileToDb(textBody.Name, textBody)
+	return s.addFileToDb(textBody.Name, textBody)
 }
 
-// RemoveFileFromDb removes a file from the database
-func RemoveFileFromDb(file FileInfo) error {
-	fmt.Printf("removeFile: %s\n", file.Name)
-	return removeFileToDb(file.Name)
+// RemoveFile removes a file from the database
+func (s *FileStore) RemoveFile(file FileInfo) error {
+	s.logger.Printf("removeFile: %s\n", file.Name)
+	return s.removeFileToDb(file.Name)
 }
 
-// ListFilesFromDb returns all files in the database
-func ListFilesFromDb() ([]FileInfo, error) {
-	fileDb, err := getFileDb()
+// ListFiles returns all files in the database
+func (s *FileStore) ListFiles() ([]FileInfo, error) {
+	fileDb, err := s.getFileDb()
 	if err != nil {
 		return nil, err
 	}
@@ -187,12 +312,35 @@ func ListFilesFromDb() ([]FileInfo, error) {
 	for _, file := range fileDb {
 		files = append(files, file)
 	}
+	// Keep a stable order instead of the random map iteration order
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
 	return files, nil
 }
 
-// GetFileFromDb retrieves a file from the database by name
-func GetFileFromDb(fileName string) (FileInfo, error) {
-	fileDb, err := getFileDb()
+// UpdateFile applies update to the named entry and persists it
+func (s *FileStore) UpdateFile(fileName string, update func(*FileInfo)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	fileDb, err := s.getFileDb()
+	if err != nil {
+		return err
+	}
+
+	file, exists := fileDb[fileName]
+	if !exists {
+		return fmt.Errorf("file not found: %s", fileName)
+	}
+	update(&file)
+	fileDb[fileName] = file
+	return s.saveFileDb(fileDb)
+}
+
+// GetFile retrieves a file from the database by name
+func (s *FileStore) GetFile(fileName string) (FileInfo, error) {
+	fileDb, err := s.getFileDb()
 	if err != nil {
 		return FileInfo{}, err
 	}
@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testFileStore returns a file store persisted in a temp directory and the
+// directory for its blobs
+func testFileStore(t *testing.T) (*FileStore, string) {
+	t.Helper()
+	dir := t.TempDir()
+	return NewFileStore(NewStorage(filepath.Join(dir, "db.json")), DiscardLogger()), filepath.Join(dir, "blobs")
+}
+
+// upload stores content as an upload named name
+func upload(t *testing.T, s *FileStore, blobDir, name, hash, content string) FileInfo {
+	t.Helper()
+	tmp := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	entry, _, err := s.AddUpload(tmp, blobDir, FileInfo{Name: name, Hash: hash, Size: int64(len(content))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+func TestAddFileReleasesReplacedUpload(t *testing.T) {
+	s, blobDir := testFileStore(t)
+	uploaded := upload(t, s, blobDir, "a.txt", "aa11", "uploaded")
+
+	local := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(local, []byte("local"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddFile(FileInfo{Name: "a.txt", Path: local}); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := s.GetFile("a.txt")
+	if err != nil || entry.Path != local || entry.Hash != "" {
+		t.Fatalf("entry = %+v, %v", entry, err)
+	}
+	if _, err := os.Stat(uploaded.Path); !os.IsNotExist(err) {
+		t.Errorf("blob of the replaced upload was kept: %v", err)
+	}
+	blobDb, err := s.getBlobDb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := blobDb["aa11"]; ok {
+		t.Errorf("blob of the replaced upload is still referenced")
+	}
+}
+
+func TestAddFileKeepsSharedBlob(t *testing.T) {
+	s, blobDir := testFileStore(t)
+	upload(t, s, blobDir, "a.txt", "bb22", "same")
+	shared := upload(t, s, blobDir, "b.txt", "bb22", "same")
+
+	local := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(local, []byte("local"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddFile(FileInfo{Name: "a.txt", Path: local}); err != nil {
+		t.Fatal(err)
+	}
+
+	// b.txt still references the blob
+	if _, err := os.Stat(shared.Path); err != nil {
+		t.Fatalf("blob still in use was removed: %v", err)
+	}
+	blobDb, _ := s.getBlobDb()
+	if blobDb["bb22"].RefCount != 1 {
+		t.Errorf("RefCount = %d, want 1", blobDb["bb22"].RefCount)
+	}
+}
+
+func TestAddFileConcurrent(t *testing.T) {
+	s, _ := testFileStore(t)
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		path := filepath.Join(dir, string(rune('a'+i))+".txt")
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.AddFile(FileInfo{Name: filepath.Base(path), Path: path}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Each add sees the entries of the others, none is lost
+	files, err := s.ListFiles()
+	if err != nil || len(files) != 20 {
+		t.Errorf("listed %d files, want 20 (%v)", len(files), err)
+	}
+}
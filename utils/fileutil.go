@@ -32,10 +32,9 @@ func OpenFile(filePath string) error {
 	return nil
 }
 
-// ListFilesInDir lists all files in the specified directory
+// ListFilesInDir lists all files in the specified directory with their
+// metadata
 func ListFilesInDir(fileDir string) ([]FileInfo, error) {
-	fmt.Println(fileDir)
-
 	// Check if path is a directory
 	fileInfo, err := os.Stat(fileDir)
 	if err != nil {
@@ -52,17 +51,23 @@ func ListFilesInDir(fileDir string) ([]FileInfo, error) {
 	}
 
 	for _, entry := range entries {
-		fmt.Println(entry.Name())
 		fileAbsPath := filepath.Join(fileDir, entry.Name())
 		fileType := "file"
 		if entry.IsDir() {
 			fileType = "directory"
 		}
-		files = append(files, FileInfo{
+		file := FileInfo{
 			Type: fileType,
 			Name: entry.Name(),
 			Path: fileAbsPath,
-		})
+		}
+		// Follow symlinks so they are listed like their targets
+		if info, err := os.Stat(fileAbsPath); err == nil {
+			FillMetadata(&file, info)
+		} else if info, err := entry.Info(); err == nil {
+			FillMetadata(&file, info)
+		}
+		files = append(files, file)
 	}
 
 	return files, nil
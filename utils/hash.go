@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// hashEntry is a digest valid as long as the file keeps its size and mtime
+type hashEntry struct {
+	size    int64
+	modTime int64
+	hash    string
+}
+
+// HashCache memoizes SHA-256 digests of files. Entries are invalidated when
+// the size or modification time of a file changes.
+type HashCache struct {
+	mutex   sync.Mutex
+	entries map[string]hashEntry
+}
+
+// NewHashCache creates an empty hash cache
+func NewHashCache() *HashCache {
+	return &HashCache{entries: make(map[string]hashEntry)}
+}
+
+// Get returns the cached digest of path when it is still current
+func (c *HashCache) Get(path string, info os.FileInfo) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[path]
+	if !ok || entry.size != info.Size() || entry.modTime != info.ModTime().UnixNano() {
+		return "", false
+	}
+	return entry.hash, true
+}
+
+// Put stores the digest of path for the given file state
+func (c *HashCache) Put(path string, info os.FileInfo, hash string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[path] = hashEntry{size: info.Size(), modTime: info.ModTime().UnixNano(), hash: hash}
+}
+
+// FileHash returns the hex encoded SHA-256 digest of path, computing it
+// only when the file changed since it was last hashed
+func (c *HashCache) FileHash(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if hash, ok := c.Get(path, info); ok {
+		return hash, nil
+	}
+
+	hash, err := HashFile(path)
+	if err != nil {
+		return "", err
+	}
+	c.Put(path, info, hash)
+	return hash, nil
+}
+
+// HashFile returns the hex encoded SHA-256 digest of the file at path
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %v", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to hash file: %v", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// DigestHeaders returns the ETag, Digest (RFC 3230) and Repr-Digest
+// (RFC 9530) header values for a hex encoded SHA-256 digest
+func DigestHeaders(hash string) (etag, digest, reprDigest string) {
+	raw, err := hex.DecodeString(hash)
+	if err != nil {
+		return "", "", ""
+	}
+	b64 := base64.StdEncoding.EncodeToString(raw)
+	return `"` + hash + `"`, "sha-256=" + b64, "sha-256=:" + b64 + ":"
+}
@@ -1,8 +1,10 @@
 package utils
 
 import (
+	"fmt"
 	"net"
 	"runtime"
+	"sort"
 	"strings"
 )
 
@@ -86,12 +88,12 @@ func GetNetInterfaceNames(ipFamily string) []string {
 		}
 
 		if hasIP {
-			// Filter out virtual interfaces
-			if !strings.Contains(strings.ToLower(iface.Name), "loopback") &&
+			// Filter out loopback and virtual interfaces
+			if iface.Flags&net.FlagLoopback == 0 &&
+				!strings.Contains(strings.ToLower(iface.Name), "loopback") &&
 				!strings.Contains(strings.ToLower(iface.Name), "vmware") &&
 				!strings.Contains(strings.ToLower(iface.Name), "internal") &&
-				!strings.Contains(strings.ToLower(iface.Name), "lo") &&
-				!strings.Contains(strings.ToLower(iface.Name), "vEthernet") {
+				!strings.Contains(strings.ToLower(iface.Name), "vethernet") {
 				names = append(names, iface.Name)
 			}
 		}
@@ -148,3 +150,117 @@ func GetWlan0IPAddress(ipFamily string) string {
 	}
 	return GetLoopback(ipFamily)
 }
+
+// AddressCandidate is a local address the server may be reached on
+type AddressCandidate struct {
+	Interface string `json:"interface"`
+	IP        string `json:"ip"`
+	Family    string `json:"family"`
+	Score     int    `json:"score"`
+}
+
+// virtualInterfacePrefixes are name prefixes of interfaces that are usually
+// not reachable from other devices on the LAN
+var virtualInterfacePrefixes = []string{
+	"docker", "br-", "veth", "virbr", "vmnet", "vboxnet", "vethernet",
+	"utun", "tun", "tap", "zt", "tailscale", "wg", "cni", "flannel",
+}
+
+// wirelessInterfacePrefixes are name prefixes of typical Wi-Fi interfaces
+var wirelessInterfacePrefixes = []string{"wl", "wi-fi", "wifi", "en0"}
+
+// GetAddressCandidates returns every usable address of the interfaces that
+// are up and running, best candidates first. Private IPv4 addresses on
+// physical (preferably wireless) interfaces rank highest; loopback and
+// link-local addresses are skipped.
+func GetAddressCandidates() []AddressCandidate {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return []AddressCandidate{}
+	}
+
+	var candidates []AddressCandidate
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			v, ok := addr.(*net.IPNet)
+			if !ok || v.IP.IsLoopback() || v.IP.IsLinkLocalUnicast() || v.IP.IsUnspecified() {
+				continue
+			}
+			family := "ipv6"
+			if v.IP.To4() != nil {
+				family = "ipv4"
+			}
+			candidates = append(candidates, AddressCandidate{
+				Interface: iface.Name,
+				IP:        v.IP.String(),
+				Family:    family,
+				Score:     scoreAddress(iface, v.IP),
+			})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].Interface < candidates[j].Interface
+	})
+	return candidates
+}
+
+// scoreAddress ranks how likely ip on iface is reachable by other LAN devices
+func scoreAddress(iface net.Interface, ip net.IP) int {
+	score := 0
+	if ip.To4() != nil {
+		score += 20
+	}
+	if ip.IsPrivate() {
+		score += 100
+	}
+	if iface.Flags&net.FlagRunning != 0 {
+		score += 30
+	}
+
+	name := strings.ToLower(iface.Name)
+	for _, prefix := range virtualInterfacePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			score -= 80
+			break
+		}
+	}
+	for _, prefix := range wirelessInterfacePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			score += 10
+			break
+		}
+	}
+	return score
+}
+
+// SelectAddressCandidate returns the best candidate on the named interface,
+// or the best candidate overall when interfaceName is empty
+func SelectAddressCandidate(candidates []AddressCandidate, interfaceName string) (AddressCandidate, error) {
+	for _, c := range candidates {
+		if interfaceName == "" || c.Interface == interfaceName {
+			return c, nil
+		}
+	}
+	if interfaceName != "" {
+		return AddressCandidate{}, fmt.Errorf("no usable address on interface %s", interfaceName)
+	}
+	return AddressCandidate{Interface: "lo", IP: GetLoopback("ipv4"), Family: "ipv4"}, nil
+}
+
+// FormatURL builds a URL for host and port, bracketing IPv6 addresses
+func FormatURL(scheme, host string, port int) string {
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, fmt.Sprint(port)))
+}
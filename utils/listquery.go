@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxListLimit is the largest page size of a listing
+const MaxListLimit = 1000
+
+// ListQuery sorts, filters and pages a file listing
+type ListQuery struct {
+	// Sort is one of name, size, mtime, type or uploader
+	Sort string
+	// Desc reverses the order
+	Desc bool
+	// Types keeps only entries of these types (file, directory, text)
+	Types []string
+	// Name is a case-insensitive glob the entry name has to match
+	Name string
+	// Cursor continues after the last entry of a previous page
+	Cursor string
+	// Limit is the page size, 0 returns everything
+	Limit int
+}
+
+// listCursor is the position after which the next page starts. It holds
+// the sort key of the last returned entry, so a page stays correct when
+// entries are added or removed in between.
+type listCursor struct {
+	Name     string `json:"n"`
+	Type     string `json:"t,omitempty"`
+	Size     int64  `json:"s,omitempty"`
+	ModTime  int64  `json:"m,omitempty"`
+	Username string `json:"u,omitempty"`
+}
+
+// ParseListQuery reads the sort, order, type, name, cursor and limit
+// query parameters
+func ParseListQuery(values url.Values) (ListQuery, error) {
+	q := ListQuery{
+		Sort:   values.Get("sort"),
+		Name:   values.Get("name"),
+		Cursor: values.Get("cursor"),
+	}
+
+	switch q.Sort {
+	case "":
+		q.Sort = "name"
+	case "name", "size", "mtime", "type", "uploader":
+	default:
+		return q, fmt.Errorf("不支持的排序字段: %s", q.Sort)
+	}
+
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, fmt.Errorf("不支持的排序方向: %s", values.Get("order"))
+	}
+
+	if types := values.Get("type"); types != "" {
+		q.Types = strings.Split(types, ",")
+	}
+
+	if q.Name != "" {
+		if _, err := path.Match(q.Name, ""); err != nil {
+			return q, fmt.Errorf("文件名匹配模式无效: %s", q.Name)
+		}
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("分页大小无效: %s", limit)
+		}
+		q.Limit = min(n, MaxListLimit)
+	}
+
+	if q.Cursor != "" {
+		if _, err := decodeListCursor(q.Cursor); err != nil {
+			return q, fmt.Errorf("分页游标无效")
+		}
+	}
+	return q, nil
+}
+
+// Apply filters and sorts files and returns the requested page, the number
+// of entries matching the filters and the cursor of the next page, which is
+// empty on the last page
+func (q ListQuery) Apply(files []FileInfo) ([]FileInfo, int, string) {
+	matched := make([]FileInfo, 0, len(files))
+	for _, file := range files {
+		if q.matches(file) {
+			matched = append(matched, file)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return q.compare(matched[i], matched[j]) < 0
+	})
+	total := len(matched)
+
+	if q.Cursor != "" {
+		cursor, _ := decodeListCursor(q.Cursor)
+		last := cursor.fileInfo()
+		start := sort.Search(len(matched), func(i int) bool {
+			return q.compare(matched[i], last) > 0
+		})
+		matched = matched[start:]
+	}
+
+	if q.Limit == 0 || len(matched) <= q.Limit {
+		return matched, total, ""
+	}
+	page := matched[:q.Limit]
+	return page, total, encodeListCursor(page[len(page)-1])
+}
+
+// matches reports whether file passes the type and name filters
+func (q ListQuery) matches(file FileInfo) bool {
+	if len(q.Types) > 0 {
+		found := false
+		for _, t := range q.Types {
+			if t == file.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.Name != "" {
+		ok, _ := path.Match(strings.ToLower(q.Name), strings.ToLower(file.Name))
+		return ok
+	}
+	return true
+}
+
+// compare orders two entries by the sort field, falling back to the name
+// so that the order is total and cursors are unambiguous
+func (q ListQuery) compare(a, b FileInfo) int {
+	var c int
+	switch q.Sort {
+	case "size":
+		c = compareInt(a.Size, b.Size)
+	case "mtime":
+		c = compareInt(a.ModTime, b.ModTime)
+	case "type":
+		c = strings.Compare(a.Type, b.Type)
+	case "uploader":
+		c = strings.Compare(a.Username, b.Username)
+	}
+	if c == 0 {
+		c = strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	}
+	if c == 0 {
+		c = strings.Compare(a.Name, b.Name)
+	}
+	if q.Desc {
+		return -c
+	}
+	return c
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func encodeListCursor(file FileInfo) string {
+	data, _ := json.Marshal(listCursor{
+		Name:     file.Name,
+		Type:     file.Type,
+		Size:     file.Size,
+		ModTime:  file.ModTime,
+		Username: file.Username,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeListCursor(cursor string) (listCursor, error) {
+	var c listCursor
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
+
+// fileInfo returns an entry sorting exactly where the cursor points
+func (c listCursor) fileInfo() FileInfo {
+	return FileInfo{Name: c.Name, Type: c.Type, Size: c.Size, ModTime: c.ModTime, Username: c.Username}
+}
@@ -0,0 +1,29 @@
+package utils
+
+import "fmt"
+
+// Logger receives the diagnostic output of the server
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// stdoutLogger prints to standard output, the historical behaviour
+type stdoutLogger struct{}
+
+func (stdoutLogger) Printf(format string, v ...interface{}) {
+	fmt.Printf(format, v...)
+}
+
+// StdoutLogger returns a Logger writing to standard output
+func StdoutLogger() Logger {
+	return stdoutLogger{}
+}
+
+// DiscardLogger returns a Logger dropping everything
+func DiscardLogger() Logger {
+	return discardLogger{}
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Printf(format string, v ...interface{}) {}
@@ -0,0 +1,430 @@
+package utils
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// RenderMarkdown renders the common subset of Markdown used for snippets:
+// headings, paragraphs, emphasis, strikethrough, inline and fenced code,
+// block quotes, lists, rules, links, images and bare URLs.
+//
+// The output is safe to embed into a page as is. Raw HTML in the input is
+// never passed through but escaped, and link targets are limited to http,
+// https, mailto and relative URLs.
+func RenderMarkdown(source string) string {
+	source = strings.ReplaceAll(source, "\r\n", "\n")
+	var b strings.Builder
+	renderBlocks(&b, strings.Split(source, "\n"), 0)
+	return b.String()
+}
+
+const (
+	// maxBlockDepth is how deep block quotes and lists nest, deeper
+	// markers are rendered as text
+	maxBlockDepth = 16
+	// maxInlineDepth is how deep links and emphasis nest, deeper links are
+	// rendered as text
+	maxInlineDepth = 8
+)
+
+var (
+	headingRe     = regexp.MustCompile(`^(#{1,6})[ \t]+(.*?)[ \t#]*$`)
+	bulletRe      = regexp.MustCompile(`^( {0,3})[-*+][ \t]+`)
+	orderedRe     = regexp.MustCompile(`^( {0,3})(\d{1,9})[.)][ \t]+`)
+	fenceRe       = regexp.MustCompile("^ {0,3}(```+|~~~+)[ \t]*([^`\\s]*)")
+	languageRe    = regexp.MustCompile(`^[A-Za-z0-9_+#.-]{1,32}$`)
+	bareURLRe     = regexp.MustCompile(`^https?://[^\s<>"]+[^\s<>".,;:!?)\]'*_~]`)
+	hardBreakLine = regexp.MustCompile(`( {2,}|\\)$`)
+)
+
+// renderBlocks renders lines as a sequence of block elements. depth is the
+// number of enclosing quotes and list items.
+func renderBlocks(b *strings.Builder, lines []string, depth int) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case trimmed == "":
+			i++
+
+		case fenceRe.MatchString(line):
+			m := fenceRe.FindStringSubmatch(line)
+			fence := m[1]
+			i++
+			var code []string
+			for i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence) {
+				code = append(code, lines[i])
+				i++
+			}
+			i++ // closing fence
+			b.WriteString("<pre><code")
+			if languageRe.MatchString(m[2]) {
+				b.WriteString(` class="language-` + html.EscapeString(m[2]) + `"`)
+			}
+			b.WriteString(">")
+			b.WriteString(html.EscapeString(strings.Join(code, "\n")))
+			b.WriteString("</code></pre>\n")
+
+		case headingRe.MatchString(line):
+			m := headingRe.FindStringSubmatch(line)
+			level := string(rune('0' + len(m[1])))
+			b.WriteString("<h" + level + ">" + renderInline(m[2], 0) + "</h" + level + ">\n")
+			i++
+
+		case ruleMatches(line):
+			b.WriteString("<hr>\n")
+			i++
+
+		case strings.HasPrefix(trimmed, ">") && depth < maxBlockDepth:
+			var quoted []string
+			for i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">") {
+				q := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				quoted = append(quoted, strings.TrimPrefix(q, " "))
+				i++
+			}
+			b.WriteString("<blockquote>\n")
+			renderBlocks(b, quoted, depth+1)
+			b.WriteString("</blockquote>\n")
+
+		case (bulletRe.MatchString(line) || orderedRe.MatchString(line)) && depth < maxBlockDepth:
+			i = renderList(b, lines, i, depth)
+
+		default:
+			var para []string
+			for i < len(lines) && strings.TrimSpace(lines[i]) != "" && (len(para) == 0 || !startsBlock(lines[i])) {
+				para = append(para, lines[i])
+				i++
+			}
+			b.WriteString("<p>")
+			for j, l := range para {
+				if j > 0 {
+					b.WriteString("<br>\n")
+				}
+				b.WriteString(renderInline(strings.TrimSpace(hardBreakLine.ReplaceAllString(l, "")), 0))
+			}
+			b.WriteString("</p>\n")
+		}
+	}
+}
+
+// ruleMatches reports whether line is a thematic break such as ---
+func ruleMatches(line string) bool {
+	trimmed := strings.ReplaceAll(strings.TrimSpace(line), " ", "")
+	if len(trimmed) < 3 {
+		return false
+	}
+	for _, c := range []string{"-", "*", "_"} {
+		if strings.Trim(trimmed, c) == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// startsBlock reports whether line interrupts a paragraph
+func startsBlock(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return fenceRe.MatchString(line) || headingRe.MatchString(line) || ruleMatches(line) ||
+		strings.HasPrefix(trimmed, ">") || bulletRe.MatchString(line) || orderedRe.MatchString(line)
+}
+
+// renderList renders the list starting at lines[start] and returns the
+// index of the first line after it. Lines indented below an item belong to
+// it, which is how nested lists are written.
+func renderList(b *strings.Builder, lines []string, start, depth int) int {
+	ordered := !bulletRe.MatchString(lines[start])
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+	}
+	b.WriteString("<" + tag + ">\n")
+
+	i := start
+	for i < len(lines) {
+		var marker []string
+		if ordered {
+			marker = orderedRe.FindStringSubmatch(lines[i])
+		} else {
+			marker = bulletRe.FindStringSubmatch(lines[i])
+		}
+		if marker == nil {
+			break
+		}
+		item := []string{lines[i][len(marker[0]):]}
+		i++
+		for i < len(lines) {
+			l := lines[i]
+			if strings.TrimSpace(l) == "" {
+				// A blank line continues the item only if indented text follows
+				if i+1 < len(lines) && indent(lines[i+1]) >= 2 {
+					item = append(item, "")
+					i++
+					continue
+				}
+				break
+			}
+			if indent(l) >= 2 {
+				item = append(item, dedent(l, 2))
+				i++
+				continue
+			}
+			if startsBlock(l) {
+				break
+			}
+			// Lazy continuation of the item's paragraph
+			item = append(item, l)
+			i++
+		}
+
+		b.WriteString("<li>")
+		if len(item) == 1 {
+			b.WriteString(renderInline(strings.TrimSpace(item[0]), 0))
+		} else {
+			var inner strings.Builder
+			renderBlocks(&inner, item, depth+1)
+			b.WriteString(unwrapParagraph(inner.String()))
+		}
+		b.WriteString("</li>\n")
+
+		if i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+			break
+		}
+	}
+
+	b.WriteString("</" + tag + ">\n")
+	return i
+}
+
+// unwrapParagraph drops the <p> around the first paragraph of a list item
+// so tight lists render compact
+func unwrapParagraph(s string) string {
+	if strings.HasPrefix(s, "<p>") {
+		if end := strings.Index(s, "</p>\n"); end >= 0 {
+			return s[3:end] + "\n" + s[end+5:]
+		}
+	}
+	return s
+}
+
+// indent returns the number of leading spaces of line, a tab counts as four
+func indent(line string) int {
+	n := 0
+	for _, r := range line {
+		switch r {
+		case ' ':
+			n++
+		case '\t':
+			n += 4
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+// dedent removes up to n columns of leading whitespace
+func dedent(line string, n int) string {
+	for n > 0 && len(line) > 0 {
+		switch line[0] {
+		case ' ':
+			n--
+		case '\t':
+			n -= 4
+		default:
+			return line
+		}
+		line = line[1:]
+	}
+	return line
+}
+
+// renderInline renders the inline elements of a line of text. depth is the
+// number of enclosing links and emphasis.
+func renderInline(s string, depth int) string {
+	var b strings.Builder
+	closers := matchBrackets(s)
+	// gt is the index of the next '>' from i on, len(s) when there is none
+	gt := -1
+	for i := 0; i < len(s); {
+		c := s[i]
+		rest := s[i:]
+
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_{}[]()#+-.!~>|", s[i+1]) >= 0:
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '`':
+			n := len(rest) - len(strings.TrimLeft(rest, "`"))
+			fence := rest[:n]
+			if end := strings.Index(rest[n:], fence); end >= 0 {
+				code := strings.TrimSpace(rest[n : n+end])
+				b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i += n + end + n
+				continue
+			}
+			b.WriteString(fence)
+			i += n
+			continue
+
+		case c == '!' && strings.HasPrefix(rest, "![") && depth < maxInlineDepth:
+			if alt, target, n, ok := parseLink(s, i+1, closers); ok {
+				if url, ok := safeURL(target, true); ok {
+					b.WriteString(`<img src="` + html.EscapeString(url) + `" alt="` + html.EscapeString(alt) + `">`)
+				} else {
+					b.WriteString(html.EscapeString(alt))
+				}
+				i += 1 + n
+				continue
+			}
+
+		case c == '[' && depth < maxInlineDepth:
+			if text, target, n, ok := parseLink(s, i, closers); ok {
+				if url, ok := safeURL(target, false); ok {
+					b.WriteString(`<a href="` + html.EscapeString(url) + `" rel="nofollow noopener noreferrer" target="_blank">` + renderInline(text, depth+1) + `</a>`)
+				} else {
+					b.WriteString(renderInline(text, depth+1))
+				}
+				i += n
+				continue
+			}
+
+		case c == '<':
+			if gt < i {
+				gt = len(s)
+				if end := strings.IndexByte(rest, '>'); end >= 0 {
+					gt = i + end
+				}
+			}
+			if gt < len(s) {
+				if url, ok := safeURL(s[i+1:gt], false); ok && strings.Contains(url, ":") {
+					b.WriteString(`<a href="` + html.EscapeString(url) + `" rel="nofollow noopener noreferrer" target="_blank">` + html.EscapeString(url) + `</a>`)
+					i = gt + 1
+					continue
+				}
+			}
+
+		case c == 'h' && (i == 0 || !isWordByte(s[i-1])):
+			if url := bareURLRe.FindString(rest); url != "" {
+				b.WriteString(`<a href="` + html.EscapeString(url) + `" rel="nofollow noopener noreferrer" target="_blank">` + html.EscapeString(url) + `</a>`)
+				i += len(url)
+				continue
+			}
+
+		case strings.HasPrefix(rest, "**") || strings.HasPrefix(rest, "__"):
+			if out, n, ok := renderDelimited(rest, rest[:2], "strong", depth); ok {
+				b.WriteString(out)
+				i += n
+				continue
+			}
+
+		case strings.HasPrefix(rest, "~~"):
+			if out, n, ok := renderDelimited(rest, "~~", "del", depth); ok {
+				b.WriteString(out)
+				i += n
+				continue
+			}
+
+		case c == '*' || c == '_' && (i == 0 || !isWordByte(s[i-1])):
+			if out, n, ok := renderDelimited(rest, rest[:1], "em", depth); ok {
+				b.WriteString(out)
+				i += n
+				continue
+			}
+		}
+
+		b.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+	return b.String()
+}
+
+// renderDelimited renders s, which starts with delim, as tag up to the
+// closing delim. It returns the HTML and the number of bytes consumed.
+func renderDelimited(s, delim, tag string, depth int) (string, int, bool) {
+	inner := s[len(delim):]
+	if inner == "" || inner[0] == ' ' {
+		return "", 0, false
+	}
+	end := strings.Index(inner, delim)
+	if end <= 0 || inner[end-1] == ' ' {
+		return "", 0, false
+	}
+	return "<" + tag + ">" + renderInline(inner[:end], depth+1) + "</" + tag + ">", len(delim) + end + len(delim), true
+}
+
+// matchBrackets returns the index of the closing bracket or parenthesis
+// for each opening one in s that is closed. Escaped brackets do not count.
+func matchBrackets(s string) map[int]int {
+	closers := make(map[int]int)
+	var brackets, parens []int
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			brackets = append(brackets, i)
+		case ']':
+			if n := len(brackets); n > 0 {
+				closers[brackets[n-1]] = i
+				brackets = brackets[:n-1]
+			}
+		case '(':
+			parens = append(parens, i)
+		case ')':
+			if n := len(parens); n > 0 {
+				closers[parens[n-1]] = i
+				parens = parens[:n-1]
+			}
+		}
+	}
+	return closers
+}
+
+// parseLink parses "[text](target)" at s[start:], closers being the
+// result of matchBrackets for s. It returns the text, the target and the
+// number of bytes consumed. Parentheses in the target have to be balanced.
+func parseLink(s string, start int, closers map[int]int) (text, target string, n int, ok bool) {
+	closeText, ok := closers[start]
+	if !ok || closeText+1 >= len(s) || s[closeText+1] != '(' {
+		return "", "", 0, false
+	}
+	closeTarget, ok := closers[closeText+1]
+	if !ok {
+		return "", "", 0, false
+	}
+	target = strings.TrimSpace(s[closeText+2 : closeTarget])
+	// Drop an optional "title"
+	if sp := strings.IndexAny(target, " \t"); sp >= 0 {
+		target = target[:sp]
+	}
+	return s[start+1 : closeText], strings.Trim(target, "<>"), closeTarget + 1 - start, true
+}
+
+// safeURL returns target when it is a relative URL or uses an allowed
+// scheme; images only allow http and https
+func safeURL(target string, image bool) (string, bool) {
+	target = strings.TrimSpace(target)
+	if target == "" || strings.ContainsAny(target, " \t\n<>\"") {
+		return "", false
+	}
+	colon := strings.IndexByte(target, ':')
+	if colon < 0 || strings.ContainsAny(target[:colon], "/?#") {
+		return target, true
+	}
+	switch strings.ToLower(target[:colon]) {
+	case "http", "https":
+		return target, true
+	case "mailto":
+		return target, !image
+	}
+	return "", false
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderMarkdownSanitizes(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"raw html", `<script>alert(1)</script>`, "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"attribute quote", `[x](http://a.example/"onmouseover="alert(1))`, "<p>x</p>\n"},
+		{"javascript link", `[x](javascript:alert(1))`, "<p>x</p>\n"},
+		{"javascript link uppercase", `[x](JavaScript:alert(1))`, "<p>x</p>\n"},
+		{"data image", `![x](data:image/png;base64,AAAA)`, "<p>x</p>\n"},
+		{"mailto image", `![x](mailto:a@b.example)`, "<p>x</p>\n"},
+		{"javascript autolink", `<javascript:alert(1)>`, "<p>&lt;javascript:alert(1)&gt;</p>\n"},
+		{"code language", "```js\"><script>\nx\n```", "<pre><code>x</code></pre>\n"},
+		{"code content", "```\n<b>\n```", "<pre><code>&lt;b&gt;</code></pre>\n"},
+		{"inline code", "`<b>`", "<p><code>&lt;b&gt;</code></p>\n"},
+	}
+	for _, tt := range tests {
+		if got := RenderMarkdown(tt.source); got != tt.want {
+			t.Errorf("%s: RenderMarkdown(%q) = %q, want %q", tt.name, tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestRenderMarkdownLinks(t *testing.T) {
+	const attrs = `" rel="nofollow noopener noreferrer" target="_blank">`
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"link", `[x](http://a.example)`, `<a href="http://a.example` + attrs + `x</a>`},
+		{"relative", `[x](/api/files)`, `<a href="/api/files` + attrs + `x</a>`},
+		{"title", `[x](http://a.example "t")`, `<a href="http://a.example` + attrs + `x</a>`},
+		{"angle target", `[x](<http://a.example>)`, `<a href="http://a.example` + attrs + `x</a>`},
+		{"balanced parens", `[x](http://a.example/f(1))`, `<a href="http://a.example/f(1)` + attrs + `x</a>`},
+		{"unbalanced parens", `[x](http://a.example/f(1)`, `[x](<a href="http://a.example/f(1" rel="nofollow noopener noreferrer" target="_blank">http://a.example/f(1</a>)`},
+		{"nested brackets", `[a [b] c](/x)`, `<a href="/x` + attrs + `a [b] c</a>`},
+		{"escaped bracket", `[a \] b](/x)`, `<a href="/x` + attrs + `a ] b</a>`},
+		{"no target", `[x] (y)`, `[x] (y)`},
+		{"unclosed", `[x`, `[x`},
+		{"image", `![a "b"](http://a.example/i.png)`, `<img src="http://a.example/i.png" alt="a &#34;b&#34;">`},
+		{"emphasis in text", `[*x*](/y)`, `<a href="/y` + attrs + `<em>x</em></a>`},
+		{"autolink", `<https://a.example>`, `<a href="https://a.example` + attrs + `https://a.example</a>`},
+		{"bare url", `see https://a.example/x.`, `see <a href="https://a.example/x` + attrs + `https://a.example/x</a>.`},
+	}
+	for _, tt := range tests {
+		want := "<p>" + tt.want + "</p>\n"
+		if got := RenderMarkdown(tt.source); got != want {
+			t.Errorf("%s: RenderMarkdown(%q) = %q, want %q", tt.name, tt.source, got, want)
+		}
+	}
+}
+
+func TestRenderMarkdownNesting(t *testing.T) {
+	quote := RenderMarkdown(strings.Repeat(">", 100) + " x")
+	if n := strings.Count(quote, "<blockquote>"); n != maxBlockDepth {
+		t.Errorf("rendered %d nested quotes, want %d", n, maxBlockDepth)
+	}
+
+	link := RenderMarkdown(strings.Repeat("[", 20) + "x" + strings.Repeat("](/y)", 20))
+	if n := strings.Count(link, "<a "); n != maxInlineDepth {
+		t.Errorf("rendered %d nested links, want %d", n, maxInlineDepth)
+	}
+}
+
+func TestRenderMarkdownLinear(t *testing.T) {
+	// Each of these took quadratic time in the number of brackets
+	inputs := []string{
+		strings.Repeat("[", 100000),
+		strings.Repeat("[a](", 50000),
+		strings.Repeat("<", 100000),
+		strings.Repeat(">", 50000),
+		strings.Repeat("- ", 50000) + "x",
+	}
+	for _, input := range inputs {
+		start := time.Now()
+		RenderMarkdown(input)
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("rendering %q... took %v", input[:8], elapsed)
+		}
+	}
+}
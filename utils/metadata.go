@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FillMetadata sets the size, modification time, MIME type and permissions
+// of file from info. Directories get their item count instead of a size and
+// MIME type.
+func FillMetadata(file *FileInfo, info os.FileInfo) {
+	file.ModTime = info.ModTime().UnixMilli()
+	file.Mode = info.Mode().String()
+
+	if info.IsDir() {
+		file.Type = "directory"
+		if count, err := countItems(file.Path); err == nil {
+			file.ItemCount = count
+		}
+		return
+	}
+
+	file.Type = "file"
+	file.Size = info.Size()
+	file.SizeText = ConvertBytes(info.Size())
+	file.MimeType = mime.TypeByExtension(strings.ToLower(filepath.Ext(file.Name)))
+	if file.MimeType == "" {
+		file.MimeType = "application/octet-stream"
+	}
+}
+
+// countItems returns the number of entries directly inside dir
+func countItems(dir string) (int, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	return len(names), err
+}
+
+// dirSize sums the sizes of all files below dir, skipping anything that
+// cannot be read instead of failing the whole walk
+func dirSize(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total, err
+}
+
+// dirSizeEntry is a computed recursive directory size
+type dirSizeEntry struct {
+	size       int64
+	computedAt time.Time
+}
+
+// DirSizeCache computes recursive directory sizes in the background and
+// remembers them for a while, so listing a directory never waits on
+// walking a large tree.
+type DirSizeCache struct {
+	ttl     time.Duration
+	mutex   sync.Mutex
+	entries map[string]dirSizeEntry
+	pending map[string]bool
+}
+
+// NewDirSizeCache creates a cache whose sizes are recomputed once older
+// than ttl
+func NewDirSizeCache(ttl time.Duration) *DirSizeCache {
+	return &DirSizeCache{
+		ttl:     ttl,
+		entries: make(map[string]dirSizeEntry),
+		pending: make(map[string]bool),
+	}
+}
+
+// Lookup returns the cached size of dir. Without a current size it starts
+// computing it, unless that is already underway, and calls done with the
+// result once finished. A stale size is still returned while refreshing.
+func (c *DirSizeCache) Lookup(dir string, done func(size int64)) (int64, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[dir]
+	if ok && time.Since(entry.computedAt) < c.ttl {
+		return entry.size, true
+	}
+	if !c.pending[dir] {
+		c.pending[dir] = true
+		go c.compute(dir, done)
+	}
+	return entry.size, ok
+}
+
+// compute walks dir and stores its total size
+func (c *DirSizeCache) compute(dir string, done func(size int64)) {
+	size, err := dirSize(dir)
+
+	c.mutex.Lock()
+	delete(c.pending, dir)
+	if err == nil {
+		c.entries[dir] = dirSizeEntry{size: size, computedAt: time.Now()}
+	}
+	c.mutex.Unlock()
+
+	if err == nil && done != nil {
+		done(size)
+	}
+}
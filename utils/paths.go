@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// appName is the directory name used below the XDG base directories
+const appName = "file-share"
+
+// Paths locates everything a server persists. All of storage, settings,
+// uploaded blobs, archives, thumbnails and certificates derive from it, so two servers with
+// different Paths never share state.
+type Paths struct {
+	DataDir   string `json:"dataDir"`
+	ConfigDir string `json:"configDir"`
+}
+
+// NewPaths keeps both data and settings below dataDir
+func NewPaths(dataDir string) Paths {
+	return Paths{DataDir: dataDir, ConfigDir: dataDir}
+}
+
+// DefaultPaths follows the XDG base directory specification:
+// $XDG_DATA_HOME/file-share (default ~/.local/share/file-share) for data and
+// $XDG_CONFIG_HOME/file-share (default ~/.config/file-share) for settings.
+// An existing ~/.hui/cache/fs-share directory of older versions keeps being
+// used as data directory when XDG_DATA_HOME is not set.
+func DefaultPaths() (Paths, error) {
+	home, homeErr := os.UserHomeDir()
+
+	var p Paths
+	if dir := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dir) {
+		p.DataDir = filepath.Join(dir, appName)
+	} else if homeErr == nil {
+		legacy := filepath.Join(home, ".hui", "cache", "fs-share")
+		if info, err := os.Stat(legacy); err == nil && info.IsDir() {
+			p.DataDir = legacy
+		} else {
+			p.DataDir = filepath.Join(home, ".local", "share", appName)
+		}
+	} else {
+		return Paths{}, fmt.Errorf("cannot determine data directory, set --data-dir or XDG_DATA_HOME: %v", homeErr)
+	}
+
+	if dir := os.Getenv("XDG_CONFIG_HOME"); filepath.IsAbs(dir) {
+		p.ConfigDir = filepath.Join(dir, appName)
+	} else if homeErr == nil {
+		p.ConfigDir = filepath.Join(home, ".config", appName)
+	} else {
+		return Paths{}, fmt.Errorf("cannot determine config directory, set --data-dir or XDG_CONFIG_HOME: %v", homeErr)
+	}
+
+	return p, nil
+}
+
+// Ensure creates the data and config directories
+func (p Paths) Ensure() error {
+	for _, dir := range []string{p.DataDir, p.ConfigDir, p.BlobDir(), p.TempDir()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// StorageFile is the key-value storage holding the shared file list
+func (p Paths) StorageFile() string {
+	return filepath.Join(p.DataDir, "files.json")
+}
+
+// SettingsFile is the JSON config file of the settings
+func (p Paths) SettingsFile() string {
+	return filepath.Join(p.ConfigDir, "settings.json")
+}
+
+// BlobDir stores uploaded content addressed by its SHA-256
+func (p Paths) BlobDir() string {
+	return filepath.Join(p.DataDir, "blobs")
+}
+
+// TempDir holds temporary files
+func (p Paths) TempDir() string {
+	return filepath.Join(p.DataDir, "tmp")
+}
+
+// ArchiveDir caches the zip archives of shared directories
+func (p Paths) ArchiveDir() string {
+	return filepath.Join(p.DataDir, "archives")
+}
+
+// ThumbnailDir caches generated image thumbnails
+func (p Paths) ThumbnailDir() string {
+	return filepath.Join(p.DataDir, "thumbnails")
+}
+
+// CertDir holds the generated TLS certificate and key
+func (p Paths) CertDir() string {
+	return filepath.Join(p.DataDir, "tls")
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket letting rate bytes per second through, in
+// bursts of up to one second worth of bytes. A rate of 0 does not limit.
+type RateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter of rate bytes per second
+func NewRateLimiter(rate int64) *RateLimiter {
+	l := &RateLimiter{}
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes the rate, waits already running keep their duration
+func (l *RateLimiter) SetRate(rate int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.refill(time.Now())
+	l.rate = math.Max(float64(rate), 0)
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+}
+
+// Rate returns the rate in bytes per second, 0 when unlimited
+func (l *RateLimiter) Rate() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return int64(l.rate)
+}
+
+// refill adds the tokens earned since the last call. The caller holds
+// l.lock.
+func (l *RateLimiter) refill(now time.Time) {
+	if !l.last.IsZero() && l.rate > 0 {
+		l.tokens = math.Min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+}
+
+// WaitN takes n bytes from the bucket, blocking until they are covered or
+// ctx is done. Taking more than the bucket holds leaves it in debt, which
+// the following callers wait off.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	l.lock.Lock()
+	if l.rate <= 0 {
+		l.lock.Unlock()
+		return nil
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	for _, rate := range []int64{0, -1} {
+		l := NewRateLimiter(rate)
+		if l.Rate() != 0 {
+			t.Errorf("NewRateLimiter(%d).Rate() = %d", rate, l.Rate())
+		}
+		start := time.Now()
+		for i := 0; i < 100; i++ {
+			if err := l.WaitN(context.Background(), 1<<30); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Errorf("rate %d waited %v", rate, elapsed)
+		}
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	tests := []struct {
+		name string
+		rate int64
+		// takes are the sizes taken one after the other
+		takes []int
+		// want is the expected total wait
+		want time.Duration
+	}{
+		// The bucket starts empty
+		{"first take", 1000, []int{100}, 100 * time.Millisecond},
+		{"debt", 1000, []int{300}, 300 * time.Millisecond},
+		{"sequence", 10000, []int{1000, 1000, 1000}, 300 * time.Millisecond},
+		{"zero bytes", 1000, []int{0}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewRateLimiter(tt.rate)
+			start := time.Now()
+			for _, n := range tt.takes {
+				if err := l.WaitN(context.Background(), n); err != nil {
+					t.Fatal(err)
+				}
+			}
+			elapsed := time.Since(start)
+			if elapsed < tt.want*8/10 || elapsed > tt.want+150*time.Millisecond {
+				t.Errorf("waited %v, want about %v", elapsed, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	l := NewRateLimiter(10000)
+	l.WaitN(context.Background(), 0)
+	// Idle time fills the bucket up to one second worth of bytes, not more
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	l.WaitN(context.Background(), 1500)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("take covered by the bucket waited %v", elapsed)
+	}
+
+	l = NewRateLimiter(1000)
+	l.WaitN(context.Background(), 0)
+	time.Sleep(1200 * time.Millisecond)
+	start = time.Now()
+	l.WaitN(context.Background(), 1100)
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("bucket held more than one second worth of bytes, waited %v", elapsed)
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	l := NewRateLimiter(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := l.WaitN(ctx, 1000); err != context.DeadlineExceeded {
+		t.Fatalf("WaitN error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled wait took %v", elapsed)
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	l := NewRateLimiter(1000)
+	l.SetRate(-5)
+	if l.Rate() != 0 {
+		t.Fatalf("Rate() = %d after SetRate(-5)", l.Rate())
+	}
+	if err := l.WaitN(context.Background(), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lowering the rate drops tokens above the new burst
+	l = NewRateLimiter(100000)
+	l.WaitN(context.Background(), 0)
+	time.Sleep(100 * time.Millisecond)
+	l.SetRate(1000)
+	start := time.Now()
+	l.WaitN(context.Background(), 1100)
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("tokens of the old rate were kept, waited %v", elapsed)
+	}
+}
@@ -0,0 +1,265 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultRoom is the room everyone is a member of. Entries and texts
+// without a room, e.g. of older versions, belong to it.
+const DefaultRoom = "default"
+
+// maxRoomNameRunes is the maximum length of a room name
+const maxRoomNameRunes = 32
+
+var (
+	// ErrRoomNotFound is returned for rooms that do not exist
+	ErrRoomNotFound = errors.New("room not found")
+	// ErrRoomExists is returned when creating a room that already exists
+	ErrRoomExists = errors.New("room already exists")
+	// ErrNoMember is returned when a room is created or joined without a
+	// member identity
+	ErrNoMember = errors.New("room member is empty")
+)
+
+// RoomName returns the room an entry with room belongs to
+func RoomName(room string) string {
+	if room == "" {
+		return DefaultRoom
+	}
+	return room
+}
+
+// ValidRoomName reports whether name can be used for a new room. Names are
+// up to 32 letters, digits, spaces or one of "_-.".
+func ValidRoomName(name string) bool {
+	if name == "" || name != strings.TrimSpace(name) || utf8.RuneCountInString(name) > maxRoomNameRunes {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != ' ' && !strings.ContainsRune("_-.", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Room is a named space scoping shared files, texts and events
+type Room struct {
+	Name      string `json:"name"`
+	CreatedBy string `json:"createdBy,omitempty"`
+	// CreatedAt is unix milliseconds
+	CreatedAt int64    `json:"createdAt,omitempty"`
+	Members   []string `json:"members"`
+}
+
+// HasMember reports whether member joined the room, everyone is a member
+// of the default room. An empty member identifies nobody and joined no
+// other room.
+func (r Room) HasMember(member string) bool {
+	if r.Name == DefaultRoom {
+		return true
+	}
+	if member == "" {
+		return false
+	}
+	for _, m := range r.Members {
+		if m == member {
+			return true
+		}
+	}
+	return false
+}
+
+// RoomStore is the list of rooms and their members persisted in a Storage
+type RoomStore struct {
+	mutex   sync.Mutex
+	storage *Storage
+	logger  Logger
+}
+
+// NewRoomStore creates a room store persisted in storage. A nil logger
+// prints to standard output.
+func NewRoomStore(storage *Storage, logger Logger) *RoomStore {
+	if logger == nil {
+		logger = StdoutLogger()
+	}
+	return &RoomStore{storage: storage, logger: logger}
+}
+
+// getRoomDBKey returns the storage key for the rooms
+func getRoomDBKey() string {
+	return "Rooms:" + getMachineID()
+}
+
+// load reads the rooms except the default room, the caller holds the lock
+func (s *RoomStore) load() ([]Room, error) {
+	value, err := s.storage.GetItem(getRoomDBKey(), "[]")
+	if err != nil {
+		return nil, err
+	}
+
+	var rooms []Room
+	if err := json.Unmarshal([]byte(value.(string)), &rooms); err != nil {
+		return nil, fmt.Errorf("failed to parse room database: %v", err)
+	}
+	// Older versions stored an empty member for every IPv6 client
+	for i := range rooms {
+		members := rooms[i].Members[:0]
+		for _, m := range rooms[i].Members {
+			if m != "" {
+				members = append(members, m)
+			}
+		}
+		rooms[i].Members = members
+	}
+	return rooms, nil
+}
+
+// save persists the rooms, the caller holds the lock
+func (s *RoomStore) save(rooms []Room) error {
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Name < rooms[j].Name
+	})
+	jsonData, err := json.Marshal(rooms)
+	if err != nil {
+		return fmt.Errorf("failed to marshal room database: %v", err)
+	}
+	return s.storage.SetItem(getRoomDBKey(), string(jsonData))
+}
+
+// List returns all rooms, the default room first
+func (s *RoomStore) List() ([]Room, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	rooms, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return append([]Room{{Name: DefaultRoom, Members: []string{}}}, rooms...), nil
+}
+
+// Get returns the room called name
+func (s *RoomStore) Get(name string) (Room, error) {
+	rooms, err := s.List()
+	if err != nil {
+		return Room{}, err
+	}
+	for _, room := range rooms {
+		if room.Name == name {
+			return room, nil
+		}
+	}
+	return Room{}, ErrRoomNotFound
+}
+
+// IsMember reports whether member joined the room called name
+func (s *RoomStore) IsMember(name, member string) bool {
+	if RoomName(name) == DefaultRoom {
+		return true
+	}
+	room, err := s.Get(name)
+	return err == nil && room.HasMember(member)
+}
+
+// Create adds a room called name with creator as its first member
+func (s *RoomStore) Create(name, creator string) (Room, error) {
+	if !ValidRoomName(name) {
+		return Room{}, fmt.Errorf("invalid room name %q", name)
+	}
+	if creator == "" {
+		return Room{}, ErrNoMember
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	rooms, err := s.load()
+	if err != nil {
+		return Room{}, err
+	}
+	if name == DefaultRoom {
+		return Room{}, ErrRoomExists
+	}
+	for _, room := range rooms {
+		if room.Name == name {
+			return Room{}, ErrRoomExists
+		}
+	}
+
+	room := Room{
+		Name:      name,
+		CreatedBy: creator,
+		CreatedAt: time.Now().UnixMilli(),
+		Members:   []string{creator},
+	}
+	return room, s.save(append(rooms, room))
+}
+
+// Delete removes the room called name, the default room cannot be deleted
+func (s *RoomStore) Delete(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	rooms, err := s.load()
+	if err != nil {
+		return err
+	}
+	for i := range rooms {
+		if rooms[i].Name == name {
+			return s.save(append(rooms[:i], rooms[i+1:]...))
+		}
+	}
+	return ErrRoomNotFound
+}
+
+// Join adds member to the room called name
+func (s *RoomStore) Join(name, member string) (Room, error) {
+	if member == "" {
+		return Room{}, ErrNoMember
+	}
+	return s.update(name, func(room *Room) {
+		if !room.HasMember(member) {
+			room.Members = append(room.Members, member)
+		}
+	})
+}
+
+// Leave removes member from the room called name
+func (s *RoomStore) Leave(name, member string) (Room, error) {
+	return s.update(name, func(room *Room) {
+		for i, m := range room.Members {
+			if m == member {
+				room.Members = append(room.Members[:i], room.Members[i+1:]...)
+				return
+			}
+		}
+	})
+}
+
+// update applies update to the room called name and persists it. The
+// default room has no stored members and cannot be updated.
+func (s *RoomStore) update(name string, update func(*Room)) (Room, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	rooms, err := s.load()
+	if err != nil {
+		return Room{}, err
+	}
+	for i := range rooms {
+		if rooms[i].Name == name {
+			update(&rooms[i])
+			return rooms[i], s.save(rooms)
+		}
+	}
+	return Room{}, ErrRoomNotFound
+}
@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// NewMatcher returns a function matching names against pattern. mode is
+// one of substring (default), name (exact), glob or regex; all but regex
+// ignore case.
+func NewMatcher(mode, pattern string) (func(string) bool, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+	lower := strings.ToLower(pattern)
+
+	switch mode {
+	case "", "substring":
+		return func(s string) bool {
+			return strings.Contains(strings.ToLower(s), lower)
+		}, nil
+	case "name":
+		return func(s string) bool {
+			return strings.EqualFold(s, pattern)
+		}, nil
+	case "glob":
+		if _, err := path.Match(lower, ""); err != nil {
+			return nil, err
+		}
+		return func(s string) bool {
+			ok, _ := path.Match(lower, strings.ToLower(s))
+			return ok
+		}, nil
+	case "regex":
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+	return nil, fmt.Errorf("unknown match mode %q", mode)
+}
+
+// WalkMatches walks the tree below root and calls found with the slash
+// separated path relative to root and the metadata of every entry whose
+// name matches. Walking stops when ctx is done or found returns false.
+// Unreadable directories are skipped.
+func WalkMatches(ctx context.Context, root string, match func(string) bool, found func(relPath string, file FileInfo) bool) error {
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			if p != root && d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if p == root || !match(d.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return nil
+		}
+		file := FileInfo{Name: d.Name(), Path: p, Type: "file"}
+		if d.IsDir() {
+			file.Type = "directory"
+		}
+		if info, err := d.Info(); err == nil {
+			FillMetadata(&file, info)
+		}
+		if !found(filepath.ToSlash(rel), file) {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return err
+}
@@ -16,6 +16,7 @@ const (
 	PasswordKey   = "password"
 	TusEnableKey  = "tusEnable"
 	ChunkSizeKey  = "chunkSize"
+	BandwidthKey  = "bandwidth"
 )
 
 type Settings struct {
@@ -26,18 +27,63 @@ type Settings struct {
 	Password   string `json:"password"`
 	TusEnable  bool   `json:"tusEnable"`
 	ChunkSize  int    `json:"chunkSize"`
+	// Bandwidth limits the upload and download rates
+	Bandwidth Bandwidth `json:"bandwidth"`
 }
 
-var (
+// BandwidthLimit is a pair of rates in bytes per second, 0 for unlimited
+type BandwidthLimit struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// Bandwidth limits the transfer rates of the server
+type Bandwidth struct {
+	// Global limits all clients together
+	Global BandwidthLimit `json:"global"`
+	// PerClient limits each client IP
+	PerClient BandwidthLimit `json:"perClient"`
+	// Clients overrides PerClient for single client IPs
+	Clients map[string]BandwidthLimit `json:"clients,omitempty"`
+}
+
+// ClientLimit returns the limit of the client with ip
+func (b Bandwidth) ClientLimit(ip string) BandwidthLimit {
+	if limit, ok := b.Clients[ip]; ok {
+		return limit
+	}
+	return b.PerClient
+}
+
+// Validate rejects negative rates
+func (b Bandwidth) Validate() error {
+	limits := []BandwidthLimit{b.Global, b.PerClient}
+	for _, limit := range b.Clients {
+		limits = append(limits, limit)
+	}
+	for _, limit := range limits {
+		if limit.Upload < 0 || limit.Download < 0 {
+			return fmt.Errorf("bandwidth limits must not be negative")
+		}
+	}
+	return nil
+}
+
+// SettingsStore holds the settings of one server, optionally persisted to
+// a JSON config file
+type SettingsStore struct {
 	settings     Settings
 	settingsLock sync.RWMutex
 	configFile   string
-)
+	// onChange is called with the new settings after every update
+	onChange []func(Settings)
+}
 
-// InitSettings initializes the settings with default values
-func InitSettings(configPath string) error {
-	configFile = configPath
-	settings = Settings{
+var defaultSettings = &SettingsStore{settings: DefaultSettings()}
+
+// DefaultSettings returns the settings used when no config file exists
+func DefaultSettings() Settings {
+	return Settings{
 		UploadPath: getDefaultUploadPath(),
 		Port:       5421,
 		IP:         GetIPAddress(0, "ipv4"),
@@ -46,109 +92,164 @@ func InitSettings(configPath string) error {
 		TusEnable:  false,
 		ChunkSize:  20,
 	}
+}
+
+// NewSettingsStore loads the settings from configPath, creating the file
+// with default values if it does not exist. An empty configPath keeps the
+// settings in memory only.
+func NewSettingsStore(configPath string) (*SettingsStore, error) {
+	store := &SettingsStore{
+		settings:   DefaultSettings(),
+		configFile: configPath,
+	}
+	if configPath == "" {
+		return store, nil
+	}
 
 	// Load settings from file if it exists
-	if _, err := os.Stat(configFile); err == nil {
-		data, err := os.ReadFile(configFile)
+	if _, err := os.Stat(configPath); err == nil {
+		data, err := os.ReadFile(configPath)
 		if err != nil {
-			return fmt.Errorf("error reading config file: %v", err)
+			return nil, fmt.Errorf("error reading config file: %v", err)
 		}
 
-		if err := json.Unmarshal(data, &settings); err != nil {
-			return fmt.Errorf("error parsing config file: %v", err)
+		if err := json.Unmarshal(data, &store.settings); err != nil {
+			return nil, fmt.Errorf("error parsing config file: %v", err)
 		}
 	}
 
-	return saveSettings()
+	return store, store.saveSettings()
 }
 
-// GetSettings returns the current settings
-func GetSettings() Settings {
-	settingsLock.RLock()
-	defer settingsLock.RUnlock()
-	return settings
+// NewMemorySettingsStore returns a store holding settings without a config file
+func NewMemorySettingsStore(settings Settings) *SettingsStore {
+	return &SettingsStore{settings: settings}
 }
 
-// UpdateSettings updates the settings with new values
-func UpdateSettings(newSettings Settings) error {
-	settingsLock.Lock()
-	defer settingsLock.Unlock()
-
-	// Validate upload path
-	if newSettings.UploadPath != settings.UploadPath {
-		if err := validateUploadPath(newSettings.UploadPath); err != nil {
-			return err
-		}
+// InitSettings initializes the default settings from configPath
+func InitSettings(configPath string) error {
+	store, err := NewSettingsStore(configPath)
+	if err != nil {
+		return err
 	}
+	defaultSettings = store
+	return nil
+}
 
-	// Validate port
-	if newSettings.Port <= 0 || newSettings.Port > 65535 {
-		return fmt.Errorf("invalid port number")
-	}
+// DefaultSettingsStore returns the store used by the package level helpers
+func DefaultSettingsStore() *SettingsStore {
+	return defaultSettings
+}
 
-	// Validate chunk size
-	if newSettings.ChunkSize <= 0 {
-		return fmt.Errorf("chunk size must be greater than 0")
-	}
+// GetSettings returns the current default settings
+func GetSettings() Settings {
+	return defaultSettings.Get()
+}
 
-	settings = newSettings
-	return saveSettings()
+// UpdateSettings updates the default settings with new values
+func UpdateSettings(newSettings Settings) error {
+	return defaultSettings.Update(newSettings)
 }
 
 // GetUploadPath returns the current upload path
 func GetUploadPath() string {
-	settingsLock.RLock()
-	defer settingsLock.RUnlock()
-	return settings.UploadPath
+	return defaultSettings.Get().UploadPath
 }
 
 // GetPort returns the current port
 func GetPort() int {
-	settingsLock.RLock()
-	defer settingsLock.RUnlock()
-	return settings.Port
+	return defaultSettings.Get().Port
 }
 
 // GetIP returns the current IP
 func GetIP() string {
-	settingsLock.RLock()
-	defer settingsLock.RUnlock()
-	return settings.IP
+	return defaultSettings.Get().IP
 }
 
 // GetAuthEnable returns whether authentication is enabled
 func GetAuthEnable() bool {
-	settingsLock.RLock()
-	defer settingsLock.RUnlock()
-	return settings.AuthEnable
+	return defaultSettings.Get().AuthEnable
 }
 
 // GetPassword returns the current password
 func GetPassword() string {
-	settingsLock.RLock()
-	defer settingsLock.RUnlock()
-	return settings.Password
+	return defaultSettings.Get().Password
 }
 
 // GetTusEnable returns whether TUS upload is enabled
 func GetTusEnable() bool {
-	settingsLock.RLock()
-	defer settingsLock.RUnlock()
-	return settings.TusEnable
+	return defaultSettings.Get().TusEnable
 }
 
 // GetChunkSize returns the current chunk size
 func GetChunkSize() int {
-	settingsLock.RLock()
-	defer settingsLock.RUnlock()
-	return settings.ChunkSize
+	return defaultSettings.Get().ChunkSize
 }
 
 // GetURL returns the current server URL
 func GetURL() string {
-	settingsLock.RLock()
-	defer settingsLock.RUnlock()
-	return fmt.Sprintf("http://%s:%d", settings.IP, settings.Port)
+	settings := defaultSettings.Get()
+	return FormatURL("http", settings.IP, settings.Port)
+}
+
+// Get returns the current settings
+func (s *SettingsStore) Get() Settings {
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	return s.settings
+}
+
+// OnChange registers fn to be called with the new settings after every
+// successful Update
+func (s *SettingsStore) OnChange(fn func(Settings)) {
+	s.settingsLock.Lock()
+	defer s.settingsLock.Unlock()
+	s.onChange = append(s.onChange, fn)
+}
+
+// Update validates and stores new settings
+func (s *SettingsStore) Update(newSettings Settings) error {
+	if err := s.update(newSettings); err != nil {
+		return err
+	}
+
+	s.settingsLock.RLock()
+	hooks := s.onChange
+	s.settingsLock.RUnlock()
+	for _, fn := range hooks {
+		fn(newSettings)
+	}
+	return nil
+}
+
+// update validates and stores new settings without running the hooks
+func (s *SettingsStore) update(newSettings Settings) error {
+	s.settingsLock.Lock()
+	defer s.settingsLock.Unlock()
+
+	// Validate upload path
+	if newSettings.UploadPath != s.settings.UploadPath {
+		if err := validateUploadPath(newSettings.UploadPath); err != nil {
+			return err
+		}
+	}
+
+	// Validate port
+	if newSettings.Port <= 0 || newSettings.Port > 65535 {
+		return fmt.Errorf("invalid port number")
+	}
+
+	// Validate chunk size
+	if newSettings.ChunkSize <= 0 {
+		return fmt.Errorf("chunk size must be greater than 0")
+	}
+
+	if err := newSettings.Bandwidth.Validate(); err != nil {
+		return err
+	}
+
+	s.settings = newSettings
+	return s.saveSettings()
 }
 
 // Helper functions
@@ -172,13 +273,17 @@ func validateUploadPath(path string) error {
 	return nil
 }
 
-func saveSettings() error {
-	data, err := json.MarshalIndent(settings, "", "  ")
+func (s *SettingsStore) saveSettings() error {
+	if s.configFile == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.settings, "", "  ")
 	if err != nil {
 		return fmt.Errorf("error marshaling settings: %v", err)
 	}
 
-	if err := os.WriteFile(configFile, data, 0644); err != nil {
+	if err := os.WriteFile(s.configFile, data, 0644); err != nil {
 		return fmt.Errorf("error writing config file: %v", err)
 	}
 
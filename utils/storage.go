@@ -8,34 +8,72 @@ import (
 	"sync"
 )
 
-var (
-	storageMutex sync.RWMutex
-	storagePath  = filepath.Join(os.Getenv("HOME"), ".hui", "cache", "fs-share", "files.json")
-)
+// Storage is a JSON file backed key-value store
+type Storage struct {
+	mutex sync.RWMutex
+	path  string
+}
+
+var defaultStorage = NewStorage(defaultStorageFile())
+
+// NewStorage creates a storage persisted at path
+func NewStorage(path string) *Storage {
+	return &Storage{path: path}
+}
+
+// DefaultStorage returns the storage shared by the package level helpers
+func DefaultStorage() *Storage {
+	return defaultStorage
+}
+
+// defaultStorageFile locates the storage of the package level helpers,
+// falling back to the temp directory when no home directory is known
+func defaultStorageFile() string {
+	paths, err := DefaultPaths()
+	if err != nil {
+		return filepath.Join(os.TempDir(), appName, "files.json")
+	}
+	return paths.StorageFile()
+}
+
+// Dir returns the directory holding the storage file
+func (s *Storage) Dir() string {
+	return filepath.Dir(s.path)
+}
 
 // ensureStoragePath ensures the storage directory exists
-func ensureStoragePath() error {
-	dir := filepath.Dir(storagePath)
+func (s *Storage) ensureStoragePath() error {
+	dir := s.Dir()
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return fmt.Errorf("failed to create storage directory: %v", err)
 	}
 	return nil
 }
 
-// SetStorageItem sets a key-value pair in the storage
+// SetStorageItem sets a key-value pair in the default storage
 func SetStorageItem(key string, value interface{}) error {
-	storageMutex.Lock()
-	defer storageMutex.Unlock()
+	return defaultStorage.SetItem(key, value)
+}
+
+// GetStorageItem retrieves a value from the default storage by key
+func GetStorageItem(key string, defaultValue interface{}) (interface{}, error) {
+	return defaultStorage.GetItem(key, defaultValue)
+}
+
+// SetItem sets a key-value pair in the storage
+func (s *Storage) SetItem(key string, value interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
 	// Ensure storage directory exists
-	if err := ensureStoragePath(); err != nil {
+	if err := s.ensureStoragePath(); err != nil {
 		return err
 	}
 
 	// Read existing data
 	data := make(map[string]interface{})
-	if _, err := os.Stat(storagePath); err == nil {
-		file, err := os.ReadFile(storagePath)
+	if _, err := os.Stat(s.path); err == nil {
+		file, err := os.ReadFile(s.path)
 		if err != nil {
 			return fmt.Errorf("failed to read storage file: %v", err)
 		}
@@ -55,29 +93,29 @@ func SetStorageItem(key string, value interface{}) error {
 		return fmt.Errorf("failed to marshal storage data: %v", err)
 	}
 
-	if err := os.WriteFile(storagePath, jsonData, 0644); err != nil {
+	if err := os.WriteFile(s.path, jsonData, 0644); err != nil {
 		return fmt.Errorf("failed to write storage file: %v", err)
 	}
 
 	return nil
 }
 
-// GetStorageItem retrieves a value from storage by key
-func GetStorageItem(key string, defaultValue interface{}) (interface{}, error) {
-	storageMutex.RLock()
-	defer storageMutex.RUnlock()
+// GetItem retrieves a value from storage by key
+func (s *Storage) GetItem(key string, defaultValue interface{}) (interface{}, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 
 	// Ensure storage directory exists
-	if err := ensureStoragePath(); err != nil {
+	if err := s.ensureStoragePath(); err != nil {
 		return defaultValue, err
 	}
 
 	// Read storage file
-	if _, err := os.Stat(storagePath); err != nil {
+	if _, err := os.Stat(s.path); err != nil {
 		return defaultValue, nil
 	}
 
-	file, err := os.ReadFile(storagePath)
+	file, err := os.ReadFile(s.path)
 	if err != nil {
 		return defaultValue, fmt.Errorf("failed to read storage file: %v", err)
 	}
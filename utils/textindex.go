@@ -0,0 +1,481 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// MaxIndexedFileSize is the largest file read into the full-text index
+	MaxIndexedFileSize = 1 << 20
+	// excerptRunes is the length of a search hit excerpt
+	excerptRunes = 160
+)
+
+// textExts are indexed without looking at their content first
+var textExts = map[string]bool{
+	".txt": true, ".md": true, ".markdown": true, ".csv": true, ".log": true,
+	".json": true, ".yaml": true, ".yml": true, ".toml": true, ".ini": true,
+	".conf": true, ".cfg": true, ".env": true, ".xml": true, ".html": true,
+	".css": true, ".js": true, ".ts": true, ".go": true, ".py": true,
+	".java": true, ".c": true, ".h": true, ".cpp": true, ".rs": true,
+	".sh": true, ".sql": true, ".vue": true,
+}
+
+// indexedDoc is a document of the full-text index. Only its terms are
+// kept, the content is read again for the excerpts of hits.
+type indexedDoc struct {
+	id      string
+	kind    string
+	name    string
+	path    string
+	size    int64
+	modTime int64
+	terms   map[string]int
+	length  int
+}
+
+// ExcerptPart is a piece of a search hit excerpt, Match marks the parts
+// that matched the query
+type ExcerptPart struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match,omitempty"`
+}
+
+// TextHit is a full-text search result
+type TextHit struct {
+	ID      string        `json:"id"`
+	Kind    string        `json:"kind"`
+	Name    string        `json:"name"`
+	Score   float64       `json:"score"`
+	Excerpt []ExcerptPart `json:"excerpt"`
+}
+
+// TextIndex is an in-memory inverted index over text snippets and text
+// files. Latin text is indexed by words, CJK text by characters and
+// bigrams, so queries work without a dictionary for either.
+type TextIndex struct {
+	mutex    sync.RWMutex
+	docs     map[string]*indexedDoc
+	postings map[string]map[string]int
+	totalLen int
+	// texts returns the contents of the snippets indexed under ids
+	texts func(ids []string) map[string]string
+}
+
+// NewTextIndex creates an empty index. texts returns the contents of the
+// snippets indexed under ids, the excerpts of file hits are read from the
+// files.
+func NewTextIndex(texts func(ids []string) map[string]string) *TextIndex {
+	return &TextIndex{
+		docs:     make(map[string]*indexedDoc),
+		postings: make(map[string]map[string]int),
+		texts:    texts,
+	}
+}
+
+// AddText indexes a text snippet under id, replacing an older version
+func (x *TextIndex) AddText(id, name, content string) {
+	x.add(&indexedDoc{id: id, kind: "text", name: name}, content)
+}
+
+// AddFile indexes the file at path under id when it is a text file. A file
+// unchanged since it was last indexed is not read again.
+func (x *TextIndex) AddFile(id, name, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	x.mutex.RLock()
+	doc, ok := x.docs[id]
+	x.mutex.RUnlock()
+	if ok && doc.path == path && doc.size == info.Size() && doc.modTime == info.ModTime().UnixNano() {
+		return nil
+	}
+
+	if info.IsDir() || info.Size() > MaxIndexedFileSize || isBinaryName(name) {
+		x.Remove(id)
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !isTextName(name) && !looksLikeText(data) {
+		x.Remove(id)
+		return nil
+	}
+
+	x.add(&indexedDoc{
+		id:      id,
+		kind:    "file",
+		name:    name,
+		path:    path,
+		size:    info.Size(),
+		modTime: info.ModTime().UnixNano(),
+	}, string(data))
+	return nil
+}
+
+// Remove drops the document id from the index
+func (x *TextIndex) Remove(id string) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.remove(id)
+}
+
+// RemovePrefix drops id and every document below it, e.g. all files of a
+// shared directory
+func (x *TextIndex) RemovePrefix(id string) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	for docID := range x.docs {
+		if docID == id || strings.HasPrefix(docID, id+"/") {
+			x.remove(docID)
+		}
+	}
+}
+
+// IDs returns the ids of all indexed documents
+func (x *TextIndex) IDs() []string {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	ids := make([]string, 0, len(x.docs))
+	for id := range x.docs {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Len returns the number of indexed documents
+func (x *TextIndex) Len() int {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	return len(x.docs)
+}
+
+// Search returns up to limit documents containing all terms of query,
+// best matches first, ranked with BM25. A non-nil keep restricts the
+// search to the documents whose id it accepts.
+func (x *TextIndex) Search(query string, limit int, keep func(id string) bool) []TextHit {
+	terms := uniqueTerms(tokenize(query))
+	if len(terms) == 0 {
+		return nil
+	}
+
+	x.mutex.RLock()
+	if len(x.docs) == 0 {
+		x.mutex.RUnlock()
+		return nil
+	}
+
+	// Start from the rarest term, every other term only narrows the set
+	sort.Slice(terms, func(i, j int) bool {
+		return len(x.postings[terms[i]]) < len(x.postings[terms[j]])
+	})
+	candidates := x.postings[terms[0]]
+
+	const k1, b = 1.2, 0.75
+	n := float64(len(x.docs))
+	avgLen := float64(x.totalLen) / n
+	var hits []TextHit
+	for id := range candidates {
+		if keep != nil && !keep(id) {
+			continue
+		}
+		doc := x.docs[id]
+		score := 0.0
+		for _, term := range terms {
+			tf, ok := doc.terms[term]
+			if !ok {
+				score = -1
+				break
+			}
+			df := float64(len(x.postings[term]))
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			score += idf * float64(tf) * (k1 + 1) / (float64(tf) + k1*(1-b+b*float64(doc.length)/avgLen))
+		}
+		if score < 0 {
+			continue
+		}
+		// Matching the name as well is a strong hint
+		if nameTerms := tokenize(doc.name); containsAll(nameTerms, terms) {
+			score *= 1.5
+		}
+		hits = append(hits, TextHit{ID: doc.id, Kind: doc.kind, Name: doc.name, Score: score})
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID < hits[j].ID
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	paths := make([]string, len(hits))
+	for i, hit := range hits {
+		paths[i] = x.docs[hit.ID].path
+	}
+	x.mutex.RUnlock()
+
+	var textIDs []string
+	for _, hit := range hits {
+		if hit.Kind == "text" {
+			textIDs = append(textIDs, hit.ID)
+		}
+	}
+	var texts map[string]string
+	if len(textIDs) > 0 && x.texts != nil {
+		texts = x.texts(textIDs)
+	}
+	for i, hit := range hits {
+		if hit.Kind == "text" {
+			if content, ok := texts[hit.ID]; ok {
+				hits[i].Excerpt = excerpt(content, query)
+			}
+		} else if content, ok := readIndexedFile(paths[i]); ok {
+			hits[i].Excerpt = excerpt(content, query)
+		}
+	}
+	return hits
+}
+
+// readIndexedFile reads the file at path for the excerpt of a hit
+func readIndexedFile(path string) (string, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, MaxIndexedFileSize))
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// add replaces the document with doc.id by doc with content
+func (x *TextIndex) add(doc *indexedDoc, content string) {
+	tokens := tokenize(content + "\n" + doc.name)
+	doc.terms = make(map[string]int)
+	for _, t := range tokens {
+		doc.terms[t]++
+	}
+	doc.length = len(tokens)
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.remove(doc.id)
+	x.docs[doc.id] = doc
+	x.totalLen += doc.length
+	for term, tf := range doc.terms {
+		posting, ok := x.postings[term]
+		if !ok {
+			posting = make(map[string]int)
+			x.postings[term] = posting
+		}
+		posting[doc.id] = tf
+	}
+}
+
+// remove drops a document, the caller holds the write lock
+func (x *TextIndex) remove(id string) {
+	doc, ok := x.docs[id]
+	if !ok {
+		return
+	}
+	for term := range doc.terms {
+		posting := x.postings[term]
+		delete(posting, id)
+		if len(posting) == 0 {
+			delete(x.postings, term)
+		}
+	}
+	x.totalLen -= doc.length
+	delete(x.docs, id)
+}
+
+// isCJK reports whether r belongs to a script written without spaces
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r)
+}
+
+// tokenize lowercases s and splits it into words; CJK characters become
+// single character terms plus the overlapping bigrams of each run
+func tokenize(s string) []string {
+	var tokens []string
+	var word []rune
+	var cjk []rune
+	flushWord := func() {
+		if len(word) > 0 {
+			tokens = append(tokens, string(word))
+			word = word[:0]
+		}
+	}
+	flushCJK := func() {
+		for _, r := range cjk {
+			tokens = append(tokens, string(r))
+		}
+		for i := 0; i+1 < len(cjk); i++ {
+			tokens = append(tokens, string(cjk[i:i+2]))
+		}
+		cjk = cjk[:0]
+	}
+
+	for _, r := range s {
+		switch {
+		case isCJK(r):
+			flushWord()
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushCJK()
+			word = append(word, unicode.ToLower(r))
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+	return tokens
+}
+
+func uniqueTerms(tokens []string) []string {
+	seen := make(map[string]bool, len(tokens))
+	var terms []string
+	for _, t := range tokens {
+		if !seen[t] {
+			seen[t] = true
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+func containsAll(haystack, needles []string) bool {
+	set := make(map[string]bool, len(haystack))
+	for _, t := range haystack {
+		set[t] = true
+	}
+	for _, t := range needles {
+		if !set[t] {
+			return false
+		}
+	}
+	return len(needles) > 0
+}
+
+// excerpt cuts the part of content around the first match of a query word
+// and marks every occurrence of the query words in it
+func excerpt(content, query string) []ExcerptPart {
+	text := []rune(content)
+	lower := make([]rune, len(text))
+	for i, r := range text {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	// The query words as typed, not the bigrams, are highlighted
+	var words [][]rune
+	for _, w := range strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		words = append(words, []rune(w))
+	}
+
+	matchAt := func(i int) int {
+		for _, w := range words {
+			if i+len(w) <= len(lower) && string(lower[i:i+len(w)]) == string(w) {
+				return len(w)
+			}
+		}
+		return 0
+	}
+
+	first := -1
+	for i := range lower {
+		if matchAt(i) > 0 {
+			first = i
+			break
+		}
+	}
+	start := 0
+	if first > excerptRunes/4 {
+		start = first - excerptRunes/4
+	}
+	end := min(len(text), start+excerptRunes)
+
+	var parts []ExcerptPart
+	appendPart := func(s string, match bool) {
+		if s == "" {
+			return
+		}
+		if n := len(parts); n > 0 && parts[n-1].Match == match {
+			parts[n-1].Text += s
+			return
+		}
+		parts = append(parts, ExcerptPart{Text: s, Match: match})
+	}
+	if start > 0 {
+		appendPart("…", false)
+	}
+	for i := start; i < end; {
+		if n := matchAt(i); n > 0 {
+			stop := min(i+n, end)
+			appendPart(string(text[i:stop]), true)
+			i = stop
+			continue
+		}
+		appendPart(string(text[i]), false)
+		i++
+	}
+	if end < len(text) {
+		appendPart("…", false)
+	}
+	return parts
+}
+
+// isTextName reports whether the extension of name is a known text format
+func isTextName(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	if textExts[ext] {
+		return true
+	}
+	return strings.HasPrefix(mime.TypeByExtension(ext), "text/")
+}
+
+// isBinaryName reports whether the extension of name is a known format
+// that is not text, so its content does not need to be sniffed
+func isBinaryName(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	if textExts[ext] {
+		return false
+	}
+	mediaType := mime.TypeByExtension(ext)
+	return mediaType != "" && !strings.HasPrefix(mediaType, "text/")
+}
+
+// looksLikeText reports whether data is UTF-8 without NUL bytes
+func looksLikeText(data []byte) bool {
+	head := data
+	if len(head) > 8192 {
+		head = head[:8192]
+		// Do not fail on a rune cut in half
+		for len(head) > 0 && !utf8.RuneStart(data[len(head)]) {
+			head = head[:len(head)-1]
+		}
+	}
+	return len(data) > 0 && bytes.IndexByte(head, 0) < 0 && utf8.Valid(head)
+}
@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"", nil},
+		{"Hello, World!", []string{"hello", "world"}},
+		{"file_share v2.1", []string{"file", "share", "v2", "1"}},
+		{"中文", []string{"中", "文", "中文"}},
+		{"分享文件", []string{"分", "享", "文", "件", "分享", "享文", "文件"}},
+		{"go语言", []string{"go", "语", "言", "语言"}},
+		{"Ünïcödé ÄÖ", []string{"ünïcödé", "äö"}},
+	}
+	for _, tt := range tests {
+		if got := tokenize(tt.input); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+// testIndex returns an index of snippets whose content is kept in texts
+func testIndex(texts map[string]string) *TextIndex {
+	x := NewTextIndex(func(ids []string) map[string]string {
+		contents := make(map[string]string)
+		for _, id := range ids {
+			if content, ok := texts[id]; ok {
+				contents[id] = content
+			}
+		}
+		return contents
+	})
+	for id, content := range texts {
+		x.AddText(id, TextTitle(content), content)
+	}
+	return x
+}
+
+func hitIDs(hits []TextHit) []string {
+	ids := make([]string, len(hits))
+	for i, hit := range hits {
+		ids[i] = hit.ID
+	}
+	return ids
+}
+
+func TestTextIndexSearch(t *testing.T) {
+	x := testIndex(map[string]string{
+		"a": "apple banana",
+		"b": "apple apple apple banana cherry",
+		"c": "recipe\ncherry pie with a very long description of cherries and pastry and more",
+		"d": "文件分享工具",
+		"e": "蛋糕食谱",
+	})
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", nil},
+		{"durian", nil},
+		// Term frequency ranks b above a
+		{"apple", []string{"b", "a"}},
+		// All terms have to match
+		{"apple cherry", []string{"b"}},
+		// The shorter document ranks first at equal frequency
+		{"cherry", []string{"b", "c"}},
+		{"APPLE", []string{"b", "a"}},
+		{"分享", []string{"d"}},
+		{"享工", []string{"d"}},
+		{"食谱", []string{"e"}},
+	}
+	for _, tt := range tests {
+		if got := hitIDs(x.Search(tt.query, 0, nil)); len(got) != len(tt.want) || len(got) > 0 && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Search(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	if got := hitIDs(x.Search("apple", 1, nil)); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("Search with limit 1 = %q", got)
+	}
+	if got := hitIDs(x.Search("apple", 0, func(id string) bool { return id == "a" })); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("Search with keep = %q", got)
+	}
+}
+
+func TestTextIndexExcerpt(t *testing.T) {
+	content := strings.Repeat("lorem ipsum ", 40) + "needle " + strings.Repeat("dolor sit ", 40)
+	x := testIndex(map[string]string{"t": content})
+
+	hits := x.Search("needle", 0, nil)
+	if len(hits) != 1 {
+		t.Fatalf("got %d hits", len(hits))
+	}
+	var matched []string
+	for _, part := range hits[0].Excerpt {
+		if part.Match {
+			matched = append(matched, part.Text)
+		}
+	}
+	if !reflect.DeepEqual(matched, []string{"needle"}) {
+		t.Errorf("matched parts %q", matched)
+	}
+	if first, last := hits[0].Excerpt[0], hits[0].Excerpt[len(hits[0].Excerpt)-1]; !strings.HasPrefix(first.Text, "…") || !strings.HasSuffix(last.Text, "…") {
+		t.Errorf("excerpt is not cut: %q ... %q", first.Text, last.Text)
+	}
+}
+
+func TestTextIndexFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(path, []byte("the quick brown fox"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	x := NewTextIndex(nil)
+	if err := x.AddFile("notes.txt", "notes.txt", path); err != nil {
+		t.Fatal(err)
+	}
+
+	hits := x.Search("fox", 0, nil)
+	if len(hits) != 1 || hits[0].Kind != "file" || len(hits[0].Excerpt) == 0 {
+		t.Fatalf("Search(fox) = %+v", hits)
+	}
+	for _, doc := range x.docs {
+		// The terms of the name count as well
+		if doc.path != path || doc.length != 6 {
+			t.Errorf("indexed %+v", doc)
+		}
+	}
+
+	// The excerpt is read from disk, a file removed since has none
+	os.Remove(path)
+	if hits := x.Search("fox", 0, nil); len(hits) != 1 || hits[0].Excerpt != nil {
+		t.Errorf("Search after removal = %+v", hits)
+	}
+
+	x.RemovePrefix("notes.txt")
+	if x.Len() != 0 || len(x.postings) != 0 || x.totalLen != 0 {
+		t.Errorf("index not empty after removal: %d docs, %d terms", x.Len(), len(x.postings))
+	}
+}
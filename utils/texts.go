@@ -0,0 +1,389 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// textTitleRunes is the length of a text title before it is cut
+	textTitleRunes = 20
+	// textIntroRunes is the length of a text intro
+	textIntroRunes = 100
+	// MaxTextSize is the largest message in bytes
+	MaxTextSize = 256 * 1024
+)
+
+// TextMessage is a shared text such as a pasted clipboard
+type TextMessage struct {
+	ID      string `json:"id"`
+	Title   string `json:"title"`
+	Content string `json:"content"`
+	Author  string `json:"author"`
+	// Client is the address of the client that posted the message, only
+	// it and the host may edit or delete the message
+	Client string `json:"client,omitempty"`
+	// CreatedAt and UpdatedAt are unix milliseconds
+	CreatedAt int64 `json:"createdAt"`
+	UpdatedAt int64 `json:"updatedAt"`
+	Pinned    bool  `json:"pinned"`
+	// Format is one of TextPlain, TextMarkdown or TextCode, Language names
+	// the programming language of code snippets
+	Format   string `json:"format"`
+	Language string `json:"language,omitempty"`
+	// HTML is the sanitized rendering of markdown messages
+	HTML string `json:"html,omitempty"`
+	// Room is the room the message was posted in, see RoomName
+	Room string `json:"room"`
+}
+
+// Formats of a TextMessage
+const (
+	TextPlain    = "plain"
+	TextMarkdown = "markdown"
+	TextCode     = "code"
+)
+
+var textLanguageRe = regexp.MustCompile(`^[a-z0-9_+#.-]{0,32}$`)
+
+// ParseTextFormat validates the format and language of a message. An empty
+// format is plain text, the language is only kept for code.
+func ParseTextFormat(format, language string) (string, string, error) {
+	language = strings.ToLower(strings.TrimSpace(language))
+	switch format {
+	case "", TextPlain:
+		return TextPlain, "", nil
+	case TextMarkdown:
+		return TextMarkdown, "", nil
+	case TextCode:
+		if !textLanguageRe.MatchString(language) {
+			return "", "", fmt.Errorf("invalid language %q", language)
+		}
+		return TextCode, language, nil
+	}
+	return "", "", fmt.Errorf("invalid format %q", format)
+}
+
+// render fills the derived fields after the content or format changed
+func (m *TextMessage) render() {
+	m.Title = TextTitle(m.Content)
+	m.HTML = ""
+	if m.Format == TextMarkdown {
+		m.HTML = RenderMarkdown(m.Content)
+	}
+}
+
+// FileInfo returns the message as a text entry of a file listing
+func (m TextMessage) FileInfo() FileInfo {
+	return FileInfo{
+		Type:     "text",
+		ID:       m.ID,
+		Name:     m.Title,
+		Username: m.Author,
+		Content:  m.Content,
+		Intro:    truncateRunes(m.Content, textIntroRunes, ""),
+		ModTime:  m.UpdatedAt,
+		Pinned:   m.Pinned,
+		Format:   m.Format,
+		Language: m.Language,
+		Room:     m.Room,
+	}
+}
+
+// TextTitle derives a title from the first non-empty line of text, cut
+// after 20 characters without splitting a multi-byte character
+func TextTitle(text string) string {
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return truncateRunes(line, textTitleRunes, "...")
+		}
+	}
+	return ""
+}
+
+// truncateRunes cuts s after n characters, appending suffix when cut
+func truncateRunes(s string, n int, suffix string) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n]) + suffix
+}
+
+// TextPage is a page of messages in chronological order
+type TextPage struct {
+	Texts []TextMessage `json:"texts"`
+	// Before is the cursor of the previous, older page, empty when there
+	// are no older messages
+	Before string `json:"before"`
+	Total  int    `json:"total"`
+}
+
+// TextStore is the history of shared texts persisted in a Storage
+type TextStore struct {
+	mutex   sync.Mutex
+	storage *Storage
+	logger  Logger
+}
+
+// NewTextStore creates a text store persisted in storage. A nil logger
+// prints to standard output.
+func NewTextStore(storage *Storage, logger Logger) *TextStore {
+	if logger == nil {
+		logger = StdoutLogger()
+	}
+	return &TextStore{storage: storage, logger: logger}
+}
+
+// getTextDBKey returns the storage key for the text history
+func getTextDBKey() string {
+	return "Texts:" + getMachineID()
+}
+
+// load reads all messages ordered by creation, the caller holds the lock
+func (s *TextStore) load() ([]TextMessage, error) {
+	value, err := s.storage.GetItem(getTextDBKey(), "[]")
+	if err != nil {
+		return nil, err
+	}
+
+	var texts []TextMessage
+	if err := json.Unmarshal([]byte(value.(string)), &texts); err != nil {
+		return nil, fmt.Errorf("failed to parse text database: %v", err)
+	}
+	// Messages stored before formats and rooms existed are plain text in
+	// the default room
+	for i := range texts {
+		if texts[i].Format == "" {
+			texts[i].Format = TextPlain
+		}
+		texts[i].Room = RoomName(texts[i].Room)
+	}
+	return texts, nil
+}
+
+// save persists all messages, the caller holds the lock
+func (s *TextStore) save(texts []TextMessage) error {
+	sort.SliceStable(texts, func(i, j int) bool {
+		if texts[i].CreatedAt != texts[j].CreatedAt {
+			return texts[i].CreatedAt < texts[j].CreatedAt
+		}
+		return texts[i].ID < texts[j].ID
+	})
+	jsonData, err := json.Marshal(texts)
+	if err != nil {
+		return fmt.Errorf("failed to marshal text database: %v", err)
+	}
+	return s.storage.SetItem(getTextDBKey(), string(jsonData))
+}
+
+// Add stores message as a new message. Its Content, Author, Client, Room,
+// Format and Language are used, the format is checked with ParseTextFormat.
+func (s *TextStore) Add(message TextMessage) (TextMessage, error) {
+	format, language, err := ParseTextFormat(message.Format, message.Language)
+	if err != nil {
+		return TextMessage{}, err
+	}
+	return s.insert(TextMessage{
+		Content:  message.Content,
+		Format:   format,
+		Language: language,
+		Author:   message.Author,
+		Client:   message.Client,
+		Room:     RoomName(message.Room),
+	}, time.Now().UnixMilli())
+}
+
+// insert stores message as a new message created at createdAt
+func (s *TextStore) insert(message TextMessage, createdAt int64) (TextMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	texts, err := s.load()
+	if err != nil {
+		return TextMessage{}, err
+	}
+
+	message.ID = newTextID()
+	message.CreatedAt = createdAt
+	message.UpdatedAt = createdAt
+	message.render()
+	texts = append(texts, message)
+	return message, s.save(texts)
+}
+
+// Get returns the message with id
+func (s *TextStore) Get(id string) (TextMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	texts, err := s.load()
+	if err != nil {
+		return TextMessage{}, err
+	}
+	for _, text := range texts {
+		if text.ID == id {
+			return text, nil
+		}
+	}
+	return TextMessage{}, fmt.Errorf("text %s not found", id)
+}
+
+// Update applies update to the message with id and persists it. The title,
+// rendering and update time follow a changed content or format.
+func (s *TextStore) Update(id string, update func(*TextMessage)) (TextMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	texts, err := s.load()
+	if err != nil {
+		return TextMessage{}, err
+	}
+	for i := range texts {
+		if texts[i].ID != id {
+			continue
+		}
+		old := texts[i]
+		update(&texts[i])
+		texts[i].ID, texts[i].Client = id, old.Client
+		format, language, err := ParseTextFormat(texts[i].Format, texts[i].Language)
+		if err != nil {
+			return TextMessage{}, err
+		}
+		texts[i].Format, texts[i].Language = format, language
+		if texts[i].Content != old.Content || texts[i].Format != old.Format || texts[i].Language != old.Language {
+			texts[i].render()
+			texts[i].UpdatedAt = time.Now().UnixMilli()
+		}
+		return texts[i], s.save(texts)
+	}
+	return TextMessage{}, fmt.Errorf("text %s not found", id)
+}
+
+// Delete removes the message with id
+func (s *TextStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	texts, err := s.load()
+	if err != nil {
+		return err
+	}
+	for i := range texts {
+		if texts[i].ID == id {
+			return s.save(append(texts[:i], texts[i+1:]...))
+		}
+	}
+	return fmt.Errorf("text %s not found", id)
+}
+
+// DeleteRoom removes all messages of room and returns their ids
+func (s *TextStore) DeleteRoom(room string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	texts, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	kept := texts[:0]
+	for _, text := range texts {
+		if text.Room == room {
+			ids = append(ids, text.ID)
+		} else {
+			kept = append(kept, text)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return ids, s.save(kept)
+}
+
+// List returns all messages in chronological order
+func (s *TextStore) List() ([]TextMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.load()
+}
+
+// Page returns up to limit of the newest messages of room created before
+// the message with id before, or the newest messages when before is empty.
+// With pinnedOnly only pinned messages are considered.
+func (s *TextStore) Page(room, before string, limit int, pinnedOnly bool) (TextPage, error) {
+	texts, err := s.List()
+	if err != nil {
+		return TextPage{}, err
+	}
+	room = RoomName(room)
+	selected := texts[:0]
+	for _, text := range texts {
+		if text.Room == room && (text.Pinned || !pinnedOnly) {
+			selected = append(selected, text)
+		}
+	}
+	texts = selected
+
+	end := len(texts)
+	if before != "" {
+		end = -1
+		for i, text := range texts {
+			if text.ID == before {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return TextPage{}, fmt.Errorf("text %s not found", before)
+		}
+	}
+	start := 0
+	if limit > 0 && end-limit > 0 {
+		start = end - limit
+	}
+
+	page := TextPage{Texts: texts[start:end], Total: len(texts)}
+	if start > 0 {
+		page.Before = texts[start].ID
+	}
+	return page, nil
+}
+
+// Import moves the text entries of older versions, which were kept in the
+// file database, into the store. Their order is kept by name as they carry
+// no timestamps.
+func (s *TextStore) Import(files *FileStore) error {
+	entries, err := files.ListFiles()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixMilli()
+	for i, entry := range entries {
+		if entry.Type != "text" {
+			continue
+		}
+		message := TextMessage{Content: entry.Content, Format: TextPlain, Author: entry.Username, Room: RoomName(entry.Room)}
+		if _, err := s.insert(message, now-int64(len(entries)-i)); err != nil {
+			return err
+		}
+		if err := files.RemoveFile(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newTextID returns a random message id
+func newTextID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,244 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	// Register the decoders of the supported thumbnail sources
+	_ "image/gif"
+)
+
+const (
+	// DefaultThumbnailSize is the default bounding box of a thumbnail
+	DefaultThumbnailSize = 256
+	// MaxThumbnailSize is the largest thumbnail that can be requested
+	MaxThumbnailSize = 1024
+	// maxThumbnailPixels refuses images whose decoded bitmap would be too
+	// large to hold in memory
+	maxThumbnailPixels = 64 << 20
+)
+
+// thumbnailExts are the image formats thumbnails are generated for
+var thumbnailExts = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+}
+
+// CanThumbnail reports whether a thumbnail can be generated for a file name
+func CanThumbnail(name string) bool {
+	return thumbnailExts[strings.ToLower(filepath.Ext(name))]
+}
+
+// ThumbnailCache generates image thumbnails and keeps them in a directory.
+// A cached thumbnail is named after the source path, its version (size and
+// modification time) and the thumbnail size. Generating a thumbnail for a
+// new version of an image removes those of older versions.
+type ThumbnailCache struct {
+	dir   string
+	mutex sync.Mutex
+	// pending holds the generation locks by source, guarded by mutex
+	pending map[string]*thumbnailLock
+}
+
+// thumbnailLock serializes the thumbnail generations of one source
+type thumbnailLock struct {
+	sync.Mutex
+	// users counts the requests holding or waiting for the lock
+	users int
+}
+
+// NewThumbnailCache creates a thumbnail cache stored in dir
+func NewThumbnailCache(dir string) *ThumbnailCache {
+	return &ThumbnailCache{dir: dir, pending: make(map[string]*thumbnailLock)}
+}
+
+// Thumbnail returns the path and content type of a thumbnail of the image at
+// path fitting into a size x size box, generating it if it is not cached.
+// JPEG sources produce JPEG thumbnails, everything else PNG to keep
+// transparency.
+func (c *ThumbnailCache) Thumbnail(path string, size int) (string, string, error) {
+	if size <= 0 {
+		size = DefaultThumbnailSize
+	}
+	if size > MaxThumbnailSize {
+		size = MaxThumbnailSize
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", "", err
+	}
+	if info.IsDir() {
+		return "", "", fmt.Errorf("%s is a directory", path)
+	}
+
+	ext, contentType := ".png", "image/png"
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg":
+		ext, contentType = ".jpg", "image/jpeg"
+	}
+
+	sourceSum := sha256.Sum256([]byte(filepath.Clean(path)))
+	source := hex.EncodeToString(sourceSum[:16])
+	versionSum := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%d", info.Size(), info.ModTime().UnixNano())))
+	version := hex.EncodeToString(versionSum[:8])
+	dir := filepath.Join(c.dir, source[:2])
+	thumbPath := filepath.Join(dir, fmt.Sprintf("%s-%s-%d%s", source, version, size, ext))
+
+	// Requests for the same source wait for a single generation
+	lock := c.lock(source)
+	lock.Lock()
+	defer func() {
+		lock.Unlock()
+		c.unlock(source)
+	}()
+
+	if _, err := os.Stat(thumbPath); err == nil {
+		return thumbPath, contentType, nil
+	}
+	if err := generateThumbnail(path, thumbPath, size); err != nil {
+		return "", "", err
+	}
+
+	// Drop the thumbnails of older versions of the image in any size
+	if cached, err := filepath.Glob(filepath.Join(dir, source+"-*")); err == nil {
+		for _, p := range cached {
+			if !strings.HasPrefix(filepath.Base(p), source+"-"+version+"-") {
+				os.Remove(p)
+			}
+		}
+	}
+	return thumbPath, contentType, nil
+}
+
+// lock returns the generation lock of source
+func (c *ThumbnailCache) lock(source string) *thumbnailLock {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	lock, ok := c.pending[source]
+	if !ok {
+		lock = &thumbnailLock{}
+		c.pending[source] = lock
+	}
+	lock.users++
+	return lock
+}
+
+// unlock gives back the generation lock of source, forgetting it once no
+// request uses it
+func (c *ThumbnailCache) unlock(source string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	lock := c.pending[source]
+	if lock.users--; lock.users == 0 {
+		delete(c.pending, source)
+	}
+}
+
+// generateThumbnail decodes the image at src and writes a scaled down copy
+// to dst
+func generateThumbnail(src, dst string, size int) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open image: %v", err)
+	}
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %v", err)
+	}
+	if config.Width*config.Height > maxThumbnailPixels {
+		return fmt.Errorf("image too large: %dx%d", config.Width, config.Height)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	thumb := scaleImage(img, size)
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create thumbnail directory: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "thumb-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create thumbnail: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if filepath.Ext(dst) == ".jpg" {
+		err = jpeg.Encode(tmp, thumb, &jpeg.Options{Quality: 80})
+	} else {
+		err = png.Encode(tmp, thumb)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode thumbnail: %v", err)
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// scaleImage shrinks img to fit into a size x size box, averaging the source
+// pixels covered by each target pixel. Images already small enough are only
+// converted.
+func scaleImage(img image.Image, size int) *image.RGBA {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	dstW, dstH := srcW, srcH
+	if srcW > size || srcH > size {
+		if srcW >= srcH {
+			dstW, dstH = size, max(1, srcH*size/srcW)
+		} else {
+			dstW, dstH = max(1, srcW*size/srcH), size
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	if dstW == srcW && dstH == srcH {
+		draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+		return dst
+	}
+
+	for y := 0; y < dstH; y++ {
+		y0 := bounds.Min.Y + y*srcH/dstH
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*srcH/dstH)
+		for x := 0; x < dstW; x++ {
+			x0 := bounds.Min.X + x*srcW/dstW
+			x1 := max(x0+1, bounds.Min.X+(x+1)*srcW/dstW)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(b / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
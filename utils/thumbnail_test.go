@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeTestImage writes a w x h PNG to path
+func writeTestImage(t *testing.T, path string, w, h int) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// cachedThumbnails returns the files kept by the cache in dir
+func cachedThumbnails(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files
+}
+
+func TestThumbnailCache(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "a.png")
+	writeTestImage(t, src, 300, 150)
+	dir := t.TempDir()
+	c := NewThumbnailCache(dir)
+
+	small, contentType, err := c.Thumbnail(src, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "image/png" {
+		t.Errorf("content type %q", contentType)
+	}
+	f, err := os.Open(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := png.DecodeConfig(f)
+	f.Close()
+	if err != nil || config.Width != 64 || config.Height != 32 {
+		t.Errorf("thumbnail is %dx%d, %v", config.Width, config.Height, err)
+	}
+
+	again, _, err := c.Thumbnail(src, 64)
+	if err != nil || again != small {
+		t.Errorf("cached thumbnail %q, %v, want %q", again, err, small)
+	}
+	if _, _, err := c.Thumbnail(src, 128); err != nil {
+		t.Fatal(err)
+	}
+	if files := cachedThumbnails(t, dir); len(files) != 2 {
+		t.Fatalf("cached %v, want two sizes", files)
+	}
+
+	// A new version of the image replaces the thumbnails of all sizes
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(src, later, later); err != nil {
+		t.Fatal(err)
+	}
+	fresh, _, err := c.Thumbnail(src, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh == small {
+		t.Fatal("changed image kept its thumbnail path")
+	}
+	if files := cachedThumbnails(t, dir); len(files) != 1 || files[0] != fresh {
+		t.Errorf("cached %v, want only %s", files, fresh)
+	}
+}
+
+func TestThumbnailCacheConcurrent(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "a.png")
+	writeTestImage(t, src, 200, 200)
+	dir := t.TempDir()
+	c := NewThumbnailCache(dir)
+
+	var wg sync.WaitGroup
+	paths := make([]string, 16)
+	for i := range paths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path, _, err := c.Thumbnail(src, 32+i%2*32)
+			if err != nil {
+				t.Error(err)
+			}
+			paths[i] = path
+		}()
+	}
+	wg.Wait()
+
+	if files := cachedThumbnails(t, dir); len(files) != 2 {
+		t.Errorf("cached %v, want one per size", files)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.pending) != 0 {
+		t.Errorf("%d generation locks left", len(c.pending))
+	}
+}
@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// certValidity is how long a generated self-signed certificate stays valid
+const certValidity = 365 * 24 * time.Hour
+
+// GetCertHosts returns the host names and IP addresses a self-signed
+// certificate should cover on this machine
+func GetCertHosts() []string {
+	hosts := []string{"localhost", GetLoopback("ipv4"), GetLoopback("ipv6")}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		hosts = append(hosts, hostname)
+	}
+	for _, family := range []string{"ipv4", "ipv6"} {
+		for _, name := range GetNetInterfaceNames(family) {
+			hosts = append(hosts, GetIPAddresses(name, family)...)
+		}
+	}
+	return hosts
+}
+
+// LoadOrCreateCertificate loads the certificate at certFile/keyFile. When
+// generate is true and the files are missing, expired or do not cover all of
+// hosts, a new self-signed ECDSA certificate is generated and persisted there.
+func LoadOrCreateCertificate(certFile, keyFile string, hosts []string, generate bool) (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil && (!generate || certCovers(cert, hosts)) {
+		return cert, nil
+	}
+	if !generate {
+		return tls.Certificate{}, fmt.Errorf("failed to load certificate: %v", err)
+	}
+
+	if err := GenerateSelfSignedCertificate(certFile, keyFile, hosts); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// GenerateSelfSignedCertificate writes a new self-signed ECDSA certificate
+// and its private key as PEM files
+func GenerateSelfSignedCertificate(certFile, keyFile string, hosts []string) error {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate private key: %v", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("failed to generate serial number: %v", err)
+	}
+
+	notBefore := time.Now().Add(-time.Hour)
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"file-share"}, CommonName: "file-share"},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(certValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if h != "" {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("failed to marshal private key: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certFile), 0755); err != nil {
+		return fmt.Errorf("failed to create certificate directory: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		return fmt.Errorf("failed to create key directory: %v", err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certFile, certPem, 0644); err != nil {
+		return fmt.Errorf("failed to write certificate: %v", err)
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(keyFile, keyPem, 0600); err != nil {
+		return fmt.Errorf("failed to write private key: %v", err)
+	}
+	return nil
+}
+
+// CertificateFingerprint returns the SHA-256 fingerprint of the leaf
+// certificate formatted as colon separated hex pairs
+func CertificateFingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// certCovers reports whether cert is still valid and covers every host
+func certCovers(cert tls.Certificate, hosts []string) bool {
+	if len(cert.Certificate) == 0 {
+		return false
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false
+	}
+	if time.Now().Add(24 * time.Hour).After(leaf.NotAfter) {
+		return false
+	}
+	for _, h := range hosts {
+		if h == "" {
+			continue
+		}
+		if err := leaf.VerifyHostname(h); err != nil {
+			return false
+		}
+	}
+	return true
+}
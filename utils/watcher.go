@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+)
+
+// ErrWatcherClosed is returned when adding to a closed watcher
+var ErrWatcherClosed = errors.New("watcher closed")
+
+// Operations of a WatchEvent
+const (
+	WatchCreated = "created"
+	WatchChanged = "changed"
+	WatchDeleted = "deleted"
+)
+
+// WatchEvent is a change below a watched root
+type WatchEvent struct {
+	// Op is one of WatchCreated, WatchChanged or WatchDeleted
+	Op string
+	// Key and Root are the values the root was added to the watcher with
+	Key  string
+	Root string
+	// Path is the absolute path of the changed file
+	Path  string
+	IsDir bool
+}
+
+// RelPath returns the path of the event relative to its root with slashes,
+// or "" for the root itself
+func (e WatchEvent) RelPath() string {
+	rel, err := filepath.Rel(e.Root, e.Path)
+	if err != nil || rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// underRoot reports whether path is root or inside of it
+func underRoot(path, root string) bool {
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
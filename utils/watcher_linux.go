@@ -0,0 +1,351 @@
+//go:build linux
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// dirWatchMask watches the entries of a directory
+	dirWatchMask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_DELETE |
+		unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+	// fileWatchMask watches a single shared file
+	fileWatchMask = unix.IN_CLOSE_WRITE | unix.IN_ATTRIB | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+)
+
+// Watcher reports changes below a set of roots using inotify. Directories
+// are watched recursively, directories created later included.
+type Watcher struct {
+	fd     int
+	logger Logger
+	events chan WatchEvent
+
+	mutex   sync.Mutex
+	roots   map[string]string
+	watches map[int]string
+	paths   map[string]int
+	full    bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewWatcher creates a watcher without roots. A nil logger prints to
+// standard output.
+func NewWatcher(logger Logger) (*Watcher, error) {
+	if logger == nil {
+		logger = StdoutLogger()
+	}
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify init: %v", err)
+	}
+
+	w := &Watcher{
+		fd:      fd,
+		logger:  logger,
+		events:  make(chan WatchEvent, 256),
+		roots:   make(map[string]string),
+		watches: make(map[int]string),
+		paths:   make(map[string]int),
+		done:    make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go w.readEvents()
+	return w, nil
+}
+
+// Events delivers the changes, it is closed by Close
+func (w *Watcher) Events() <-chan WatchEvent {
+	return w.events
+}
+
+// Add watches root, a file or a directory tree, reporting its changes
+// under key. Adding a key again replaces its root.
+func (w *Watcher) Add(key, root string) error {
+	select {
+	case <-w.done:
+		return ErrWatcherClosed
+	default:
+	}
+	root = filepath.Clean(root)
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if old, ok := w.roots[key]; ok && old != root {
+		delete(w.roots, key)
+		w.unwatchTree(old, true)
+	}
+	w.roots[key] = root
+
+	if !info.IsDir() {
+		return w.watch(root, fileWatchMask)
+	}
+	return w.watchTree(root)
+}
+
+// Remove stops watching the root added as key
+func (w *Watcher) Remove(key string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	root, ok := w.roots[key]
+	if !ok {
+		return
+	}
+	delete(w.roots, key)
+	w.unwatchTree(root, true)
+}
+
+// Roots returns the watched roots by key
+func (w *Watcher) Roots() map[string]string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	keys := make(map[string]string, len(w.roots))
+	for key, root := range w.roots {
+		keys[key] = root
+	}
+	return keys
+}
+
+// Close stops watching and closes the Events channel
+func (w *Watcher) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.done)
+		w.wg.Wait()
+		unix.Close(w.fd)
+		close(w.events)
+	})
+	return nil
+}
+
+// watchTree watches dir and all directories below it, the caller holds
+// the lock
+func (w *Watcher) watchTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if err := w.watch(path, dirWatchMask); err != nil {
+			if errors.Is(err, unix.ENOSPC) {
+				return fs.SkipAll
+			}
+			if path == dir {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// watch adds an inotify watch for path, the caller holds the lock
+func (w *Watcher) watch(path string, mask uint32) error {
+	if _, ok := w.paths[path]; ok {
+		return nil
+	}
+	wd, err := unix.InotifyAddWatch(w.fd, path, mask)
+	if err != nil {
+		if errors.Is(err, unix.ENOSPC) && !w.full {
+			w.full = true
+			w.logger.Printf("watch limit reached, raise fs.inotify.max_user_watches to watch everything\n")
+		}
+		return err
+	}
+	w.watches[wd] = path
+	w.paths[path] = wd
+	return nil
+}
+
+// unwatchTree removes the watches of path and everything below it. With
+// keepCovered watches another root still includes are kept. The caller holds
+// the lock.
+func (w *Watcher) unwatchTree(path string, keepCovered bool) {
+	for watched, wd := range w.paths {
+		if !underRoot(watched, path) || keepCovered && w.covered(watched) {
+			continue
+		}
+		unix.InotifyRmWatch(w.fd, uint32(wd))
+		delete(w.paths, watched)
+		delete(w.watches, wd)
+	}
+}
+
+// covered reports whether a root still includes path, the caller holds the
+// lock
+func (w *Watcher) covered(path string) bool {
+	for _, root := range w.roots {
+		if underRoot(path, root) {
+			return true
+		}
+	}
+	return false
+}
+
+// readEvents reads and dispatches inotify events until Close
+func (w *Watcher) readEvents() {
+	defer w.wg.Done()
+	buf := make([]byte, 64*1024)
+	for {
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+
+		fds := []unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, 500)
+		if err != nil && err != unix.EINTR {
+			w.logger.Printf("watch poll error: %v\n", err)
+			return
+		}
+		if n <= 0 {
+			continue
+		}
+
+		n, err = unix.Read(w.fd, buf)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			w.logger.Printf("watch read error: %v\n", err)
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(raw.Len)]), "\x00")
+			offset = nameStart + int(raw.Len)
+			w.handle(int(raw.Wd), raw.Mask, name)
+		}
+	}
+}
+
+// handle translates one inotify event into watch events
+func (w *Watcher) handle(wd int, mask uint32, name string) {
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		w.logger.Printf("watch event queue overflowed, changes were missed\n")
+		return
+	}
+
+	w.mutex.Lock()
+	dir, ok := w.watches[wd]
+	if mask&unix.IN_IGNORED != 0 {
+		if ok {
+			delete(w.watches, wd)
+			if w.paths[dir] == wd {
+				delete(w.paths, dir)
+			}
+		}
+		w.mutex.Unlock()
+		return
+	}
+	w.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	path := dir
+	if name != "" {
+		path = filepath.Join(dir, name)
+	}
+	isDir := mask&unix.IN_ISDIR != 0
+
+	switch {
+	case mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+		w.emit(WatchCreated, path, isDir)
+		if isDir {
+			w.created(path)
+		}
+	case mask&(unix.IN_CLOSE_WRITE|unix.IN_ATTRIB) != 0:
+		// Deleting a file changes its link count first, skip that
+		if _, err := os.Lstat(path); err == nil && !isDir {
+			w.emit(WatchChanged, path, false)
+		}
+	case mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+		w.emit(WatchDeleted, path, isDir)
+		if isDir {
+			w.mutex.Lock()
+			w.unwatchTree(path, false)
+			w.mutex.Unlock()
+		}
+	case mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF) != 0:
+		// Entries inside roots are reported by their parent, only a
+		// vanished root needs its own event
+		w.mutex.Lock()
+		isRoot := false
+		for _, root := range w.roots {
+			if root == path {
+				isRoot = true
+			}
+		}
+		if mask&unix.IN_MOVE_SELF != 0 {
+			w.unwatchTree(path, false)
+		} else if w.paths[path] == wd {
+			// The watch is gone with the file, forget it right away so
+			// that adding a replacement before IN_IGNORED arrives watches
+			// the new file
+			delete(w.paths, path)
+		}
+		w.mutex.Unlock()
+		if isRoot {
+			w.emit(WatchDeleted, path, false)
+		}
+	}
+}
+
+// created watches a new directory and reports what was created inside of it
+// before the watch was in place
+func (w *Watcher) created(dir string) {
+	w.mutex.Lock()
+	w.watchTree(dir)
+	w.mutex.Unlock()
+
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return nil
+		}
+		w.emit(WatchCreated, path, d.IsDir())
+		return nil
+	})
+}
+
+// emit sends an event for every root containing path
+func (w *Watcher) emit(op, path string, isDir bool) {
+	w.mutex.Lock()
+	var events []WatchEvent
+	for key, root := range w.roots {
+		if underRoot(path, root) {
+			events = append(events, WatchEvent{Op: op, Key: key, Root: root, Path: path, IsDir: isDir})
+		}
+	}
+	w.mutex.Unlock()
+
+	for _, event := range events {
+		select {
+		case w.events <- event:
+		case <-w.done:
+			return
+		}
+	}
+}
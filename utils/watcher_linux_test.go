@@ -0,0 +1,116 @@
+//go:build linux
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// nextEvent returns the next event of w or fails after a second
+func nextEvent(t *testing.T, w *Watcher) WatchEvent {
+	t.Helper()
+	select {
+	case event := <-w.Events():
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no watch event")
+	}
+	return WatchEvent{}
+}
+
+func TestWatcherReportsChanges(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWatcher(DiscardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Add("docs", dir); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, w); event.Op != WatchCreated || event.Path != sub || !event.IsDir || event.Key != "docs" {
+		t.Fatalf("mkdir: %+v", event)
+	}
+
+	// The new directory is watched as well
+	file := filepath.Join(sub, "a.txt")
+	if err := os.WriteFile(file, []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, w); event.Op != WatchCreated || event.RelPath() != "sub/a.txt" {
+		t.Fatalf("create: %+v", event)
+	}
+	if event := nextEvent(t, w); event.Op != WatchChanged || event.Path != file {
+		t.Fatalf("write: %+v", event)
+	}
+
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, w); event.Op != WatchDeleted || event.Path != file {
+		t.Fatalf("remove: %+v", event)
+	}
+}
+
+func TestWatcherReAddsReplacedRoot(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(root, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the reader goroutine the events are handled in the order the
+	// test chooses
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	w := &Watcher{
+		fd:      fd,
+		logger:  DiscardLogger(),
+		events:  make(chan WatchEvent, 16),
+		roots:   make(map[string]string),
+		watches: make(map[int]string),
+		paths:   make(map[string]int),
+		done:    make(chan struct{}),
+	}
+	if err := w.Add("a.txt", root); err != nil {
+		t.Fatal(err)
+	}
+	oldWd := w.paths[root]
+
+	// An editor saves by renaming a new file over the root
+	tmp := root + ".tmp"
+	if err := os.WriteFile(tmp, []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, root); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server re-adds the root on the deletion, before the kernel's
+	// IN_IGNORED for the old watch is handled
+	w.handle(oldWd, unix.IN_DELETE_SELF, "")
+	if event := <-w.events; event.Op != WatchDeleted || event.Path != root {
+		t.Fatalf("delete self: %+v", event)
+	}
+	if err := w.Add("a.txt", root); err != nil {
+		t.Fatal(err)
+	}
+	w.handle(oldWd, unix.IN_IGNORED, "")
+
+	newWd, ok := w.paths[root]
+	if !ok || newWd == oldWd || w.watches[newWd] != root {
+		t.Fatalf("replaced root is not watched: paths %v, watches %v", w.paths, w.watches)
+	}
+}
@@ -0,0 +1,198 @@
+//go:build !linux
+
+package utils
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// watchPollInterval is how often roots are rescanned
+	watchPollInterval = 2 * time.Second
+	// maxPolledEntries bounds the entries tracked per root
+	maxPolledEntries = 20000
+)
+
+// polledEntry is the state of a file at the last scan
+type polledEntry struct {
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+// Watcher reports changes below a set of roots. Without inotify the roots
+// are rescanned periodically and compared with the previous scan.
+type Watcher struct {
+	logger Logger
+	events chan WatchEvent
+
+	mutex sync.Mutex
+	roots map[string]string
+	state map[string]map[string]polledEntry
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewWatcher creates a watcher without roots. A nil logger prints to
+// standard output.
+func NewWatcher(logger Logger) (*Watcher, error) {
+	if logger == nil {
+		logger = StdoutLogger()
+	}
+	w := &Watcher{
+		logger: logger,
+		events: make(chan WatchEvent, 256),
+		roots:  make(map[string]string),
+		state:  make(map[string]map[string]polledEntry),
+		done:   make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go w.poll()
+	return w, nil
+}
+
+// Events delivers the changes, it is closed by Close
+func (w *Watcher) Events() <-chan WatchEvent {
+	return w.events
+}
+
+// Add watches root, a file or a directory tree, reporting its changes
+// under key. Adding a key again replaces its root.
+func (w *Watcher) Add(key, root string) error {
+	select {
+	case <-w.done:
+		return ErrWatcherClosed
+	default:
+	}
+	root = filepath.Clean(root)
+	if _, err := os.Stat(root); err != nil {
+		return err
+	}
+	state := scanRoot(root)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.roots[key] = root
+	w.state[key] = state
+	return nil
+}
+
+// Remove stops watching the root added as key
+func (w *Watcher) Remove(key string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	delete(w.roots, key)
+	delete(w.state, key)
+}
+
+// Roots returns the watched roots by key
+func (w *Watcher) Roots() map[string]string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	roots := make(map[string]string, len(w.roots))
+	for key, root := range w.roots {
+		roots[key] = root
+	}
+	return roots
+}
+
+// Close stops watching and closes the Events channel
+func (w *Watcher) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.done)
+		w.wg.Wait()
+		close(w.events)
+	})
+	return nil
+}
+
+// poll rescans all roots until Close
+func (w *Watcher) poll() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+
+		for key, root := range w.Roots() {
+			current := scanRoot(root)
+			w.mutex.Lock()
+			previous, ok := w.state[key]
+			if ok {
+				w.state[key] = current
+			}
+			w.mutex.Unlock()
+			if !ok {
+				continue
+			}
+			if !w.diff(key, root, previous, current) {
+				return
+			}
+		}
+	}
+}
+
+// diff emits the differences between two scans of root. It returns false
+// once the watcher is closed.
+func (w *Watcher) diff(key, root string, previous, current map[string]polledEntry) bool {
+	send := func(op, path string, isDir bool) bool {
+		select {
+		case w.events <- WatchEvent{Op: op, Key: key, Root: root, Path: path, IsDir: isDir}:
+			return true
+		case <-w.done:
+			return false
+		}
+	}
+
+	for path, entry := range current {
+		old, ok := previous[path]
+		switch {
+		case !ok:
+			if !send(WatchCreated, path, entry.isDir) {
+				return false
+			}
+		case !entry.isDir && (old.size != entry.size || !old.modTime.Equal(entry.modTime)):
+			if !send(WatchChanged, path, false) {
+				return false
+			}
+		}
+	}
+	for path, entry := range previous {
+		if _, ok := current[path]; !ok {
+			if !send(WatchDeleted, path, entry.isDir) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// scanRoot records the state of root and everything below it
+func scanRoot(root string) map[string]polledEntry {
+	state := make(map[string]polledEntry)
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if len(state) >= maxPolledEntries {
+			return fs.SkipAll
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		state[path] = polledEntry{size: info.Size(), modTime: info.ModTime(), isDir: d.IsDir()}
+		return nil
+	})
+	return state
+}
@@ -2,6 +2,8 @@ package utils
 
 import (
 	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
@@ -9,21 +11,34 @@ import (
 	"strings"
 )
 
-// ZipDirectory creates a zip file from a directory
+// ZipDirectory creates a zip file from a directory. Entries are written in
+// lexical order with their modification times, so an unchanged directory
+// always produces the same archive. On failure the zip file is removed.
 func ZipDirectory(sourceDir, outPath string) error {
 	// Create the output file
 	zipFile, err := os.Create(outPath)
 	if err != nil {
 		return fmt.Errorf("error creating zip file: %v", err)
 	}
-	defer zipFile.Close()
 
+	err = writeZip(zipFile, sourceDir)
+	if closeErr := zipFile.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("error closing zip file: %v", closeErr)
+	}
+	if err != nil {
+		os.Remove(outPath)
+		return err
+	}
+	return nil
+}
+
+// writeZip writes the archive of sourceDir to w
+func writeZip(w io.Writer, sourceDir string) error {
 	// Create a new zip writer
-	zipWriter := zip.NewWriter(zipFile)
-	defer zipWriter.Close()
+	zipWriter := zip.NewWriter(w)
 
 	// Walk through the source directory
-	err = filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+	err := filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -44,7 +59,7 @@ func ZipDirectory(sourceDir, outPath string) error {
 		if err != nil {
 			return fmt.Errorf("error getting relative path: %v", err)
 		}
-		header.Name = relPath
+		header.Name = filepath.ToSlash(relPath)
 
 		// If it's a directory, just create the header
 		if info.IsDir() {
@@ -73,6 +88,11 @@ func ZipDirectory(sourceDir, outPath string) error {
 		return fmt.Errorf("error walking directory: %v", err)
 	}
 
+	// Close writes the central directory, without it the archive is
+	// unreadable
+	if err := zipWriter.Close(); err != nil {
+		return fmt.Errorf("error finishing zip file: %v", err)
+	}
 	return nil
 }
 
@@ -82,3 +102,68 @@ func ParseFileName(path string) string {
 	ext := filepath.Ext(base)
 	return strings.TrimSuffix(base, ext)
 }
+
+// ArchiveKey fingerprints a directory tree by the names, sizes and
+// modification times of all of its entries
+func ArchiveKey(sourceDir string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(sourceDir, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00%s\n", filepath.ToSlash(relPath), info.Size(), info.ModTime().UnixNano(), info.Mode())
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("error walking directory: %v", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CachedZipDirectory returns the path of a zip of sourceDir inside cacheDir,
+// only creating a new archive when the directory tree changed. Archives of
+// older states of the same directory are removed.
+func CachedZipDirectory(sourceDir, cacheDir string) (string, error) {
+	key, err := ArchiveKey(sourceDir)
+	if err != nil {
+		return "", err
+	}
+	dirSum := sha256.Sum256([]byte(filepath.Clean(sourceDir)))
+	prefix := hex.EncodeToString(dirSum[:8]) + "-"
+	archivePath := filepath.Join(cacheDir, prefix+key[:32]+".zip")
+
+	if _, err := os.Stat(archivePath); err == nil {
+		return archivePath, nil
+	}
+
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", fmt.Errorf("error creating archive directory: %v", err)
+	}
+	tmp, err := os.CreateTemp(cacheDir, prefix+"*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("error creating zip file: %v", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := ZipDirectory(sourceDir, tmp.Name()); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), archivePath); err != nil {
+		return "", fmt.Errorf("error storing zip file: %v", err)
+	}
+
+	// Drop archives of previous states of this directory
+	if old, err := filepath.Glob(filepath.Join(cacheDir, prefix+"*.zip")); err == nil {
+		for _, p := range old {
+			if p != archivePath {
+				os.Remove(p)
+			}
+		}
+	}
+	return archivePath, nil
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCachedZipDirectory(t *testing.T) {
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cache := t.TempDir()
+
+	archive, err := CachedZipDirectory(source, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		t.Fatalf("cached archive is unreadable: %v", err)
+	}
+	if len(r.File) != 1 || r.File[0].Name != "a.txt" {
+		t.Errorf("archive holds %v", r.File)
+	}
+	r.Close()
+
+	again, err := CachedZipDirectory(source, cache)
+	if err != nil || again != archive {
+		t.Errorf("unchanged directory got %q, %v, want %q", again, err, archive)
+	}
+}
+
+func TestCachedZipDirectoryFailure(t *testing.T) {
+	source := t.TempDir()
+	// A dangling link cannot be opened, which fails the archive midway
+	if err := os.WriteFile(filepath.Join(source, "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(source, "missing"), filepath.Join(source, "b.txt")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	cache := t.TempDir()
+
+	if archive, err := CachedZipDirectory(source, cache); err == nil {
+		t.Fatalf("archived a broken directory to %s", archive)
+	}
+	entries, err := os.ReadDir(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("failed archive left %v behind", entries)
+	}
+
+	out := filepath.Join(t.TempDir(), "out.zip")
+	if err := ZipDirectory(source, out); err == nil {
+		t.Fatal("ZipDirectory succeeded")
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("failed zip file was kept: %v", err)
+	}
+}
@@ -0,0 +1,323 @@
+// Package websocket implements the server side of the WebSocket protocol
+// (RFC 6455): the opening handshake and message framing, without
+// extensions or subprotocols
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Message types, the opcodes of RFC 6455 5.2
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+
+	continuationFrame = 0
+)
+
+// Close status codes of RFC 6455 7.4.1
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseInvalidPayload  = 1007
+	CloseTooBig          = 1009
+)
+
+// DefaultMaxMessageSize limits the size of a received message
+const DefaultMaxMessageSize = 1 << 20
+
+// acceptGUID is appended to the client key to compute the accept key
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	// ErrClosed is returned by ReadMessage once the peer closed the
+	// connection with a close frame
+	ErrClosed = errors.New("websocket: connection closed")
+	// ErrMessageTooBig is returned for messages above MaxMessageSize
+	ErrMessageTooBig = errors.New("websocket: message too big")
+)
+
+// Conn is a WebSocket connection. One goroutine may read while others
+// write, writes are serialized.
+type Conn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	// MaxMessageSize limits the size of received messages
+	MaxMessageSize int64
+	// ReadTimeout, when set, fails reads if no frame arrives for that long.
+	// Any frame counts, so answered pings keep a connection alive.
+	ReadTimeout time.Duration
+
+	writeLock sync.Mutex
+	closeOnce sync.Once
+	// CloseCode and CloseReason are set when the peer sent a close frame
+	CloseCode   int
+	CloseReason string
+}
+
+// headerContains reports whether the comma separated header values of key
+// contain token, ignoring case
+func headerContains(h http.Header, key, token string) bool {
+	for _, value := range h.Values(key) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AcceptKey returns the Sec-WebSocket-Accept value for a client key
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// IsUpgrade reports whether r asks for a WebSocket connection
+func IsUpgrade(r *http.Request) bool {
+	return headerContains(r.Header, "Connection", "upgrade") && headerContains(r.Header, "Upgrade", "websocket")
+}
+
+// SameOrigin reports whether the Origin header of r, which browsers send
+// with every WebSocket handshake, names the host r was made to. Requests
+// without Origin come from non-browser clients and pass.
+func SameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+// Upgrade completes the opening handshake of r and takes over its
+// connection. Browsers let any page open WebSockets to any host, so
+// handshakes from other origins are refused. On failure an error status
+// has been written to w.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet || !IsUpgrade(r) {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, fmt.Errorf("websocket: not an upgrade request")
+	}
+	if !SameOrigin(r) {
+		http.Error(w, "cross-origin websocket not allowed", http.StatusForbidden)
+		return nil, fmt.Errorf("websocket: origin %q not allowed", r.Header.Get("Origin"))
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("websocket: unsupported version %q", r.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if raw, err := base64.StdEncoding.DecodeString(key); err != nil || len(raw) != 16 {
+		http.Error(w, "invalid websocket key", http.StatusBadRequest)
+		return nil, fmt.Errorf("websocket: invalid key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("websocket: response does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("websocket: hijack: %v", err)
+	}
+
+	// The handshake may not take forever
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + AcceptKey(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("websocket: handshake: %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &Conn{conn: conn, br: rw.Reader, MaxMessageSize: DefaultMaxMessageSize}, nil
+}
+
+// RemoteAddr returns the address of the peer
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// frame is a single received frame
+type frame struct {
+	fin     bool
+	opcode  int
+	payload []byte
+}
+
+// readFrame reads a frame of at most limit payload bytes. Client frames
+// must be masked (RFC 6455 5.1).
+func (c *Conn) readFrame(limit int64) (frame, error) {
+	if c.ReadTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+	}
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return frame{}, err
+	}
+	f := frame{fin: header[0]&0x80 != 0, opcode: int(header[0] & 0x0f)}
+	if header[0]&0x70 != 0 {
+		return f, c.fail(CloseProtocolError, "reserved bits set")
+	}
+	if header[1]&0x80 == 0 {
+		return f, c.fail(CloseProtocolError, "unmasked client frame")
+	}
+
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return f, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return f, err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]) & (1<<63 - 1))
+	}
+	if f.opcode >= CloseMessage && (length > 125 || !f.fin) {
+		return f, c.fail(CloseProtocolError, "invalid control frame")
+	}
+	if length > limit {
+		c.fail(CloseTooBig, "message too big")
+		return f, ErrMessageTooBig
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return f, err
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, f.payload); err != nil {
+		return f, err
+	}
+	for i := range f.payload {
+		f.payload[i] ^= mask[i%4]
+	}
+	return f, nil
+}
+
+// ReadMessage returns the next text or binary message. Pings are answered
+// and fragmented messages reassembled on the way. A close frame from the
+// peer is answered and returns ErrClosed.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	var (
+		messageType int
+		message     []byte
+	)
+	for {
+		f, err := c.readFrame(c.MaxMessageSize - int64(len(message)))
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case PingMessage:
+			if err := c.WriteMessage(PongMessage, f.payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			c.CloseCode = CloseNormal
+			if len(f.payload) >= 2 {
+				c.CloseCode = int(binary.BigEndian.Uint16(f.payload))
+				c.CloseReason = string(f.payload[2:])
+			}
+			c.Close(CloseNormal, "")
+			return 0, nil, ErrClosed
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "expected continuation frame")
+			}
+			messageType = f.opcode
+		case continuationFrame:
+			if messageType == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+		default:
+			return 0, nil, c.fail(CloseProtocolError, "unknown opcode")
+		}
+
+		message = append(message, f.payload...)
+		if f.fin && messageType == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.fail(CloseInvalidPayload, "invalid utf-8")
+		}
+		if f.fin {
+			return messageType, message, nil
+		}
+	}
+}
+
+// WriteMessage sends data as a single frame of messageType
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	header := []byte{0x80 | byte(messageType), 0}
+	switch {
+	case len(data) < 126:
+		header[1] = byte(len(data))
+	case len(data) <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(len(data)))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(len(data)))
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.conn.Write(append(header, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// fail closes the connection with code after a protocol violation
+func (c *Conn) fail(code int, reason string) error {
+	c.Close(code, reason)
+	return fmt.Errorf("websocket: %s", reason)
+}
+
+// Close sends a close frame with code and reason and closes the connection.
+// Further calls do nothing.
+func (c *Conn) Close(code int, reason string) error {
+	var err error
+	c.closeOnce.Do(func() {
+		payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+		if len(reason) > 123 {
+			reason = reason[:123]
+		}
+		c.WriteMessage(CloseMessage, append(payload, reason...))
+		err = c.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,214 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+// clientFrame returns a masked frame as a client sends it
+func clientFrame(fin bool, opcode byte, payload []byte) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	default:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// serverFrames splits the unmasked frames written by the server
+func serverFrames(t *testing.T, data []byte) []frame {
+	t.Helper()
+	var frames []frame
+	for len(data) > 0 {
+		if len(data) < 2 {
+			t.Fatalf("truncated frame header")
+		}
+		f := frame{fin: data[0]&0x80 != 0, opcode: int(data[0] & 0x0f)}
+		length, header := int(data[1]&0x7f), 2
+		switch length {
+		case 126:
+			length, header = int(binary.BigEndian.Uint16(data[2:])), 4
+		case 127:
+			length, header = int(binary.BigEndian.Uint64(data[2:])), 10
+		}
+		f.payload = data[header : header+length]
+		frames = append(frames, f)
+		data = data[header+length:]
+	}
+	return frames
+}
+
+// exchange feeds input to a server connection, reads one message and
+// returns it with everything the server wrote back
+func exchange(t *testing.T, input []byte, maxSize int64) (int, []byte, []frame, error) {
+	t.Helper()
+	server, client := net.Pipe()
+	conn := &Conn{conn: server, br: bufio.NewReader(server), MaxMessageSize: maxSize}
+
+	go client.Write(input)
+	written := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(client)
+		written <- data
+	}()
+
+	messageType, message, err := conn.ReadMessage()
+	server.Close()
+	output := <-written
+	client.Close()
+	return messageType, message, serverFrames(t, output), err
+}
+
+func TestAcceptKey(t *testing.T) {
+	// Example of RFC 6455 1.3
+	if got := AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("AcceptKey = %q", got)
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://share.local:5421", true},
+		{"https://SHARE.local:5421", true},
+		{"http://share.local", false},
+		{"http://evil.example", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://share.local:5421/api/ws", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := SameOrigin(r); got != tt.want {
+			t.Errorf("SameOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	join := func(frames ...[]byte) []byte { return bytes.Join(frames, nil) }
+	unmasked := []byte{0x81, 0x02, 'h', 'i'}
+
+	tests := []struct {
+		name     string
+		input    []byte
+		wantType int
+		want     string
+		wantErr  bool
+		// reply is the opcode of the first frame the server answers with,
+		// closeCode the code of a close reply
+		reply     int
+		closeCode int
+	}{
+		{name: "text", input: clientFrame(true, TextMessage, []byte("hello")), wantType: TextMessage, want: "hello"},
+		{name: "binary", input: clientFrame(true, BinaryMessage, []byte{0, 0xff}), wantType: BinaryMessage, want: "\x00\xff"},
+		{
+			name: "fragmented",
+			input: join(
+				clientFrame(false, TextMessage, []byte("hel")),
+				clientFrame(true, continuationFrame, []byte("lo")),
+			),
+			wantType: TextMessage, want: "hello",
+		},
+		{
+			name: "ping between fragments",
+			input: join(
+				clientFrame(false, TextMessage, []byte("he")),
+				clientFrame(true, PingMessage, []byte("p")),
+				clientFrame(true, continuationFrame, []byte("y")),
+			),
+			wantType: TextMessage, want: "hey", reply: PongMessage,
+		},
+		{name: "unmasked", input: unmasked, wantErr: true, reply: CloseMessage, closeCode: CloseProtocolError},
+		{name: "too big", input: clientFrame(true, TextMessage, make([]byte, 17)), wantErr: true, reply: CloseMessage, closeCode: CloseTooBig},
+		{name: "invalid utf-8", input: clientFrame(true, TextMessage, []byte{0xff}), wantErr: true, reply: CloseMessage, closeCode: CloseInvalidPayload},
+		{name: "stray continuation", input: clientFrame(true, continuationFrame, []byte("x")), wantErr: true, reply: CloseMessage, closeCode: CloseProtocolError},
+		{name: "fragmented control", input: clientFrame(false, PingMessage, nil), wantErr: true, reply: CloseMessage, closeCode: CloseProtocolError},
+		{name: "peer close", input: clientFrame(true, CloseMessage, []byte{0x03, 0xe9}), wantErr: true, reply: CloseMessage, closeCode: CloseNormal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messageType, message, replies, err := exchange(t, tt.input, 16)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ReadMessage succeeded with %q", message)
+				}
+			} else if err != nil || messageType != tt.wantType || string(message) != tt.want {
+				t.Fatalf("ReadMessage = %d, %q, %v, want %d, %q", messageType, message, err, tt.wantType, tt.want)
+			}
+
+			if tt.reply == 0 {
+				if len(replies) != 0 {
+					t.Fatalf("unexpected replies %v", replies)
+				}
+				return
+			}
+			if len(replies) == 0 || replies[0].opcode != tt.reply {
+				t.Fatalf("replies = %v, want opcode %d first", replies, tt.reply)
+			}
+			if tt.closeCode != 0 {
+				if code := int(binary.BigEndian.Uint16(replies[0].payload)); code != tt.closeCode {
+					t.Fatalf("close code = %d, want %d", code, tt.closeCode)
+				}
+			}
+		})
+	}
+}
+
+func TestPeerCloseCode(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &Conn{conn: server, br: bufio.NewReader(server), MaxMessageSize: DefaultMaxMessageSize}
+	go client.Write(clientFrame(true, CloseMessage, append([]byte{0x03, 0xe9}, "bye"...)))
+	go io.Copy(io.Discard, client)
+
+	if _, _, err := conn.ReadMessage(); err != ErrClosed {
+		t.Fatalf("ReadMessage error = %v, want ErrClosed", err)
+	}
+	if conn.CloseCode != CloseGoingAway || conn.CloseReason != "bye" {
+		t.Fatalf("close = %d %q", conn.CloseCode, conn.CloseReason)
+	}
+}
+
+func TestWriteMessageLengths(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		server, client := net.Pipe()
+		conn := &Conn{conn: server, br: bufio.NewReader(server)}
+		payload := bytes.Repeat([]byte{'a'}, size)
+		go func() {
+			conn.WriteMessage(BinaryMessage, payload)
+			server.Close()
+		}()
+		data, _ := io.ReadAll(client)
+		client.Close()
+
+		frames := serverFrames(t, data)
+		if len(frames) != 1 || !frames[0].fin || frames[0].opcode != BinaryMessage || len(frames[0].payload) != size {
+			t.Fatalf("size %d: got %d frames", size, len(frames))
+		}
+		if data[1]&0x80 != 0 {
+			t.Fatalf("size %d: server frame is masked", size)
+		}
+	}
+}